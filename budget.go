@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/containerd/cgroups/v3/cgroup2"
+	"github.com/containerd/cgroups/v3/cgroup2/stats"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Fraction of a budget from which the limits are tightened, down to the baseline when it is exhausted
+	BudgetTightenFrom = 0.9
+	// Interval between the saves of the consumed budget
+	BudgetSaveInterval = time.Minute
+)
+
+// Consumption persisted in -budget-state, so that a resumed run continues where the previous one stopped
+type budgetState struct {
+	CPUSeconds float64 `json:"cpuSeconds"` // CPU time, in core-seconds
+	IOBytes    uint64  `json:"ioBytes"`    // Bytes read and written
+}
+
+// Caps the total consumption of the process, e.g. 100 CPU-core-hours and 1TB of IO, on top of the
+// rate limits: when a budget nears exhaustion the limits are tightened, then the process is paused
+// (frozen) or terminated
+type budget struct {
+	mu        sync.Mutex
+	cpu       float64 // Core-seconds, 0 if not bounded
+	io        uint64  // Bytes, 0 if not bounded
+	path      string
+	previous  budgetState // Consumed by previous runs
+	consumed  budgetState // Including previous runs
+	baseCPU   uint64      // Counters of the cgroup when first measured (µs and bytes)
+	baseIO    uint64
+	measured  bool
+	exhausted bool
+	savedAt   time.Time
+}
+
+// Budget of the process, nil without -cpu-budget and -io-budget
+var resourceBudget *budget
+
+func newBudget(cpuCoreHours float64, io uint64, path string) (*budget, error) {
+	b := &budget{cpu: cpuCoreHours * 3600, io: io, path: path}
+	if path != "" {
+		content, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, err
+		default:
+			if err = json.Unmarshal(content, &b.previous); err != nil {
+				return nil, fmt.Errorf("invalid budget state %s: %w", path, err)
+			}
+			log.Printf("Resuming budget: %.0f core-seconds and %d IO bytes already consumed\n", b.previous.CPUSeconds, b.previous.IOBytes)
+		}
+	}
+	b.consumed = b.previous
+	return b, nil
+}
+
+// Continue from the consumption of a previous run
+func (b *budget) resume(consumed budgetState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.previous, b.consumed = consumed, consumed
+	log.Printf("Resuming budget: %.0f core-seconds and %d IO bytes already consumed\n", consumed.CPUSeconds, consumed.IOBytes)
+}
+
+// Consumption including previous runs
+func (b *budget) consumption() budgetState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.consumed
+}
+
+// Account the cumulative usage of the cgroup
+func (b *budget) update(cgStats *stats.Metrics) {
+	cpuUsec := cgStats.GetCPU().GetUsageUsec()
+	var io uint64
+	for _, entry := range cgStats.GetIo().GetUsage() {
+		io = saturatingAdd(io, saturatingAdd(entry.GetRbytes(), entry.GetWbytes()))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.measured {
+		// The cgroup may already have been used before process-scaler (-cgroup-path)
+		b.baseCPU, b.baseIO, b.measured = cpuUsec, io, true
+	}
+	b.consumed.CPUSeconds = b.previous.CPUSeconds + float64(clampedDelta(cpuUsec, b.baseCPU))/1e6
+	b.consumed.IOBytes = saturatingAdd(b.previous.IOBytes, clampedDelta(io, b.baseIO))
+
+	if b.path != "" && clock.Now().Sub(b.savedAt) >= BudgetSaveInterval {
+		b.saveLocked()
+	}
+}
+
+// Fraction consumed of the most consumed budget
+func (b *budget) fraction() float64 {
+	fraction := 0.0
+	if b.cpu > 0 {
+		fraction = math.Max(fraction, b.consumed.CPUSeconds/b.cpu)
+	}
+	if b.io > 0 {
+		fraction = math.Max(fraction, float64(b.consumed.IOBytes)/float64(b.io))
+	}
+	return fraction
+}
+
+// Tighten the limits as the budget nears exhaustion, linearly from BudgetTightenFrom to the baseline
+func (b *budget) apply(limits *Limits) {
+	b.mu.Lock()
+	fraction := b.fraction()
+	b.mu.Unlock()
+	if fraction < BudgetTightenFrom {
+		return
+	}
+
+	factor := math.Max(0, (1-fraction)/(1-BudgetTightenFrom))
+	if b.cpu > 0 {
+		limits.CPUQuota = int64(math.Max(BaselineCPUQuota, float64(limits.CPUQuota)*factor))
+	}
+	if b.io > 0 {
+		io := make([]cgroup2.Entry, len(limits.IO))
+		for i, entry := range limits.IO {
+			entry.Rate = uint64(math.Max(BaselineIOBPS, float64(entry.Rate)*factor))
+			io[i] = entry
+		}
+		limits.IO = io
+	}
+}
+
+// Pause or terminate the process once the budget is exhausted, return whether it is
+func (b *budget) enforce(cgManager cgroupManager) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exhausted || b.fraction() < 1 {
+		return b.exhausted
+	}
+	b.exhausted = true
+	if b.path != "" {
+		b.saveLocked()
+	}
+
+	if cfg.budgetAction == "pause" {
+		log.Printf("Budget exhausted (%.0f core-seconds, %d IO bytes), freezing the process\n", b.consumed.CPUSeconds, b.consumed.IOBytes)
+		if err := cgManager.Freeze(); err != nil {
+			log.Printf("Warning: could not freeze the cgroup: %s\n", err)
+		}
+		return true
+	}
+
+	log.Printf("Budget exhausted (%.0f core-seconds, %d IO bytes), stopping the process with %s\n", b.consumed.CPUSeconds, b.consumed.IOBytes, cfg.stopSignal)
+	pids, err := cgManager.Procs(true)
+	if err != nil {
+		log.Printf("Warning: could not list the processes of the cgroup: %s\n", err)
+	}
+	for _, pid := range pids {
+		_ = syscall.Kill(int(pid), cfg.stopSignal)
+	}
+	return true
+}
+
+// Whether the budget was exhausted
+func (b *budget) isExhausted() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.exhausted
+}
+
+func (b *budget) save() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.path != "" {
+		b.saveLocked()
+	}
+}
+
+func (b *budget) saveLocked() {
+	b.savedAt = clock.Now()
+	content, err := json.Marshal(b.consumed)
+	if err == nil {
+		err = os.WriteFile(b.path, append(content, '\n'), 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: could not save the budget state %s: %s\n", b.path, err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// Bump when the cache format or the meaning of its values changes
+	BenchmarkCacheVersion = 1
+	// Benchmark method, part of the fingerprint so that changing it invalidates cached values
+	BenchmarkMethod = "read:hdparm -Tt of the disk;write:dd bs=8k count=10k on one filesystem"
+	// Written by the benchmark subcommand, read by default by every run
+	DefaultBenchmarkCache = "/var/lib/process-scaler/io-benchmark.json"
+)
+
+type benchmarkCache struct {
+	Version int                        `json:"version"`
+	Devices map[string]cachedBenchmark `json:"devices"` // By kernel name
+}
+
+type cachedBenchmark struct {
+	// Hash of what the values depend on (kernel, device, benchmark method)
+	Fingerprint  string    `json:"fingerprint"`
+	Read         uint64    `json:"read"`
+	Write        uint64    `json:"write"`
+	ReadTool     string    `json:"readTool"`
+	WriteTool    string    `json:"writeTool"`
+	WritesTested bool      `json:"writesTested"`
+	MeasuredAt   time.Time `json:"measuredAt"`
+	Model        string    `json:"model"`
+	Serial       string    `json:"serial"`
+	BaselineUtil float64   `json:"baselineUtil"`
+}
+
+func kernelRelease() string {
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(release))
+}
+
+func benchmarkFingerprint(device lsblkOutputJSON, kernel string) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{
+		kernel,
+		strings.TrimSpace(device.Model),
+		strings.TrimSpace(device.Serial),
+		BenchmarkMethod,
+	}, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+// Load the cache, an empty cache is returned if it doesn't exist or is from an incompatible version
+func loadBenchmarkCache(path string) benchmarkCache {
+	empty := benchmarkCache{Version: BenchmarkCacheVersion, Devices: make(map[string]cachedBenchmark)}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: could not read benchmark cache %s: %s\n", path, err)
+		}
+		return empty
+	}
+	var cache benchmarkCache
+	if err = json.Unmarshal(content, &cache); err != nil {
+		log.Printf("Warning: invalid benchmark cache %s, benchmarking again: %s\n", path, err)
+		return empty
+	}
+	if cache.Version != BenchmarkCacheVersion {
+		slog.Info("Benchmark cache from another version, benchmarking again", "path", path, "version", cache.Version)
+		return empty
+	}
+	if cache.Devices == nil {
+		cache.Devices = make(map[string]cachedBenchmark)
+	}
+	return cache
+}
+
+// Return the cached benchmark of the device, if it is still valid
+func (c benchmarkCache) get(device lsblkOutputJSON, kernel string) (maxIO, bool) {
+	cached, exists := c.Devices[device.Kname]
+	if !exists {
+		return maxIO{}, false
+	}
+	if cached.Fingerprint != benchmarkFingerprint(device, kernel) {
+		slog.Info("Cached benchmark outdated (kernel, device or method changed)", "device", device.Kname)
+		return maxIO{}, false
+	}
+	if cfg.benchmarkCacheTTL > 0 && time.Since(cached.MeasuredAt) > cfg.benchmarkCacheTTL {
+		slog.Info("Cached benchmark expired", "device", device.Kname, "ttl", cfg.benchmarkCacheTTL)
+		return maxIO{}, false
+	}
+	return maxIO{
+		read:         cached.Read,
+		write:        cached.Write,
+		readTool:     cached.ReadTool,
+		writeTool:    cached.WriteTool,
+		writesTested: cached.WritesTested,
+		measuredAt:   cached.MeasuredAt,
+		source:       benchmarkSourceCached,
+		model:        cached.Model,
+		serial:       cached.Serial,
+		baselineUtil: cached.BaselineUtil,
+	}, true
+}
+
+// Drop the devices that no longer exist, e.g. replaced disks
+func (c benchmarkCache) prune(devices map[string]lsblkOutputJSON) {
+	for name := range c.Devices {
+		if _, exists := devices[name]; !exists {
+			delete(c.Devices, name)
+		}
+	}
+}
+
+func (c benchmarkCache) set(device lsblkOutputJSON, kernel string, max maxIO) {
+	c.Devices[device.Kname] = cachedBenchmark{
+		Fingerprint:  benchmarkFingerprint(device, kernel),
+		Read:         max.read,
+		Write:        max.write,
+		ReadTool:     max.readTool,
+		WriteTool:    max.writeTool,
+		WritesTested: max.writesTested,
+		MeasuredAt:   max.measuredAt,
+		Model:        max.model,
+		Serial:       max.serial,
+		BaselineUtil: max.baselineUtil,
+	}
+}
+
+func (c benchmarkCache) save(path string) error {
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+// Write a file and its directory, through a temporary file renamed over it, so that a crash never
+// leaves a truncated file behind for the next run to read
+func writeFileAtomic(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
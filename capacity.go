@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/containerd/cgroups/v3/cgroup2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timeout of a capacity request, it is polled on each tick
+const CapacityRequestTimeout = 500 * time.Millisecond
+
+// Capacity the process is allowed to use, the limits computed from the local headroom are bounded by it
+// A nil field is not bounded, ex: {"cpu": 4, "memory": 8589934592}
+type Capacity struct {
+	CPU    *float64 `json:"cpu,omitempty"`    // Cores
+	Memory *int64   `json:"memory,omitempty"` // Bytes
+	IOBPS  *uint64  `json:"ioBPS,omitempty"`  // Bytes per second, on each device for both read and write
+}
+
+// A CapacityProvider knows how much the process is allowed to use, e.g. an external scheduler
+type CapacityProvider interface {
+	Capacity() (Capacity, error)
+}
+
+// Only the locally measured headroom applies
+type localCapacity struct{}
+
+func (localCapacity) Capacity() (Capacity, error) {
+	return Capacity{}, nil
+}
+
+// Polls the capacity, as JSON, from an HTTP endpoint
+type httpCapacity struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPCapacity(url string) *httpCapacity {
+	return &httpCapacity{url: url, client: &http.Client{Timeout: CapacityRequestTimeout}}
+}
+
+func (p *httpCapacity) Capacity() (Capacity, error) {
+	resp, err := p.client.Get(p.url)
+	if err != nil {
+		return Capacity{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Capacity{}, fmt.Errorf("capacity endpoint %s returned %s", p.url, resp.Status)
+	}
+	var capacity Capacity
+	if err = json.NewDecoder(resp.Body).Decode(&capacity); err != nil {
+		return Capacity{}, fmt.Errorf("invalid capacity from %s: %w", p.url, err)
+	}
+	return capacity, nil
+}
+
+// Bound the limits by the capacity, numCores converts cores to the CPU quota
+func (c Capacity) apply(limits *Limits, numCores int) {
+	if c.Memory != nil && limits.MemoryMax > *c.Memory {
+		limits.MemoryMax = *c.Memory
+	}
+	if c.CPU != nil && numCores > 0 && limits.CPUPeriod > 0 {
+		if maxQuota := int64(*c.CPU / float64(numCores) * float64(limits.CPUPeriod)); limits.CPUQuota > maxQuota {
+			limits.CPUQuota = maxQuota
+		}
+	}
+	if c.IOBPS != nil {
+		io := make([]cgroup2.Entry, len(limits.IO))
+		for i, entry := range limits.IO {
+			if entry.Rate > *c.IOBPS {
+				entry.Rate = *c.IOBPS
+			}
+			io[i] = entry
+		}
+		limits.IO = io
+	}
+}
+
+// Capacity of the machine, or of the cgroup process-scaler runs in if it is more limited
+// (e.g. in a container), to resolve the limits given as percentages
+func detectCapacity() (cores float64, memory int64, err error) {
+	cores = float64(runtime.NumCPU())
+	if cpuAffinity != nil {
+		cores = float64(len(cpuAffinity))
+	}
+	v, err := system.VirtualMemory()
+	if err != nil {
+		return 0, 0, err
+	}
+	memory = int64(v.Total)
+
+	group, err := processCgroup(os.Getpid())
+	if err != nil {
+		return cores, memory, nil
+	}
+	// Limits of the ancestors apply as well, the most restrictive one wins
+	for dir := filepath.Join(CgroupRoot, group); strings.HasPrefix(dir, CgroupRoot+"/"); dir = filepath.Dir(dir) {
+		if content, err := os.ReadFile(filepath.Join(dir, "memory.max")); err == nil {
+			if limit, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err == nil && limit < memory {
+				memory = limit
+			}
+		}
+		// Format: "<quota> <period>", quota is "max" when unlimited
+		if content, err := os.ReadFile(filepath.Join(dir, "cpu.max")); err == nil {
+			var quota, period float64
+			if _, err := fmt.Sscanf(string(content), "%f %f", &quota, &period); err == nil && period > 0 && quota/period < cores {
+				cores = quota / period
+			}
+		}
+	}
+	return cores, memory, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/containerd/cgroups/v3/cgroup2"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroups left behind by process-scaler instances that crashed: named after the PID of their
+// process (see createCgroup), which is no longer alive, and without processes
+// A cgroup whose process died may still hold its descendants or the other processes of -pid: it is
+// reported but left in place, as deleting it through systemd would kill them
+func orphanedCgroups() ([]string, error) {
+	entries, err := os.ReadDir(CgroupRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, "process_scaler_") || !strings.HasSuffix(name, ".slice") {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "process_scaler_"), ".slice"))
+		if err != nil || processAlive(pid) {
+			continue
+		}
+		populated, err := cgroupPopulated(name)
+		if err != nil {
+			log.Printf("Warning: could not check whether %s has processes, left in place: %s\n", name, err)
+			continue
+		}
+		if populated {
+			log.Printf("Warning: %s still has processes, left in place\n", name)
+			continue
+		}
+		orphans = append(orphans, name)
+	}
+	return orphans, nil
+}
+
+// Whether a cgroup (or one of its descendants) has processes, from the "populated" key of cgroup.events
+func cgroupPopulated(name string) (bool, error) {
+	content, err := os.ReadFile(filepath.Join(CgroupRoot, name, "cgroup.events"))
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if value, found := strings.CutPrefix(line, "populated "); found {
+			return value != "0", nil
+		}
+	}
+	return false, fmt.Errorf("no populated key in %s/cgroup.events", name)
+}
+
+// Delete an orphaned cgroup through systemd if it created it, directly otherwise
+// Only called on cgroups without processes: stopping the slice would kill them
+func deleteOrphanedCgroup(name string) error {
+	if systemdBooted() {
+		if m, err := cgroup2.LoadSystemd("/", name); err == nil && m.DeleteSystemd() == nil {
+			if _, err := os.Stat(CgroupRoot + "/" + name); os.IsNotExist(err) {
+				return nil
+			}
+		}
+	}
+	m, err := cgroup2.Load("/" + name)
+	if err != nil {
+		return err
+	}
+	return m.Delete()
+}
+
+func runCleanup(args []string) {
+	flags := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the orphaned cgroups")
+	_ = flags.Parse(args)
+
+	orphans, err := orphanedCgroups()
+	if err != nil {
+		fatal(err)
+	}
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned cgroup")
+		return
+	}
+
+	failed := false
+	for _, name := range orphans {
+		if *dryRun {
+			fmt.Printf("Orphaned: %s\n", name)
+			continue
+		}
+		if err := deleteOrphanedCgroup(name); err != nil {
+			log.Printf("Warning: could not remove %s: %s\n", name, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Removed %s\n", name)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "time"
+
+// Time source of the control loop: the loop and its delta windows only use it, so that it can be
+// replaced to run the loop deterministically, advancing a fake time instead of sleeping
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	// Deliver ticks every d, until stop is called
+	Tick(d time.Duration) (ticks <-chan time.Time, stop func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (realClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+	return ticker.C, ticker.Stop
+}
+
+var clock Clock = realClock{}
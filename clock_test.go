@@ -0,0 +1,335 @@
+package main
+
+import (
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/mem"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Clock moved forward by the test: Sleep returns right away, advancing the time
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	ticks chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticks: make(chan time.Time, 1)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) { c.advance(d) }
+
+// The ticks are the ones sent by the test
+func (c *fakeClock) Tick(time.Duration) (<-chan time.Time, func()) {
+	return c.ticks, func() {}
+}
+
+func (c *fakeClock) advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// System whose CPU times follow the clock: `cores` cores (4 by default), one of them busy
+// The IO counters and the memory are set by the test, the busy time of the disks follows the clock
+type fakeSystem struct {
+	clock   *fakeClock
+	start   time.Time
+	cores   int
+	io      map[string]disk.IOCountersStat
+	busy    map[string]float64 // Fraction of the time each disk is busy
+	memory  mem.VirtualMemoryStat
+	ioMutex sync.Mutex
+}
+
+func newFakeSystem(clock *fakeClock) *fakeSystem {
+	return &fakeSystem{
+		clock:  clock,
+		start:  clock.Now(),
+		cores:  4,
+		io:     make(map[string]disk.IOCountersStat),
+		busy:   make(map[string]float64),
+		memory: mem.VirtualMemoryStat{Total: 8 << 30, Available: 4 << 30, Free: 4 << 30},
+	}
+}
+
+func (s *fakeSystem) CPUTimes(perCPU bool) ([]cpu.TimesStat, error) {
+	elapsed := s.clock.Now().Sub(s.start).Seconds()
+	perCore := []cpu.TimesStat{{CPU: "cpu0", User: elapsed}}
+	for i := 1; i < s.cores; i++ {
+		perCore = append(perCore, cpu.TimesStat{CPU: "cpu" + strconv.Itoa(i), Idle: elapsed})
+	}
+	if !perCPU {
+		return []cpu.TimesStat{sumCPUTimes("cpu-total", perCore)}, nil
+	}
+	return perCore, nil
+}
+
+func (s *fakeSystem) IOCounters() (map[string]disk.IOCountersStat, error) {
+	s.ioMutex.Lock()
+	defer s.ioMutex.Unlock()
+	elapsed := s.clock.Now().Sub(s.start)
+	counters := make(map[string]disk.IOCountersStat, len(s.io))
+	for name, counter := range s.io {
+		counter.IoTime += uint64(s.busy[name] * float64(elapsed.Milliseconds()))
+		counters[name] = counter
+	}
+	return counters, nil
+}
+
+func (s *fakeSystem) setBusy(name string, fraction float64) {
+	s.ioMutex.Lock()
+	defer s.ioMutex.Unlock()
+	s.busy[name] = fraction
+}
+
+func (s *fakeSystem) setIO(name string, counter disk.IOCountersStat) {
+	s.ioMutex.Lock()
+	defer s.ioMutex.Unlock()
+	s.io[name] = counter
+}
+
+func (s *fakeSystem) VirtualMemory() (*mem.VirtualMemoryStat, error) {
+	memory := s.memory
+	return &memory, nil
+}
+
+// Run the test on a fake clock and a fake system, with the given disks benchmarked at 1GB/s
+func useFakeTime(t *testing.T, disks ...lsblkOutputJSON) (*fakeClock, *fakeSystem) {
+	resetGlobals(t)
+	savedLsblk, savedBenchmark := lsblk, ioBenchmark
+	t.Cleanup(func() {
+		lsblk, ioBenchmark = savedLsblk, savedBenchmark
+	})
+
+	c := newFakeClock()
+	s := newFakeSystem(c)
+	clock, system = c, s
+	lsblk = make(map[string]lsblkOutputJSON)
+	ioBenchmark = make(map[string]maxIO)
+	for _, disk := range disks {
+		lsblk[disk.Kname] = disk
+		ioBenchmark[disk.Kname] = maxIO{
+			read:         1 << 30,
+			write:        1 << 30,
+			readTool:     "hdparm",
+			writeTool:    "dd",
+			writesTested: true,
+			measuredAt:   time.Now(),
+			source:       benchmarkSourceMeasured,
+		}
+	}
+	return c, s
+}
+
+func TestIORatesOverTheClockInterval(t *testing.T) {
+	sda := lsblkOutputJSON{Name: "sda", Kname: "sda", MajMin: "8:0", Type: "disk"}
+	c, s := useFakeTime(t, sda)
+	s.setIO("sda", disk.IOCountersStat{})
+	initIOCounters(newFakeCgroup())
+
+	// 200MiB read over 2s of the clock, whatever the real time elapsed
+	c.advance(2 * time.Second)
+	s.setIO("sda", disk.IOCountersStat{ReadBytes: 200 << 20, WriteBytes: 50 << 20})
+	samples, err := sampleIO(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("got %d samples, want 1", len(samples))
+	}
+	if samples[0].cgRead != 100<<20 || samples[0].cgWrite != 25<<20 {
+		t.Errorf("got %.0f read and %.0f written per second, want %d and %d", samples[0].cgRead, samples[0].cgWrite, 100<<20, 25<<20)
+	}
+	if want := float64(1<<30 - 100<<20); samples[0].availableRead != want {
+		t.Errorf("got %.0f available to read, want %.0f", samples[0].availableRead, want)
+	}
+}
+
+// A disk that appears is only a baseline on its first observation, and throttled from its second
+func TestNewDiskThrottledFromItsSecondObservation(t *testing.T) {
+	sda := lsblkOutputJSON{Name: "sda", Kname: "sda", MajMin: "8:0", Type: "disk"}
+	sdb := lsblkOutputJSON{Name: "sdb", Kname: "sdb", MajMin: "8:16", Type: "disk"}
+	c, s := useFakeTime(t, sda, sdb)
+	s.setIO("sda", disk.IOCountersStat{})
+	initIOCounters(newFakeCgroup())
+
+	c.advance(time.Second)
+	s.setIO("sdb", disk.IOCountersStat{ReadBytes: 1 << 30})
+	samples, err := sampleIO(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].minor != 0 {
+		t.Fatalf("got %+v, want only sda", samples)
+	}
+
+	c.advance(time.Second)
+	s.setIO("sdb", disk.IOCountersStat{ReadBytes: 1<<30 + 10<<20})
+	if samples, err = sampleIO(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("got %+v, want sda and sdb", samples)
+	}
+	for _, sample := range samples {
+		if sample.minor == 16 && sample.cgRead != 10<<20 {
+			t.Errorf("sdb read %.0f per second, want %d (not the bytes read before it appeared)", sample.cgRead, 10<<20)
+		}
+	}
+}
+
+// The limits are held while the process is idle, and scaled again once it is active
+func TestIdleProcessHoldsItsLimits(t *testing.T) {
+	c, _ := useFakeTime(t)
+	cfg.idleCPUThreshold = 0.5
+	cfg.idleIOThreshold = 64 << 10
+	m := newFakeCgroup()
+	s := newTestScaler(m, fixedPolicy{Limits{MemoryMax: 512 << 20, CPUQuota: 50000, CPUPeriod: 100000}})
+
+	active, idle := testSnapshot(), testSnapshot()
+	idle.CPU.cg = 10000 // 0.1 core
+	for i, tick := range []struct {
+		snapshot Snapshot
+		applied  bool
+	}{
+		// The first limits are applied even when idle, the process must not run unbounded
+		{idle, true},
+		{active, true},
+		{idle, false},
+		{idle, false},
+		{active, true},
+	} {
+		now := c.advance(time.Second)
+		if err := s.step(tick.snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if s.State().Applied != tick.applied {
+			t.Errorf("tick %d: applied %t, want %t", i, !tick.applied, tick.applied)
+		}
+		if tick.applied && !state.updatedAt.Equal(now) {
+			t.Errorf("tick %d: limits updated at %s, want %s", i, state.updatedAt, now)
+		}
+	}
+	if len(m.updates) != 3 {
+		t.Errorf("got %d updates, want 3", len(m.updates))
+	}
+}
+
+// The state is saved at most once per StateSaveInterval, unless forced
+func TestStateSavedOncePerInterval(t *testing.T) {
+	c, _ := useFakeTime(t)
+	cfg.stateFile = filepath.Join(t.TempDir(), "state.json")
+	s := newTestScaler(newFakeCgroup(), fixedPolicy{})
+
+	savedAt := func() time.Time {
+		t.Helper()
+		saved, err := loadState(cfg.stateFile)
+		if err != nil || saved == nil {
+			t.Fatalf("state not loaded: %v", err)
+		}
+		return saved.SavedAt
+	}
+
+	first := c.Now()
+	s.saveState(false)
+	for _, step := range []struct {
+		after time.Duration
+		force bool
+		saved time.Duration // Offset of the last save from the first one
+	}{
+		{StateSaveInterval / 2, false, 0},
+		{StateSaveInterval/2 - time.Second, false, 0},
+		{time.Second, false, StateSaveInterval},
+		{time.Second, true, StateSaveInterval + time.Second},
+		{StateSaveInterval - time.Second, false, StateSaveInterval + time.Second},
+		{time.Second, false, 2*StateSaveInterval + time.Second},
+	} {
+		now := c.advance(step.after)
+		s.saveState(step.force)
+		if got := savedAt(); !got.Equal(first.Add(step.saved)) {
+			t.Errorf("at %s: state saved at %s, want %s", now.Sub(first), got.Sub(first), step.saved)
+		}
+	}
+}
+
+// The warmup measures over the intervals of the clock, without sleeping
+func TestWarmupOnTheClock(t *testing.T) {
+	c, _ := useFakeTime(t)
+	m := newFakeCgroup()
+	initCPUTimes(m)
+	initIOCounters(m)
+	s := newTestScaler(m, greedyPolicy{})
+
+	start, startedAt := c.Now(), time.Now()
+	if err := s.Warmup(3, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := c.Now().Sub(start); elapsed != 30*time.Second {
+		t.Errorf("warmup took %s of the clock, want 30s", elapsed)
+	}
+	if time.Since(startedAt) > 5*time.Second {
+		t.Error("warmup slept in real time")
+	}
+	if len(m.updates) != 1 {
+		t.Fatalf("got %d updates, want 1", len(m.updates))
+	}
+	// Over the 30s of the clock, 3 of the 4 cores were idle: the greedy policy grants them minus the
+	// margin of 10% of the machine, on top of the process not using any
+	if got := m.updates[0].CPU.Max; got != "65000 100000" {
+		t.Errorf("cpu.max %q, want 65000 100000", got)
+	}
+}
+
+// The utilization of a disk before its benchmark is measured over the clock, waiting for it to be idle
+func TestBaselineIOOnTheClock(t *testing.T) {
+	sda := lsblkOutputJSON{Name: "sda", Kname: "sda", MajMin: "8:0", Type: "disk"}
+	c, s := useFakeTime(t, sda)
+	s.setIO("sda", disk.IOCountersStat{})
+	startedAt := time.Now()
+
+	// Not measured without -benchmark-wait-idle
+	start := c.Now()
+	if util := measureBaselineIO("sda"); util != -1 || !c.Now().Equal(start) {
+		t.Errorf("got %g after %s, want -1 right away", util, c.Now().Sub(start))
+	}
+
+	cfg.benchmarkWaitIdle = 3 * time.Second
+	for _, test := range []struct {
+		name    string
+		kname   string
+		busy    float64
+		util    float64
+		elapsed time.Duration
+	}{
+		{"idle", "sda", 0, 0, time.Second},
+		{"idle enough", "sda", 0.1, 0.1, time.Second},
+		// Measured until the wait is over
+		{"busy", "sda", 0.5, 0.5, 4 * time.Second},
+		{"unknown", "sdb", 0, -1, time.Second},
+	} {
+		s.setBusy("sda", test.busy)
+		start := c.Now()
+		if util := measureBaselineIO(test.kname); util != test.util {
+			t.Errorf("%s: got %g, want %g", test.name, util, test.util)
+		}
+		if elapsed := c.Now().Sub(start); elapsed != test.elapsed {
+			t.Errorf("%s: measured over %s of the clock, want %s", test.name, elapsed, test.elapsed)
+		}
+	}
+	if time.Since(startedAt) > 5*time.Second {
+		t.Error("the measurements slept in real time")
+	}
+}
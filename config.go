@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Settings loaded from -config, a YAML file, e.g.:
+//
+//	margins:
+//	  cpu: 0.2
+//	  memory: 0.1
+//	interval: 2s
+//	controllers: [memory, cpu]
+//	benchmarkCache: /var/lib/process-scaler/io-benchmark.json
+//	log:
+//	  format: json
+//	  level: debug
+//	options:
+//	  min-memory: 512Mi
+//
+// Each setting is applied as the flag it stands for, so that they are validated in one place, with
+// the flags; the flags given on the command line (or in the systemd unit) take precedence
+type Config struct {
+	Margins struct {
+		CPU    *float64 `yaml:"cpu"`
+		Memory *float64 `yaml:"memory"`
+		IO     *float64 `yaml:"io"`
+		GPU    *float64 `yaml:"gpu"`
+	} `yaml:"margins"`
+	Interval       string   `yaml:"interval"`
+	Controllers    []string `yaml:"controllers"`
+	BenchmarkCache *string  `yaml:"benchmarkCache"` // Empty to disable the cache
+	Log            struct {
+		File     string `yaml:"file"`
+		Format   string `yaml:"format"`
+		Level    string `yaml:"level"`
+		MaxSize  string `yaml:"maxSize"`
+		MaxFiles *int   `yaml:"maxFiles"`
+	} `yaml:"log"`
+	Options map[string]string `yaml:"options"` // Any other flag, by name
+}
+
+// Load the config file, unknown keys are rejected so that typos are not silently ignored
+func loadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	var config Config
+	if err = decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// Values of the flags set by the config, by flag name
+func (c *Config) flags() map[string]string {
+	flags := make(map[string]string, len(c.Options))
+	for name, value := range c.Options {
+		flags[name] = value
+	}
+	setFloat := func(name string, value *float64) {
+		if value != nil {
+			flags[name] = strconv.FormatFloat(*value, 'g', -1, 64)
+		}
+	}
+	setString := func(name, value string) {
+		if value != "" {
+			flags[name] = value
+		}
+	}
+	setFloat("cpu-margin", c.Margins.CPU)
+	setFloat("mem-margin", c.Margins.Memory)
+	setFloat("io-margin", c.Margins.IO)
+	setFloat("gpu-margin", c.Margins.GPU)
+	setString("interval", c.Interval)
+	if len(c.Controllers) > 0 {
+		flags["controllers"] = strings.Join(c.Controllers, ",")
+	}
+	if c.BenchmarkCache != nil {
+		flags["benchmark-cache"] = *c.BenchmarkCache
+	}
+	setString("log-file", c.Log.File)
+	setString("log-format", c.Log.Format)
+	setString("log-level", c.Log.Level)
+	setString("log-max-size", c.Log.MaxSize)
+	if c.Log.MaxFiles != nil {
+		flags["log-max-files"] = strconv.Itoa(*c.Log.MaxFiles)
+	}
+	return flags
+}
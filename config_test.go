@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Parse the command line like process-scaler, on a fresh set of flags
+func parseTestFlags(t *testing.T, args ...string) {
+	t.Helper()
+	resetGlobals(t)
+	savedArgs, savedFlags := os.Args, flag.CommandLine
+	savedPolicy, savedShadows := activePolicy, shadowPolicies
+	t.Cleanup(func() {
+		os.Args, flag.CommandLine = savedArgs, savedFlags
+		activePolicy, shadowPolicies = savedPolicy, savedShadows
+	})
+	os.Args = append([]string{"process-scaler"}, args...)
+	flag.CommandLine = flag.NewFlagSet("process-scaler", flag.ExitOnError)
+	parseFlags()
+}
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Each setting of the config file is the flag it stands for
+func TestConfigMatchesFlags(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, "process-scaler.yaml", `
+margins:
+  cpu: 0.2
+  memory: 0.15
+  io: 0.3
+  gpu: 0.25
+interval: 2s
+controllers: [memory, cpu]
+benchmarkCache: `+dir+`/io-benchmark.json
+log:
+  file: `+dir+`/process-scaler.log
+  format: json
+  level: debug
+  maxSize: 5Mi
+  maxFiles: 3
+options:
+  policy: target
+  min-memory: 512Mi
+  reserve-cpu: "0.5"
+`)
+
+	parseTestFlags(t, "-config", path, "true")
+	fromConfig := cfg
+	parseTestFlags(t,
+		"-cpu-margin", "0.2", "-mem-margin", "0.15", "-io-margin", "0.3", "-gpu-margin", "0.25",
+		"-interval", "2s", "-controllers", "memory,cpu", "-benchmark-cache", dir+"/io-benchmark.json",
+		"-log-file", dir+"/process-scaler.log", "-log-format", "json", "-log-level", "debug",
+		"-log-max-size", "5Mi", "-log-max-files", "3",
+		"-policy", "target", "-min-memory", "512Mi", "-reserve-cpu", "0.5",
+		"true")
+	fromFlags := cfg
+
+	if !reflect.DeepEqual(fromConfig, fromFlags) {
+		t.Errorf("config and flags differ:\n%+v\n%+v", fromConfig, fromFlags)
+	}
+	// Not both left to their defaults
+	if fromConfig.margins != (Margins{CPU: 0.2, Memory: 0.15, IO: 0.3, GPU: 0.25}) || fromConfig.floors.memory != 512<<20 {
+		t.Errorf("settings of the config not applied: %+v", fromConfig)
+	}
+	if !fromConfig.unmanaged[resourceIO] || fromConfig.unmanaged[resourceCPU] {
+		t.Errorf("controllers of the config not applied: %v", fromConfig.unmanaged)
+	}
+}
+
+// The command line takes precedence over the unit, which takes precedence over the config file
+func TestOptionsPrecedence(t *testing.T) {
+	configPath := writeTestFile(t, "process-scaler.yaml", `
+margins:
+  cpu: 0.2
+  memory: 0.2
+  io: 0.2
+interval: 3s
+`)
+	unitPath := writeTestFile(t, "app.service", `
+[Service]
+ExecStart=/usr/bin/app
+`+UnitOptionPrefix+`cpu-margin=0.3
+`+UnitOptionPrefix+`mem-margin=0.3
+`)
+
+	// Applied in the order of parseFlags
+	parseTestFlags(t, "-cpu-margin", "0.4", "true")
+	unit := make(map[string]string)
+	if err := readUnitOptions(unitPath, unit); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyOptions(unit, unitOptionOrigin); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = applyOptions(config.flags(), func(name string) string { return name }); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Margins{CPU: 0.4, Memory: 0.3, IO: 0.2, GPU: DefaultMargin}
+	if cfg.margins != want {
+		t.Errorf("got margins %+v, want %+v", cfg.margins, want)
+	}
+	if cfg.interval.String() != "3s" {
+		t.Errorf("got interval %s, want the 3s of the config", cfg.interval)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		name, config, err string
+	}{
+		{"unknown key", "margin:\n  cpu: 0.2\n", "field margin not found"},
+		{"unknown option", "options:\n  cpu-margn: \"0.2\"\n", "unknown option cpu-margn"},
+		{"invalid value", "interval: soon\n", "invalid option interval=soon"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			parseTestFlags(t, "true")
+			config, err := loadConfig(writeTestFile(t, "process-scaler.yaml", test.config))
+			if err == nil {
+				err = applyOptions(config.flags(), func(name string) string { return name })
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Why a limit has its value: what the policy computed, what was applied, and the last constraint
+// that changed it on the way (none, schedule, floor, capacity, ceiling, budget, soft-memory or baseline)
+type LimitConstraint struct {
+	Limit   string  `json:"limit"`   // memory.max, cpu.max (fraction of the period) or io.max <maj:min> <type>
+	Raw     float64 `json:"raw"`     // Computed by the policy
+	Applied float64 `json:"applied"` // After all the constraints
+	Binding string  `json:"binding"`
+}
+
+// Follows the limits through the stages of a decision
+type limitsTrace struct {
+	raw     map[string]float64
+	last    map[string]float64
+	binding map[string]string
+}
+
+func newLimitsTrace(limits Limits) *limitsTrace {
+	values := limitValues(limits)
+	t := &limitsTrace{raw: values, last: make(map[string]float64), binding: make(map[string]string)}
+	for name, value := range values {
+		t.last[name] = value
+		t.binding[name] = "none"
+	}
+	return t
+}
+
+// Values of the limits that are set, by name
+func limitValues(limits Limits) map[string]float64 {
+	values := make(map[string]float64)
+	if !limits.Skipped[resourceMemory] {
+		values["memory.max"] = float64(limits.MemoryMax)
+	}
+	if !limits.Skipped[resourceCPU] && limits.CPUPeriod > 0 {
+		values["cpu.max"] = float64(limits.CPUQuota) / float64(limits.CPUPeriod)
+	}
+	if !limits.Skipped[resourceIO] {
+		for _, entry := range limits.IO {
+			values[fmt.Sprintf("io.max %d:%d %s", entry.Major, entry.Minor, entry.Type)] = float64(entry.Rate)
+		}
+	}
+	return values
+}
+
+// Record the limits after a stage, the limits it changed are bound by it
+func (t *limitsTrace) stage(name string, limits Limits) {
+	for limit, value := range limitValues(limits) {
+		last, exists := t.last[limit]
+		if !exists {
+			continue
+		}
+		if value != last {
+			t.binding[limit] = name
+			t.last[limit] = value
+		}
+	}
+}
+
+func (t *limitsTrace) constraints() []LimitConstraint {
+	constraints := make([]LimitConstraint, 0, len(t.raw))
+	for limit, raw := range t.raw {
+		constraints = append(constraints, LimitConstraint{Limit: limit, Raw: raw, Applied: t.last[limit], Binding: t.binding[limit]})
+	}
+	sort.Slice(constraints, func(i, j int) bool { return constraints[i].Limit < constraints[j].Limit })
+	return constraints
+}
+
+// Limits bound by a constraint, for the rationale, ex: "memory.max bound by ceiling"
+func describeConstraints(constraints []LimitConstraint) string {
+	var parts []string
+	for _, c := range constraints {
+		if c.Binding != "none" {
+			parts = append(parts, fmt.Sprintf("%s bound by %s (%.6g instead of %.6g)", c.Limit, c.Binding, c.Applied, c.Raw))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"time"
+)
+
+// Control is the JSON-RPC service exposed on the control socket.
+// Methods are called as "Control.<Method>", e.g. "Control.GetStatus".
+type Control struct{}
+
+type Empty struct{}
+
+type StatusReply struct {
+	PID       int       `json:"pid"`
+	PIDs      []int     `json:"pids"` // With -pid, the processes of the group still running
+	StartedAt time.Time `json:"startedAt"`
+	Margins   Margins   `json:"margins"`
+	Paused    bool      `json:"paused"`
+	// Resources whose scaling is paused while the others are still scaled
+	PausedResources []string          `json:"pausedResources"`
+	UpdatedAt       time.Time         `json:"updatedAt"`
+	Labels          map[string]string `json:"labels"`
+}
+
+type IOLimit struct {
+	Device string `json:"device"` // major:minor
+	Type   string `json:"type"`
+	Rate   uint64 `json:"rate"`
+}
+
+type LimitsReply struct {
+	MemoryMax int64     `json:"memoryMax"`
+	CPUQuota  int64     `json:"cpuQuota"`
+	CPUPeriod uint64    `json:"cpuPeriod"`
+	IO        []IOLimit `json:"io"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type ResourceArgs struct {
+	Resource string `json:"resource"` // memory, cpu, io or gpu
+}
+
+type SetMarginArgs struct {
+	Margin float64 `json:"margin"`
+}
+
+func (c *Control) GetStatus(_ *Empty, reply *StatusReply) error {
+	state.Lock()
+	defer state.Unlock()
+
+	*reply = StatusReply{
+		PID:       state.pid,
+		PIDs:      append([]int(nil), state.pids...),
+		StartedAt: state.startedAt,
+		Margins:   state.margins,
+		Paused:    state.paused,
+		UpdatedAt: state.updatedAt,
+		Labels:    cfg.labels,
+	}
+	for _, resource := range []string{resourceMemory, resourceCPU, resourceIO, resourceGPU} {
+		if state.pausedResources[resource] {
+			reply.PausedResources = append(reply.PausedResources, resource)
+		}
+	}
+	return nil
+}
+
+func (c *Control) GetLimits(_ *Empty, reply *LimitsReply) error {
+	state.Lock()
+	defer state.Unlock()
+
+	reply.UpdatedAt = state.updatedAt
+	if mem := state.limits.Memory; mem != nil && mem.Max != nil {
+		reply.MemoryMax = *mem.Max
+	}
+	if cpu := state.limits.CPU; cpu != nil {
+		// cpu.max is formatted as "<quota> <period>"
+		_, _ = fmt.Sscanf(string(cpu.Max), "%d %d", &reply.CPUQuota, &reply.CPUPeriod)
+	}
+	if io := state.limits.IO; io != nil {
+		for _, entry := range io.Max {
+			reply.IO = append(reply.IO, IOLimit{
+				Device: fmt.Sprintf("%d:%d", entry.Major, entry.Minor),
+				Type:   string(entry.Type),
+				Rate:   entry.Rate,
+			})
+		}
+	}
+	return nil
+}
+
+func (c *Control) SetMargin(args *SetMarginArgs, reply *StatusReply) error {
+	if !validMargin(args.Margin) {
+		return errors.New("margin must be in (0, 1)")
+	}
+
+	state.Lock()
+	state.margins = uniformMargins(args.Margin)
+	state.Unlock()
+	log.Printf("Margin of all the resources set to %.2f via control socket\n", args.Margin)
+
+	return c.GetStatus(nil, reply)
+}
+
+func (c *Control) Pause(_ *Empty, reply *StatusReply) error {
+	setPaused(true, "control socket")
+
+	return c.GetStatus(nil, reply)
+}
+
+func (c *Control) Resume(_ *Empty, reply *StatusReply) error {
+	setPaused(false, "control socket")
+
+	return c.GetStatus(nil, reply)
+}
+
+func (c *Control) PauseResource(args *ResourceArgs, reply *StatusReply) error {
+	if err := setResourcePaused(args.Resource, true, "control socket"); err != nil {
+		return err
+	}
+
+	return c.GetStatus(nil, reply)
+}
+
+func (c *Control) ResumeResource(args *ResourceArgs, reply *StatusReply) error {
+	if err := setResourcePaused(args.Resource, false, "control socket"); err != nil {
+		return err
+	}
+
+	return c.GetStatus(nil, reply)
+}
+
+type controlServer struct {
+	path     string
+	listener net.Listener
+}
+
+// Serve JSON-RPC requests on a Unix socket
+// Access is restricted through the socket file permissions (owner only)
+func startControlServer(path string) *controlServer {
+	server := rpc.NewServer()
+	if err := server.Register(&Control{}); err != nil {
+		fatal(err)
+	}
+
+	// Remove a stale socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fatal(err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		fatal(err)
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// Listener closed
+				return
+			}
+			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}
+	}()
+
+	slog.Info("Control socket listening", "path", path)
+	return &controlServer{path: path, listener: listener}
+}
+
+func (c *controlServer) close() {
+	_ = c.listener.Close()
+	_ = os.Remove(c.path)
+}
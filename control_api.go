@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Response of GET /state
+type ControlAPIState struct {
+	Margins Margins     `json:"margins"`
+	Paused  bool        `json:"paused"`
+	Limits  LimitsReply `json:"limits"` // Last limits applied to the cgroup
+}
+
+// Body of PATCH /margins, the resources not set keep their margin
+type MarginsPatch struct {
+	CPU    *float64 `json:"cpu"`
+	Memory *float64 `json:"memory"`
+	IO     *float64 `json:"io"`
+	GPU    *float64 `json:"gpu"`
+}
+
+// GET /state
+func serveControlState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeControlState(w)
+}
+
+// PATCH /margins, e.g. {"cpu": 0.2, "memory": 0.1}, the next ticks use the new margins
+func serveMargins(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var patch MarginsPatch
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		http.Error(w, fmt.Sprintf("invalid margins: %s", err), http.StatusBadRequest)
+		return
+	}
+	for name, margin := range map[string]*float64{"cpu": patch.CPU, "memory": patch.Memory, "io": patch.IO, "gpu": patch.GPU} {
+		if margin != nil && !validMargin(*margin) {
+			http.Error(w, fmt.Sprintf("%s margin must be in (0, 1)", name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	state.Lock()
+	if patch.CPU != nil {
+		state.margins.CPU = *patch.CPU
+	}
+	if patch.Memory != nil {
+		state.margins.Memory = *patch.Memory
+	}
+	if patch.IO != nil {
+		state.margins.IO = *patch.IO
+	}
+	if patch.GPU != nil {
+		state.margins.GPU = *patch.GPU
+	}
+	margins := state.margins
+	state.Unlock()
+	log.Printf("Margins set to CPU %.2f, memory %.2f, IO %.2f, GPU %.2f via control API\n", margins.CPU, margins.Memory, margins.IO, margins.GPU)
+
+	writeControlState(w)
+}
+
+func writeControlState(w http.ResponseWriter) {
+	var reply ControlAPIState
+	var status StatusReply
+	_ = (&Control{}).GetStatus(nil, &status)
+	_ = (&Control{}).GetLimits(nil, &reply.Limits)
+	reply.Margins = status.Margins
+	reply.Paused = status.Paused
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Printf("Warning: could not send the state: %s\n", err)
+	}
+}
+
+// Serve the control API over HTTP (see listenHTTP)
+func startControlAPIServer(address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", serveControlState)
+	mux.HandleFunc("/margins", serveMargins)
+	return listenHTTP("Control API", address, mux)
+}
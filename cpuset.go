@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Logical CPUs the CPU headroom is computed over, ex: 0-3,6
+// nil means all the CPUs of the system
+type cpuSet map[int]bool
+
+var cpuAffinity cpuSet
+
+// Parse a CPU list, in the format of cpuset.cpus and Cpus_allowed_list
+func parseCPUSet(list string) (cpuSet, error) {
+	set := make(cpuSet)
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid CPU list %q", list)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return nil, fmt.Errorf("invalid CPU list %q", list)
+			}
+		}
+		for i := start; i <= end; i++ {
+			set[i] = true
+		}
+	}
+	return set, nil
+}
+
+func (s cpuSet) String() string {
+	cpus := make([]int, 0, len(s))
+	for i := range s {
+		cpus = append(cpus, i)
+	}
+	sort.Ints(cpus)
+	parts := make([]string, len(cpus))
+	for i, c := range cpus {
+		parts[i] = strconv.Itoa(c)
+	}
+	return strings.Join(parts, ",")
+}
+
+// Logical CPUs of the system that are online
+func onlineCPUs() (cpuSet, error) {
+	content, err := os.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUSet(string(content))
+}
+
+// CPUs of the set that are not online
+func (s cpuSet) offline(online cpuSet) cpuSet {
+	missing := make(cpuSet)
+	for cpu := range s {
+		if !online[cpu] {
+			missing[cpu] = true
+		}
+	}
+	return missing
+}
+
+// CPUs a process is allowed to run on (e.g. restricted with taskset)
+func processAffinity(pid int) (cpuSet, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "Cpus_allowed_list:") {
+			return parseCPUSet(strings.TrimPrefix(scanner.Text(), "Cpus_allowed_list:"))
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no CPU affinity for process %d", pid)
+}
+
+// Like cpu.Times(true), but only the CPUs of the set, if any
+func perCoreCPUTimes(s cpuSet) ([]cpu.TimesStat, error) {
+	perCore, err := system.CPUTimes(true)
+	if err != nil || s == nil {
+		return perCore, err
+	}
+	return s.filter(perCore), nil
+}
+
+// CPU times of the CPUs in the set, ex: "cpu3" for CPU 3
+func (s cpuSet) filter(perCore []cpu.TimesStat) []cpu.TimesStat {
+	var result []cpu.TimesStat
+	for _, t := range perCore {
+		i, err := strconv.Atoi(strings.TrimPrefix(t.CPU, "cpu"))
+		if err == nil && s[i] {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// Like cpu.Times(false), but only summing the CPUs of the set, if any
+func systemCPUTimes(s cpuSet) ([]cpu.TimesStat, error) {
+	if s == nil {
+		return system.CPUTimes(false)
+	}
+	perCore, err := system.CPUTimes(true)
+	if err != nil {
+		return nil, err
+	}
+	return []cpu.TimesStat{sumCPUTimes("cpu-set", s.filter(perCore))}, nil
+}
+
+func sumCPUTimes(name string, times []cpu.TimesStat) cpu.TimesStat {
+	total := cpu.TimesStat{CPU: name}
+	for _, t := range times {
+		total.User += t.User
+		total.System += t.System
+		total.Idle += t.Idle
+		total.Nice += t.Nice
+		total.Iowait += t.Iowait
+		total.Irq += t.Irq
+		total.Softirq += t.Softirq
+		total.Steal += t.Steal
+	}
+	return total
+}
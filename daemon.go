@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Body of POST /jobs: a command or PIDs, and options of process-scaler by flag name
+// ex: {"command": ["stress", "-c", "4"], "policy": "target", "options": {"cpu-margin": "0.2"}}
+type JobRequest struct {
+	Command []string          `json:"command,omitempty"`
+	PIDs    []int             `json:"pids,omitempty"`
+	Policy  string            `json:"policy,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+type Job struct {
+	ID        string     `json:"id"`
+	Request   JobRequest `json:"request"`
+	PID       int        `json:"pid"` // PID of the process-scaler managing the job
+	StartedAt time.Time  `json:"startedAt"`
+	Running   bool       `json:"running"`
+	ExitInfo  *exitInfo  `json:"exitInfo,omitempty"` // Once the job exited
+	Log       string     `json:"log"`                // Output of process-scaler and of the command
+}
+
+// Each job is managed by its own process-scaler, which keeps the jobs isolated: the control loop
+// state is per process. The system stats are sampled once for all of them, and the disks benchmarked
+// once into the cache they read
+type daemon struct {
+	dir            string
+	benchmarkCache string
+	sampler        *systemSampler
+	mu             sync.Mutex
+	jobs           map[string]*Job
+	procs          map[string]*exec.Cmd
+	nextID         int
+}
+
+func (d *daemon) start(req JobRequest) (*Job, error) {
+	if (len(req.Command) == 0) == (len(req.PIDs) == 0) {
+		return nil, errors.New("either a command or pids must be given")
+	}
+
+	d.mu.Lock()
+	d.nextID++
+	id := strconv.Itoa(d.nextID)
+	d.mu.Unlock()
+
+	job := &Job{ID: id, Request: req, Log: filepath.Join(d.dir, id+".log")}
+	// The system stats are received on the first extra file, fd 3
+	args := []string{"-exit-info-file", filepath.Join(d.dir, id+".exit.json"), "-label", "job=" + id,
+		"-shared-stats-fd", "3", "-benchmark-cache", d.benchmarkCache}
+	if req.Policy != "" {
+		args = append(args, "-policy", req.Policy)
+	}
+	// Sorted for a deterministic command line
+	names := make([]string, 0, len(req.Options))
+	for name := range req.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-"+strings.TrimLeft(name, "-")+"="+req.Options[name])
+	}
+	for _, pid := range req.PIDs {
+		args = append(args, "-pid", strconv.Itoa(pid))
+	}
+	if len(req.Command) > 0 {
+		args = append(append(args, "--"), req.Command...)
+	}
+
+	output, err := os.Create(job.Log)
+	if err != nil {
+		return nil, err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		output.Close()
+		return nil, err
+	}
+	stats, feed, err := os.Pipe()
+	if err != nil {
+		output.Close()
+		return nil, err
+	}
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.ExtraFiles = []*os.File{stats}
+	err = cmd.Start()
+	stats.Close()
+	if err != nil {
+		feed.Close()
+		output.Close()
+		return nil, err
+	}
+	d.sampler.subscribe(id, feed)
+	job.PID = cmd.Process.Pid
+	job.StartedAt = time.Now()
+	job.Running = true
+	log.Printf("Job %s started (process-scaler %d): %s\n", id, job.PID, strings.Join(args, " "))
+
+	d.mu.Lock()
+	d.jobs[id] = job
+	d.procs[id] = cmd
+	d.mu.Unlock()
+
+	go func() {
+		_ = cmd.Wait()
+		d.sampler.unsubscribe(id)
+		output.Close()
+		var info exitInfo
+		content, err := os.ReadFile(filepath.Join(d.dir, id+".exit.json"))
+		if err == nil {
+			err = json.Unmarshal(content, &info)
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		job.Running = false
+		if err == nil {
+			job.ExitInfo = &info
+		}
+		delete(d.procs, id)
+		log.Printf("Job %s exited\n", id)
+	}()
+	return job, nil
+}
+
+// Stop a running job like process-scaler is stopped: its command is stopped and its cgroup deleted
+// Exited jobs are forgotten
+func (d *daemon) remove(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job, exists := d.jobs[id]
+	if !exists {
+		return os.ErrNotExist
+	}
+	if cmd, running := d.procs[id]; running {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	delete(d.jobs, job.ID)
+	return nil
+}
+
+func (d *daemon) list() []Job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	jobs := make([]Job, 0, len(d.jobs))
+	for _, job := range d.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartedAt.Before(jobs[j].StartedAt) })
+	return jobs
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// GET /jobs, POST /jobs, GET /jobs/<id>, DELETE /jobs/<id>
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, d.list())
+		case http.MethodPost:
+			var req JobRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid job: %s", err), http.StatusBadRequest)
+				return
+			}
+			job, err := d.start(req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			writeJSON(w, http.StatusCreated, job)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+		switch r.Method {
+		case http.MethodGet:
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			job, exists := d.jobs[id]
+			if !exists {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, http.StatusOK, job)
+		case http.MethodDelete:
+			if err := d.remove(id); errors.Is(err, os.ErrNotExist) {
+				http.NotFound(w, r)
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+// Stop the running jobs and wait for them, so that their cgroups are deleted
+func (d *daemon) stopAll() {
+	d.mu.Lock()
+	procs := make([]*exec.Cmd, 0, len(d.procs))
+	for _, cmd := range d.procs {
+		procs = append(procs, cmd)
+	}
+	d.mu.Unlock()
+	for _, cmd := range procs {
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+	}
+	for {
+		d.mu.Lock()
+		remaining := len(d.procs)
+		d.mu.Unlock()
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func runDaemon(args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	socket := flags.String("socket", "/run/process-scaler/daemon.sock", "Unix socket serving the jobs API (only accessible by its owner)")
+	dir := flags.String("jobs-dir", "/var/lib/process-scaler/jobs", "directory of the output and exit info of the jobs")
+	sampleInterval := flags.Duration("sample-interval", time.Second, "interval between the samples of the system stats shared by the jobs, their -interval is rounded up to a multiple of it")
+	flags.StringVar(&cfg.benchmarkCache, "benchmark-cache", DefaultBenchmarkCache, "JSON file caching the IO benchmark, done once when the daemon starts and read by the jobs")
+	_ = flags.Parse(args)
+	if *sampleInterval < MinInterval {
+		fatalf("-sample-interval must be at least %s", MinInterval)
+	}
+	if cfg.benchmarkCache == "" {
+		fatal("-benchmark-cache must not be empty")
+	}
+
+	// Checked once for all the jobs
+	if err := probeCgroupWritable(); err != nil {
+		fatal(err)
+	}
+	// The jobs find all the disks in the cache instead of each benchmarking them
+	cfg.benchmarkParallel = DefaultBenchmarkParallel
+	cfg.benchmarkExcludeCritical = true
+	benchmarkIO()
+
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(*socket), 0755); err != nil {
+		fatal(err)
+	}
+	// Remove a stale socket left behind by a previous run
+	if err := os.Remove(*socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		fatal(err)
+	}
+	listener, err := net.Listen("unix", *socket)
+	if err != nil {
+		fatal(err)
+	}
+	// Jobs run commands as root, the API must not be reachable by other users
+	if err = os.Chmod(*socket, 0600); err != nil {
+		fatal(err)
+	}
+
+	d := &daemon{
+		dir:            *dir,
+		benchmarkCache: cfg.benchmarkCache,
+		sampler:        newSystemSampler(),
+		jobs:           make(map[string]*Job),
+		procs:          make(map[string]*exec.Cmd),
+	}
+	stopSampler := make(chan struct{})
+	go d.sampler.run(*sampleInterval, stopSampler)
+	server := &http.Server{Handler: d.handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal(err)
+		}
+	}()
+	slog.Info("Daemon listening", "socket", *socket)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %s, stopping the jobs\n", sig)
+	_ = server.Close()
+	d.stopAll()
+	close(stopSampler)
+	_ = os.Remove(*socket)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Exit codes of process-scaler by category of error, the command's own failures keep their code
+const (
+	ExitCodeError        = 1 // Any other error
+	ExitCodeUnsupported  = 3 // The host doesn't support what is needed (cgroup v2, controllers)
+	ExitCodeBenchmark    = 4 // A device could not be benchmarked, with -strict
+	ExitCodeCgroupUpdate = 5 // Limits could not be applied to the cgroup
+)
+
+var (
+	ErrNotCgroupV2           = errors.New("this program requires cgroup v2")
+	ErrControllerUnavailable = errors.New("controller unavailable")
+)
+
+// A controller could not be enabled in a cgroup, e.g. it isn't delegated to it
+func controllerError(path, controller string, err error) error {
+	return fmt.Errorf("%w: %s in %s: %s", ErrControllerUnavailable, controller, path, err)
+}
+
+// A device could not be benchmarked in a direction (read or write)
+type BenchmarkError struct {
+	Device    string
+	Direction string
+	Cause     error
+}
+
+func (e *BenchmarkError) Error() string {
+	return fmt.Sprintf("%s benchmark of %s failed: %s", e.Direction, e.Device, e.Cause)
+}
+
+func (e *BenchmarkError) Unwrap() error {
+	return e.Cause
+}
+
+// Limits could not be applied to the cgroup
+type CgroupUpdateError struct {
+	Resource string // Controller of the interface file that failed, empty if unknown
+	Cause    error
+}
+
+func (e *CgroupUpdateError) Error() string {
+	if e.Resource == "" {
+		return fmt.Sprintf("could not update the cgroup: %s", e.Cause)
+	}
+	return fmt.Sprintf("could not update the %s limits of the cgroup: %s", e.Resource, e.Cause)
+}
+
+func (e *CgroupUpdateError) Unwrap() error {
+	return e.Cause
+}
+
+// The resource is the controller of the interface file that could not be written, ex: memory for memory.max
+func newCgroupUpdateError(err error) error {
+	updateErr := &CgroupUpdateError{Cause: err}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		updateErr.Resource, _, _ = strings.Cut(filepath.Base(pathErr.Path), ".")
+	}
+	return updateErr
+}
+
+// Exit code of an error of process-scaler
+func errorExitCode(err error) int {
+	var benchmarkErr *BenchmarkError
+	var updateErr *CgroupUpdateError
+	switch {
+	case errors.Is(err, ErrNotCgroupV2), errors.Is(err, ErrControllerUnavailable):
+		return ExitCodeUnsupported
+	case errors.As(err, &benchmarkErr):
+		return ExitCodeBenchmark
+	case errors.As(err, &updateErr):
+		return ExitCodeCgroupUpdate
+	}
+	return ExitCodeError
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Why process-scaler exited
+const (
+	exitReasonCompleted   = "completed"        // The command (or all the processes with -pid) exited successfully
+	exitReasonChildFailed = "child-failed"     // The command exited with an error
+	exitReasonStopped     = "stopped"          // process-scaler received SIGINT or SIGTERM and stopped the command
+	exitReasonDetached    = "detached"         // process-scaler received SIGINT or SIGTERM and left the command running (-detach)
+	exitReasonStartFailed = "start-failed"     // The command could not be started
+	exitReasonError       = "error"            // process-scaler failed
+	exitReasonBudget      = "budget-exhausted" // The budget was exhausted and the process stopped
+)
+
+// Written as JSON to -exit-info-file, so that supervising tools don't have to parse logs
+type exitInfo struct {
+	Reason          string  `json:"reason"`
+	Message         string  `json:"message,omitempty"`       // Error of process-scaler
+	ChildExitCode   *int    `json:"childExitCode,omitempty"` // Not set if the command didn't exit normally
+	Signal          string  `json:"signal,omitempty"`        // Signal that terminated the command
+	DurationSeconds float64 `json:"durationSeconds"`
+	OOMKilled       bool    `json:"oomKilled"`
+	PeakMemoryBytes int64   `json:"peakMemoryBytes"` // Highest memory usage measured
+	PeakCPUCores    float64 `json:"peakCPUCores"`    // Highest CPU usage measured over a tick
+}
+
+var (
+	startTime = time.Now()
+	exitMu    sync.Mutex
+	exitState exitInfo
+	exitOnce  sync.Once
+)
+
+// Record how the command exited
+func recordChildExit(state *os.ProcessState) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	if state == nil {
+		return
+	}
+	if code := state.ExitCode(); code >= 0 {
+		exitState.ChildExitCode = &code
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		exitState.Signal = status.Signal().String()
+	}
+}
+
+// Whether the kernel OOM killed a process of the cgroup, must be called before the cgroup is deleted
+func recordOOMKill() {
+	file, err := os.Open(filepath.Join(cgroupPath, "memory.events"))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	// Format: one "<event> <count>" per line
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var count int
+		if _, err := fmt.Sscanf(scanner.Text(), "oom_kill %d", &count); err == nil && count > 0 {
+			exitMu.Lock()
+			exitState.OOMKilled = true
+			exitMu.Unlock()
+		}
+	}
+}
+
+// Record the peak usage of the process from a measurement
+func recordUsage(snapshot Snapshot) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	if !snapshot.Skipped[resourceMemory] && snapshot.Memory.cgUsage > exitState.PeakMemoryBytes {
+		exitState.PeakMemoryBytes = snapshot.Memory.cgUsage
+	}
+	if cores := snapshot.CPU.cores(); !snapshot.Skipped[resourceCPU] && cores > exitState.PeakCPUCores {
+		exitState.PeakCPUCores = cores
+	}
+}
+
+// Run -on-exit-command once the cgroup is torn down, with the exit info in its environment
+func runOnExitCommand(reason string) {
+	if cfg.onExitCommand == "" {
+		return
+	}
+	exitMu.Lock()
+	info := exitState
+	exitMu.Unlock()
+
+	env := []string{
+		"PROCESS_SCALER_EXIT_REASON=" + reason,
+		fmt.Sprintf("PROCESS_SCALER_DURATION_SECONDS=%.3f", time.Since(startTime).Seconds()),
+		fmt.Sprintf("PROCESS_SCALER_OOM_KILLED=%t", info.OOMKilled),
+		fmt.Sprintf("PROCESS_SCALER_PEAK_MEMORY_BYTES=%d", info.PeakMemoryBytes),
+		fmt.Sprintf("PROCESS_SCALER_PEAK_CPU_CORES=%.3f", info.PeakCPUCores),
+	}
+	if info.ChildExitCode != nil {
+		env = append(env, fmt.Sprintf("PROCESS_SCALER_EXIT_CODE=%d", *info.ChildExitCode))
+	}
+	if info.Signal != "" {
+		env = append(env, "PROCESS_SCALER_SIGNAL="+info.Signal)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.onExitTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", cfg.onExitCommand)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %s", cfg.onExitTimeout)
+		}
+		log.Printf("Warning: -on-exit-command failed: %s\n", err)
+	}
+}
+
+// Write the exit info, only the first call has an effect
+func writeExitInfo(reason, message string) {
+	exitOnce.Do(func() {
+		if cfg.exitInfoFile == "" {
+			return
+		}
+		exitMu.Lock()
+		info := exitState
+		exitMu.Unlock()
+		info.Reason = reason
+		info.Message = strings.TrimSpace(message)
+		info.DurationSeconds = time.Since(startTime).Seconds()
+
+		content, err := json.Marshal(info)
+		if err == nil {
+			err = os.WriteFile(cfg.exitInfoFile, append(content, '\n'), 0644)
+		}
+		if err != nil {
+			log.Printf("Warning: could not write exit info %s: %s\n", cfg.exitInfoFile, err)
+		}
+	})
+}
+
+// Exit with the given code, after writing the exit info
+func exit(reason, message string, code int) {
+	writeExitInfo(reason, message)
+	os.Exit(code)
+}
+
+// Like log.Fatal, but logs at the Error level and writes the exit info first, as os.Exit skips deferred functions
+// A single error exits with the code of its category
+func fatal(v ...interface{}) {
+	code := ExitCodeError
+	if len(v) == 1 {
+		if err, ok := v[0].(error); ok {
+			code = errorExitCode(err)
+		}
+	}
+	message := fmt.Sprint(v...)
+	slog.Error(message)
+	exit(exitReasonError, message, code)
+}
+
+// Like log.Fatalf, but writes the exit info first
+func fatalf(format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	slog.Error(message)
+	exit(exitReasonError, message, ExitCodeError)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Lowest share of the GPU compute granted to the process, in percent
+	MinGPUThreadPercentage = 5
+	// Lowest GPU memory limit, in bytes
+	MinGPUMemory = 256 * 1024 * 1024
+)
+
+// Utilization of a GPU, as reported by NVML through nvidia-smi
+type gpuSample struct {
+	index       int
+	utilization float64 // Fraction of time the GPU was busy over the last sample period
+	memoryUsed  int64   // Bytes used by all processes
+	memoryTotal int64
+}
+
+// Query the GPUs, nvidia-smi reports memory in MiB
+func sampleGPUs() ([]gpuSample, error) {
+	output, err := exec.Command("nvidia-smi", "--query-gpu=index,utilization.gpu,memory.used,memory.total",
+		"--format=csv,noheader,nounits").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []gpuSample
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 4 {
+			continue
+		}
+		var values [4]float64
+		for i, field := range fields {
+			if values[i], err = strconv.ParseFloat(strings.TrimSpace(field), 64); err != nil {
+				return nil, fmt.Errorf("invalid nvidia-smi output %q", line)
+			}
+		}
+		samples = append(samples, gpuSample{
+			index:       int(values[0]),
+			utilization: values[1] / 100,
+			memoryUsed:  int64(values[2]) << 20,
+			memoryTotal: int64(values[3]) << 20,
+		})
+	}
+	return samples, nil
+}
+
+// With -gpu, the GPU headroom is measured like the CPU one and the process is granted a share of
+// the GPU compute and memory through the MPS control daemon, the only mechanism limiting a process
+// on a shared NVIDIA GPU. Without MPS, the decisions are only logged
+type gpuController struct {
+	mpsServer  int               // PID of the MPS server, 0 if MPS is not running
+	percentage float64           // Share of the compute granted, in percent
+	memory     map[int]int64     // Memory granted on each GPU
+	applied    map[string]string // Last MPS command of each setting, to only send changes
+}
+
+// Return nil if NVML (nvidia-smi) isn't available, -gpu is then a no-op
+func newGPUController() *gpuController {
+	if _, err := exec.LookPath("nvidia-smi"); err != nil {
+		log.Println("Warning: nvidia-smi not found, GPUs won't be managed")
+		return nil
+	}
+	c := &gpuController{percentage: 100, memory: make(map[int]int64), applied: make(map[string]string)}
+	if output, err := mpsControl("get_server_list"); err == nil {
+		c.mpsServer, _ = strconv.Atoi(strings.TrimSpace(string(output)))
+	}
+	if c.mpsServer == 0 {
+		log.Println("Warning: no MPS server running, GPU limits are only logged")
+	}
+	return c
+}
+
+// Send a command to the MPS control daemon
+func mpsControl(command string) ([]byte, error) {
+	cmd := exec.Command("nvidia-cuda-mps-control")
+	cmd.Stdin = strings.NewReader(command + "\n")
+	return cmd.Output()
+}
+
+// Compute the share of the GPUs granted to the process: the headroom (idle minus margin) is added
+// to the current share, like for the CPU and the memory
+func (c *gpuController) next(margin float64) ([]gpuSample, error) {
+	samples, err := sampleGPUs()
+	if err != nil {
+		return nil, err
+	}
+
+	// MPS applies a single compute share to all GPUs, the busiest one decides
+	headroom := 1.0
+	for _, gpu := range samples {
+		headroom = math.Min(headroom, 1-gpu.utilization-margin)
+
+		// Like the memory of the cgroup: the headroom (free memory minus margin) is added to the current limit
+		memoryMargin := int64(float64(gpu.memoryTotal) * margin)
+		granted := c.memory[gpu.index] + gpu.memoryTotal - gpu.memoryUsed - memoryMargin
+		if granted > gpu.memoryTotal-memoryMargin {
+			granted = gpu.memoryTotal - memoryMargin
+		}
+		if granted < MinGPUMemory {
+			granted = MinGPUMemory
+		}
+		c.memory[gpu.index] = granted
+	}
+	c.percentage = math.Max(MinGPUThreadPercentage, math.Min(100, c.percentage+headroom*100))
+	return samples, nil
+}
+
+// Apply the shares through MPS, for the clients started after the change
+func (c *gpuController) apply() error {
+	commands := map[string]string{
+		"threads": fmt.Sprintf("set_active_thread_percentage %d %.0f", c.mpsServer, c.percentage),
+	}
+	for index, memory := range c.memory {
+		commands[fmt.Sprintf("memory %d", index)] = fmt.Sprintf("set_device_pinned_mem_limit %d %d %dM", c.mpsServer, index, memory>>20)
+	}
+
+	var failed bytes.Buffer
+	for setting, command := range commands {
+		if c.applied[setting] == command {
+			continue
+		}
+		if c.mpsServer == 0 {
+			log.Printf("GPU limit (not applied): %s\n", command)
+			c.applied[setting] = command
+			continue
+		}
+		if _, err := mpsControl(command); err != nil {
+			fmt.Fprintf(&failed, "%s: %s; ", command, err)
+			continue
+		}
+		c.applied[setting] = command
+	}
+	if failed.Len() > 0 {
+		return fmt.Errorf("could not apply GPU limits: %s", strings.TrimSuffix(failed.String(), "; "))
+	}
+	return nil
+}
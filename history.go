@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Measured usage and decided limits of a tick
+type HistoryEntry struct {
+	Time      time.Time     `json:"time"`
+	Usage     HistoryUsage  `json:"usage"`
+	Limits    HistoryLimits `json:"limits"`
+	Applied   bool          `json:"applied"` // False when paused
+	Rationale string        `json:"rationale"`
+	// For each limit: computed by the policy, applied, and the constraint that bound it
+	Constraints []LimitConstraint `json:"constraints"`
+}
+
+type HistoryUsage struct {
+	MemoryBytes int64       `json:"memoryBytes"`
+	CPUCores    float64     `json:"cpuCores"`
+	IO          []HistoryIO `json:"io"`
+}
+
+type HistoryIO struct {
+	Device   string  `json:"device"` // major:minor
+	ReadBPS  float64 `json:"readBPS"`
+	WriteBPS float64 `json:"writeBPS"`
+}
+
+type HistoryLimits struct {
+	MemoryMax  int64     `json:"memoryMax"`
+	MemoryHigh int64     `json:"memoryHigh,omitempty"`
+	CPUQuota   int64     `json:"cpuQuota"`
+	CPUPeriod  uint64    `json:"cpuPeriod"`
+	IO         []IOLimit `json:"io"`
+}
+
+// Last decisions of the control loop, bounded to a number of ticks
+type history struct {
+	mu      sync.Mutex
+	entries []HistoryEntry
+	next    int // Index of the next entry to overwrite
+	full    bool
+}
+
+// Decisions served by the HTTP server, nil without -http-listen
+var decisions *history
+
+func newHistory(size int) *history {
+	return &history{entries: make([]HistoryEntry, size)}
+}
+
+func (h *history) add(entry HistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Entries since the given time, oldest first
+func (h *history) since(t time.Time) []HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ordered := h.entries[:h.next]
+	if h.full {
+		ordered = append(append([]HistoryEntry(nil), h.entries[h.next:]...), h.entries[:h.next]...)
+	}
+	result := make([]HistoryEntry, 0, len(ordered))
+	for _, entry := range ordered {
+		if !entry.Time.Before(t) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func newHistoryEntry(snapshot Snapshot, limits Limits, applied bool, rationale string) HistoryEntry {
+	entry := HistoryEntry{
+		Time:      clock.Now(),
+		Applied:   applied,
+		Rationale: rationale,
+		Usage: HistoryUsage{
+			MemoryBytes: snapshot.Memory.cgUsage,
+			CPUCores:    snapshot.CPU.cores(),
+			IO:          make([]HistoryIO, 0, len(snapshot.IO)),
+		},
+		Limits: HistoryLimits{
+			MemoryMax:  limits.MemoryMax,
+			MemoryHigh: limits.MemoryHigh,
+			CPUQuota:   limits.CPUQuota,
+			CPUPeriod:  limits.CPUPeriod,
+			IO:         make([]IOLimit, 0, len(limits.IO)),
+		},
+	}
+	for _, sample := range snapshot.IO {
+		entry.Usage.IO = append(entry.Usage.IO, HistoryIO{
+			Device:   fmt.Sprintf("%d:%d", sample.major, sample.minor),
+			ReadBPS:  sample.cgRead,
+			WriteBPS: sample.cgWrite,
+		})
+	}
+	for _, io := range limits.IO {
+		entry.Limits.IO = append(entry.Limits.IO, IOLimit{
+			Device: fmt.Sprintf("%d:%d", io.Major, io.Minor),
+			Type:   string(io.Type),
+			Rate:   io.Rate,
+		})
+	}
+	return entry
+}
+
+// GET /history?window=5m: decisions of the last 5 minutes, all the ones kept without window
+func serveHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var since time.Time
+	if value := r.URL.Query().Get("window"); value != "" {
+		window, err := time.ParseDuration(value)
+		if err != nil || window <= 0 {
+			http.Error(w, fmt.Sprintf("invalid window %q", value), http.StatusBadRequest)
+			return
+		}
+		since = clock.Now().Add(-window)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(decisions.since(since)); err != nil {
+		log.Printf("Warning: could not send the history: %s\n", err)
+	}
+}
+
+// Serve the decision history over HTTP (see listenHTTP)
+func startHTTPServer(address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/history", serveHistory)
+	return listenHTTP("HTTP server", address, mux)
+}
+
+// Serve the handler in the background, until the returned server is closed
+// None of the HTTP servers is authenticated nor encrypted, and the control API changes the margins:
+// they are meant to listen on a loopback address, or behind a reverse proxy that authenticates the clients
+func listenHTTP(name, address string, handler http.Handler) *http.Server {
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		fatal(err)
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Warning: %s stopped: %s\n", name, err)
+		}
+	}()
+
+	slog.Info(name+" listening", "address", listener.Addr().String())
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok && !tcpAddr.IP.IsLoopback() {
+		log.Printf("Warning: %s listens on %s, it is not authenticated\n", name, listener.Addr())
+	}
+	return server
+}
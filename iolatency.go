@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/shirou/gopsutil/v3/disk"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Weight of the last interval in the average latency of a device
+	IOLatencySmoothing = 0.1
+	// Lowest adaptive target, below it the kernel would throttle the other cgroups on noise
+	MinIOLatencyTarget = 500 // µs
+)
+
+// With -io-mode latency, the process is protected with io.latency targets instead of being capped
+// in bandwidth: the kernel throttles the other cgroups when its IO latency exceeds the target
+// The target is either static, or the average latency of the device plus the margin
+type ioLatencyController struct {
+	static  time.Duration                  // 0 for adaptive targets
+	last    map[string]disk.IOCountersStat // Last system IO counters
+	average map[string]float64             // Average latency of each device (µs per IO)
+	applied map[string]uint64              // Last target written for each device (µs)
+}
+
+func newIOLatencyController(static time.Duration) *ioLatencyController {
+	return &ioLatencyController{
+		static:  static,
+		average: make(map[string]float64),
+		applied: make(map[string]uint64),
+	}
+}
+
+// Update the average latency of the disks and compute their targets (µs), by major:minor
+func (c *ioLatencyController) next(margin float64) (map[string]uint64, error) {
+	counters, err := system.IOCounters()
+	if err != nil {
+		return nil, err
+	}
+	last := c.last
+	c.last = counters
+
+	targets := make(map[string]uint64)
+	for name, device := range lsblk {
+		// The io controller applies to whole disks only
+		if device.Type != "disk" {
+			continue
+		}
+		if c.static > 0 {
+			targets[device.MajMin] = uint64(c.static.Microseconds())
+			continue
+		}
+
+		cur, exists := counters[name]
+		prev, existed := last[name]
+		if !exists || !existed {
+			continue
+		}
+		ops := clampedDelta(cur.ReadCount+cur.WriteCount, prev.ReadCount+prev.WriteCount)
+		busy := clampedDelta(cur.ReadTime+cur.WriteTime, prev.ReadTime+prev.WriteTime) // ms
+		if ops > 0 {
+			latency := float64(busy) * 1000 / float64(ops)
+			if average, measured := c.average[name]; measured {
+				c.average[name] = average + IOLatencySmoothing*(latency-average)
+			} else {
+				c.average[name] = latency
+			}
+		}
+		if average, measured := c.average[name]; measured {
+			target := uint64(average * (1 + margin))
+			if target < MinIOLatencyTarget {
+				target = MinIOLatencyTarget
+			}
+			targets[device.MajMin] = target
+		}
+	}
+	return targets, nil
+}
+
+// Write the targets that changed since the last call
+// The containerd API doesn't support io.latency, write it directly
+func (c *ioLatencyController) apply(targets map[string]uint64) error {
+	for device, target := range targets {
+		if c.applied[device] == target {
+			continue
+		}
+		line := fmt.Sprintf("%s target=%d", device, target)
+		if err := os.WriteFile(filepath.Join(cgroupPath, "io.latency"), []byte(line), 0); err != nil {
+			return fmt.Errorf("could not set io.latency %s: %w", line, err)
+		}
+		c.applied[device] = target
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"github.com/containerd/cgroups/v3/cgroup2"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Weight of the other cgroups with bfq, unless they set theirs
+	DefaultBFQWeight = 100
+	// Range of io.bfq.weight
+	MinBFQWeight = 1
+	MaxBFQWeight = 1000
+)
+
+// How the IO of the process is throttled on a disk: the policy decides bandwidth limits, which
+// only throttle as expected with some IO schedulers, so a strategy translates them
+type ioStrategy interface {
+	// Name logged for the disk
+	name() string
+	// Translate the io.max entries decided for the disk, return the entries left to io.max
+	translate(sample ioSample, entries []cgroup2.Entry) []cgroup2.Entry
+	// Write the settings translated since the last call, if they changed
+	apply() error
+}
+
+// Bandwidth limits through io.max, enforced whatever the scheduler
+type bpsStrategy struct{}
+
+func (bpsStrategy) name() string { return "bps (io.max)" }
+
+func (bpsStrategy) translate(_ ioSample, entries []cgroup2.Entry) []cgroup2.Entry {
+	return entries
+}
+
+func (bpsStrategy) apply() error { return nil }
+
+// bfq shares a disk among the cgroups in proportion to their weights, so hard bandwidth limits
+// waste the disk when the others are idle: the share of the max throughput decided by the policy
+// is turned into a weight instead
+type bfqWeightStrategy struct {
+	majMin  string
+	weight  uint64
+	applied uint64
+}
+
+func (s *bfqWeightStrategy) name() string { return "weight (io.bfq.weight)" }
+
+func (s *bfqWeightStrategy) translate(sample ioSample, entries []cgroup2.Entry) []cgroup2.Entry {
+	share := 0.0
+	for _, entry := range entries {
+		switch {
+		case entry.Type == cgroup2.ReadBPS && sample.maxRead > 0:
+			share = math.Max(share, float64(entry.Rate)/sample.maxRead)
+		case entry.Type == cgroup2.WriteBPS && sample.maxWrite > 0:
+			share = math.Max(share, float64(entry.Rate)/sample.maxWrite)
+		}
+	}
+	if share == 0 {
+		// Nothing decided (devices not benchmarked), keep the current weight
+		return nil
+	}
+	// Against the others at the default weight, a weight w is granted w / (w + default) of the disk
+	share = math.Min(share, 0.999)
+	weight := DefaultBFQWeight * share / (1 - share)
+	s.weight = uint64(math.Max(MinBFQWeight, math.Min(MaxBFQWeight, math.Round(weight))))
+	return nil
+}
+
+// The containerd API doesn't support io.bfq.weight, write it directly
+func (s *bfqWeightStrategy) apply() error {
+	if s.weight == 0 || s.weight == s.applied {
+		return nil
+	}
+	line := fmt.Sprintf("%s %d", s.majMin, s.weight)
+	if err := os.WriteFile(filepath.Join(cgroupPath, "io.bfq.weight"), []byte(line), 0); err != nil {
+		return fmt.Errorf("could not set io.bfq.weight %s: %w", line, err)
+	}
+	s.applied = s.weight
+	return nil
+}
+
+// Active IO scheduler of a disk, ex: "bfq" for "mq-deadline kyber [bfq] none"
+func ioScheduler(kname string) (string, error) {
+	content, err := os.ReadFile(filepath.Join("/sys/block", kname, "queue/scheduler"))
+	if err != nil {
+		return "", err
+	}
+	for _, field := range strings.Fields(string(content)) {
+		if strings.HasPrefix(field, "[") && strings.HasSuffix(field, "]") {
+			return strings.Trim(field, "[]"), nil
+		}
+	}
+	// Single-queue devices without choice only print "none"
+	return strings.TrimSpace(string(content)), nil
+}
+
+// Choose the strategy of each disk, by major and minor numbers: with "auto", weight for the disks
+// using bfq and bps for the others, otherwise the given one for all
+func ioStrategies(mode string) map[[2]int64]ioStrategy {
+	strategies := make(map[[2]int64]ioStrategy)
+	for kname, device := range lsblk {
+		if device.Type != "disk" {
+			continue
+		}
+		major, minor, err := parseMajMin(device.MajMin)
+		if err != nil {
+			continue
+		}
+
+		scheduler, err := ioScheduler(kname)
+		if err != nil {
+			scheduler = "unknown"
+		}
+		var strategy ioStrategy = bpsStrategy{}
+		if weightedDisk(mode, scheduler) {
+			strategy = &bfqWeightStrategy{majMin: device.MajMin}
+		}
+		strategies[[2]int64{major, minor}] = strategy
+		log.Printf("Disk %s: scheduler %s, throttled with %s\n", kname, scheduler, strategy.name())
+	}
+	return strategies
+}
+
+// Whether a disk using the scheduler is throttled through io.bfq.weight rather than io.max
+func weightedDisk(mode, scheduler string) bool {
+	return mode == "weight" || (mode == "auto" && scheduler == "bfq")
+}
+
+// Translate the io.max entries decided by the policy with the strategy of each disk
+func translateIO(strategies map[[2]int64]ioStrategy, entries []cgroup2.Entry, samples []ioSample) []cgroup2.Entry {
+	byDevice := make(map[[2]int64][]cgroup2.Entry)
+	for _, entry := range entries {
+		device := [2]int64{entry.Major, entry.Minor}
+		byDevice[device] = append(byDevice[device], entry)
+	}
+
+	result := make([]cgroup2.Entry, 0, len(entries))
+	for _, sample := range samples {
+		device := [2]int64{sample.major, sample.minor}
+		strategy, exists := strategies[device]
+		if !exists {
+			strategy = bpsStrategy{}
+		}
+		result = append(result, strategy.translate(sample, byDevice[device])...)
+		delete(byDevice, device)
+	}
+	// Entries of devices without a sample are left as they are
+	for _, deviceEntries := range byDevice {
+		result = append(result, deviceEntries...)
+	}
+	return result
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Identifying metadata attached to logs and status, ex: -label team=ml -label job=train
+type labels map[string]string
+
+func (l *labels) String() string {
+	entries := make([]string, 0, len(*l))
+	for key, value := range *l {
+		entries = append(entries, key+"="+value)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, " ")
+}
+
+func (l *labels) Set(value string) error {
+	key, v, found := strings.Cut(value, "=")
+	if !found || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	if *l == nil {
+		*l = make(labels)
+	}
+	(*l)[key] = v
+	return nil
+}
+
+// Environment variables commonly set through the Kubernetes downward API
+var k8sLabelEnv = map[string]string{
+	"pod":       "POD_NAME",
+	"namespace": "POD_NAMESPACE",
+	"node":      "NODE_NAME",
+	"container": "CONTAINER_NAME",
+}
+
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// Detect the container ID from the cgroup of process-scaler (docker, containerd, cri-o)
+func detectContainerID() string {
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	return containerIDPattern.FindString(string(content))
+}
+
+// Add the metadata detected from the environment, without overriding labels given explicitly
+func (l *labels) detect() {
+	if *l == nil {
+		*l = make(labels)
+	}
+	for label, env := range k8sLabelEnv {
+		if value := os.Getenv(env); value != "" {
+			if _, exists := (*l)[label]; !exists {
+				(*l)[label] = value
+			}
+		}
+	}
+	if id := detectContainerID(); id != "" {
+		if _, exists := (*l)["container_id"]; !exists {
+			(*l)["container_id"] = id
+		}
+	}
+}
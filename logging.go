@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of -log-format
+const (
+	LogFormatText = "text" // Human readable, like the standard logger
+	LogFormatJSON = "json" // One JSON object per line, for log aggregators
+)
+
+// The loggers are set up with the defaults before the flags are parsed, so that their errors are
+// formatted like the other logs
+func init() {
+	setupLogging(log.Writer())
+}
+
+// Route the logs, structured or not, to a handler of -log-format filtering by -log-level
+// The messages still logged through the standard logger are logged as Info, or Warn if they start
+// with "Warning: "
+func setupLogging(out io.Writer) {
+	options := &slog.HandlerOptions{Level: cfg.logLevel}
+	var handler slog.Handler
+	if cfg.logFormat == LogFormatJSON {
+		attrs := make([]slog.Attr, 0, len(cfg.labels))
+		for key, value := range cfg.labels {
+			attrs = append(attrs, slog.String(key, value))
+		}
+		handler = slog.NewJSONHandler(out, options).WithAttrs(attrs)
+	} else {
+		plain := &plainHandler{out: out, level: cfg.logLevel, mu: new(sync.Mutex)}
+		if len(cfg.labels) > 0 {
+			plain.prefix = "[" + cfg.labels.String() + "] "
+		}
+		handler = plain
+	}
+	slog.SetDefault(slog.New(handler))
+
+	// After slog.SetDefault, which also redirects the standard logger
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(standardLogWriter{})
+}
+
+// Writer of the standard logger, forwarding its lines to slog
+type standardLogWriter struct{}
+
+func (standardLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSuffix(string(p), "\n")
+	level := slog.LevelInfo
+	if strings.HasPrefix(message, "Warning: ") {
+		level = slog.LevelWarn
+		message = strings.TrimPrefix(message, "Warning: ")
+	}
+	slog.Log(context.Background(), level, message)
+	return len(p), nil
+}
+
+// Handler of -log-format text, writing the lines the standard logger used to write, with the
+// attributes appended as key=value
+type plainHandler struct {
+	out    io.Writer
+	level  slog.Level
+	prefix string      // Labels
+	attrs  []slog.Attr // From WithAttrs
+	group  string      // Prefix of the keys, from WithGroup
+	mu     *sync.Mutex // Shared by the handlers derived from the same one
+}
+
+func (h *plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	var line bytes.Buffer
+	line.WriteString(h.prefix)
+	line.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	switch {
+	case r.Level >= slog.LevelError:
+	case r.Level >= slog.LevelWarn:
+		line.WriteString("Warning: ")
+	case r.Level < slog.LevelInfo:
+		line.WriteString("Debug: ")
+	}
+	line.WriteString(r.Message)
+	for _, attr := range h.attrs {
+		writePlainAttr(&line, "", attr)
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		writePlainAttr(&line, h.group, attr)
+		return true
+	})
+	line.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.out.Write(line.Bytes())
+	return err
+}
+
+func (h *plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	derived := *h
+	derived.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, attr := range attrs {
+		attr.Key = h.group + attr.Key
+		derived.attrs = append(derived.attrs, attr)
+	}
+	return &derived
+}
+
+func (h *plainHandler) WithGroup(name string) slog.Handler {
+	derived := *h
+	derived.group = h.group + name + "."
+	return &derived
+}
+
+func writePlainAttr(line *bytes.Buffer, group string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		for _, member := range attr.Value.Group() {
+			writePlainAttr(line, group+attr.Key+".", member)
+		}
+		return
+	}
+	var value string
+	switch attr.Value.Kind() {
+	case slog.KindTime:
+		value = attr.Value.Time().Format(time.RFC3339)
+	default:
+		value = attr.Value.String()
+	}
+	if value == "" || strings.ContainsAny(value, " \"=\n") {
+		value = strconv.Quote(value)
+	}
+	line.WriteString(" " + group + attr.Key + "=" + value)
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/containerd/cgroups/v3"
 	"github.com/containerd/cgroups/v3/cgroup2"
@@ -10,20 +13,67 @@ import (
 	"github.com/google/uuid"
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/disk"
-	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/load"
 	"log"
+	"log/slog"
 	"math"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
+// Where benchmark values come from
+const (
+	benchmarkSourceMeasured  = "measured"
+	benchmarkSourceCached    = "cached"
+	benchmarkSourceEstimated = "estimated"
+	benchmarkSourceSkipped   = "skipped"
+	// Not benchmarked because -benchmark-budget was exhausted
+	benchmarkSourceUnbenchmarked = "unbenchmarked"
+)
+
 type maxIO struct {
 	read  uint64
 	write uint64
+	// Provenance of the values, so that untrusted ones are not used for throttling
+	readTool     string // Tool that measured read, empty if not measured
+	writeTool    string // Tool that measured write, empty if not measured
+	writesTested bool
+	measuredAt   time.Time
+	source       string
+	model        string
+	serial       string
+	// IO utilization of the device (fraction of time busy) just before the benchmark, -1 if unknown
+	// A busy device depresses the measured max
+	baselineUtil float64
+}
+
+// Whether the benchmark can be used to throttle the device
+func (m maxIO) trusted() bool {
+	return m.source == benchmarkSourceMeasured || m.source == benchmarkSourceCached
+}
+
+// Max write throughput, and whether writes can be throttled
+// With -write-cap-from-read, the read max is an approximate cap for devices whose writes were not benchmarked
+func (m maxIO) writeCap() (uint64, bool) {
+	if !m.writesTested && cfg.writeCapFromRead && m.readTool != "" {
+		return m.read, true
+	}
+	return m.write, m.writesTested
+}
+
+func (m maxIO) stale() bool {
+	return time.Since(m.measuredAt) > BenchmarkStaleAfter
 }
 
 type lsblkOutputListJSON struct {
@@ -35,85 +85,420 @@ type lsblkOutputJSON struct {
 	Kname    string            `json:"kname"`
 	MajMin   string            `json:"maj:min"`
 	Type     string            `json:"type"`
+	Model    string            `json:"model"`
+	Serial   string            `json:"serial"`
+	Rota     lsblkBool         `json:"rota"`
 	Children []lsblkOutputJSON `json:"children"`
 }
 
+// Depending on its version, lsblk outputs booleans as true/false or "1"/"0"
+type lsblkBool bool
+
+func (b *lsblkBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true", "1":
+		*b = true
+	case "false", "0", "null", "":
+		*b = false
+	default:
+		return fmt.Errorf("invalid lsblk boolean %s", data)
+	}
+	return nil
+}
+
 type lastCPUTimeStats struct {
 	sync.Mutex
-	system []cpu.TimesStat // CPU time for the whole system
-	cg     uint64          // CPU time for the cgroup
+	system  []cpu.TimesStat // CPU time for the whole system
+	perCore []cpu.TimesStat // CPU time for each core (only with -per-core-cpu)
+	cg      uint64          // CPU time for the cgroup
+	// cpu.stat throttling counters of the cgroup
+	nrPeriods     uint64
+	nrThrottled   uint64
+	throttledUsec uint64
+	numCores      int // Number of logical cores of the system (or of -cpu-affinity)
+	// Smoothed available fraction of the CPU time, with -smoothing
+	available ewma
 }
 
 type lastIOCountersStats struct {
 	sync.Mutex
 	system map[string]disk.IOCountersStat
 	cg     []*stats.IOEntry
+	at     time.Time       // When the counters were read
+	warned map[string]bool // Devices for which an untrusted benchmark has already been reported
+	// Consecutive observations of the counters of each device, a device is only throttled from its second one
+	observed map[string]int
+	// Smoothed available throughputs of each device, with -smoothing
+	availableRead  map[string]ewma
+	availableWrite map[string]ewma
+}
+
+// Exponentially weighted moving average, so that a single bursty interval doesn't make the limits
+// jump: each value only moves the average by (1 - smoothing) of the difference
+type ewma struct {
+	value  float64
+	seeded bool
+}
+
+func (e *ewma) update(value, smoothing float64) float64 {
+	if !e.seeded || smoothing <= 0 {
+		e.value, e.seeded = value, true
+		return value
+	}
+	e.value = smoothing*e.value + (1-smoothing)*value
+	return e.value
+}
+
+// Runtime state shared between the monitoring loop and the control socket
+type scalerState struct {
+	sync.Mutex
+	pid       int
+	pids      []int // Processes of the group still running
+	startedAt time.Time
+	margins   Margins
+	paused    bool
+	// Resources whose management is paused, while the others are still scaled
+	pausedResources map[string]bool
+	limits          cgroup2.Resources // Last limits computed by the monitoring loop
+	updatedAt       time.Time         // When limits were last applied
+}
+
+type config struct {
+	strict              bool
+	pids                pidList
+	controlSocket       string
+	httpListen          string
+	metricsAddr         string
+	controlAddr         string
+	remoteWriteURL      string
+	remoteWriteInterval time.Duration
+	historySize         int
+	pauseSignal         string
+	perCoreCPU          bool
+	cpuAffinity         string
+	policy              string
+	shadowPolicies      string
+	reserve             reserve
+	floors              floors
+
+	benchmarkExcludeCritical bool
+	benchmarkCache           string
+	benchmarkCacheTTL        time.Duration // 0 if cached benchmarks never expire
+	benchmarkRefresh         bool          // Benchmark even the devices with a valid cached benchmark
+	skipIOBenchmark          bool
+	unmanaged                map[string]bool // Resources left out of -controllers, nil if all are managed
+	dryRun                   bool            // Compute and log the limits without applying them
+	detach                   bool            // On SIGINT or SIGTERM, leave the command running instead of stopping it
+	benchmarkWaitIdle        time.Duration
+	benchmarkBudget          time.Duration
+	benchmarkParallel        int // Devices benchmarked at the same time
+	sharedStatsFD            int // Pipe of the system stats sampled by the daemon, -1 outside of it
+	benchmarkAsync           bool
+	writeCapFromRead         bool
+	static                   staticLimits
+
+	schedule *schedule
+
+	memoryPolicy    string
+	softMemory      bool // Set memory.high at the decided limit, memory.max above it
+	psiMemoryTarget float64
+	cgroupPath      string
+
+	labels       labels
+	detectLabels bool
+
+	initialFraction       float64
+	initialSamples        int
+	initialSampleInterval time.Duration
+	interval              time.Duration // Between two readjustments
+	margins               Margins
+	cacheReclaimFactor    float64
+	loadAverageWeight     float64
+	smoothing             float64 // Weight of the past in the averages of the available CPU and IO
+	idleCPUThreshold      float64
+	cpuBurst              float64
+	cpuMode               string // quota (cpu.max) or weight (cpu.weight)
+	cpuBudget             float64
+	ioBudget              byteSize
+	budgetState           string
+	budgetAction          string
+	stateFile             string
+	idleIOThreshold       byteSize
+	aggressiveReclaim     bool
+
+	capacityEndpoint string
+	gpu              bool
+	// Ceilings given as percentages of the capacity, resolved at startup
+	maxCPUPercent        float64
+	maxMemoryPercent     float64
+	reserveMemoryPercent float64
+	ceilings             Capacity
+
+	ioMode             string
+	ioMarginBase       string
+	ioLatencyTarget    time.Duration
+	ioStrategy         string
+	ioAccounting       string
+	ioLatencyThreshold time.Duration
+
+	stopSignal syscall.Signal
+	stopGrace  time.Duration
+
+	exitInfoFile  string
+	onExitCommand string
+	onExitTimeout time.Duration
+	logFile       string
+	logMaxSize    byteSize
+	logMaxFiles   int
+	logFormat     string
+	logLevel      slog.Level
+}
+
+// Resources always left to the rest of the system, in absolute units
+type reserve struct {
+	cpu    float64  // Cores
+	memory byteSize // Bytes
+	ioBPS  byteSize // Bytes per second, for each device
+}
+
+// Lowest limits granted to the process whatever the load of the rest of the system, so that it is
+// never starved
+type floors struct {
+	cpu    cpuFloor
+	memory byteSize // Bytes, 0 if not set
+}
+
+// Lowest CPU limit, in cores (e.g. 0.5) or in microseconds of quota per period (e.g. 20000us)
+type cpuFloor struct {
+	cores float64
+	quota int64
+}
+
+func (f *cpuFloor) String() string {
+	if f.quota > 0 {
+		return strconv.FormatInt(f.quota, 10) + "us"
+	}
+	return strconv.FormatFloat(f.cores, 'g', -1, 64)
+}
+
+func (f *cpuFloor) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "us") {
+		quota, err := strconv.ParseInt(strings.TrimSuffix(value, "us"), 10, 64)
+		if err != nil || quota < 0 {
+			return fmt.Errorf("invalid quota %q", value)
+		}
+		*f = cpuFloor{quota: quota}
+		return nil
+	}
+	cores, err := strconv.ParseFloat(value, 64)
+	if err != nil || cores < 0 {
+		return fmt.Errorf("invalid number of cores %q", value)
+	}
+	*f = cpuFloor{cores: cores}
+	return nil
+}
+
+// Quota of the floor for the period, on the scale of the ceilings
+func (f cpuFloor) quotaFor(numCores int, period uint64) int64 {
+	if f.quota > 0 {
+		return f.quota
+	}
+	return int64(f.cores / float64(numCores) * float64(period))
+}
+
+// Raise the limits to the floors, numCores converts cores to the CPU quota
+// Applied before the capacity, the ceilings and the budget: these are hard limits, that still lower
+// the limits below the floors (the floors are checked against the capacity and the ceilings at startup)
+func (f floors) apply(limits *Limits, numCores int) {
+	if f.memory > 0 && limits.MemoryMax < int64(f.memory) {
+		limits.MemoryMax = int64(f.memory)
+	}
+	if numCores > 0 && limits.CPUPeriod > 0 {
+		if minQuota := f.cpu.quotaFor(numCores, limits.CPUPeriod); limits.CPUQuota < minQuota {
+			limits.CPUQuota = minQuota
+		}
+	}
+}
+
+// Size in bytes, accepting suffixes (k, M, G, T for powers of 1000, Ki, Mi, Gi, Ti for powers of 1024)
+type byteSize uint64
+
+var byteSizeSuffixes = []struct {
+	suffix     string
+	multiplier uint64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"k", 1e3}, {"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+func (b *byteSize) String() string {
+	return strconv.FormatUint(uint64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	value = strings.TrimSuffix(strings.TrimSpace(value), "B")
+	multiplier := uint64(1)
+	for _, s := range byteSizeSuffixes {
+		if strings.HasSuffix(value, s.suffix) {
+			value = strings.TrimSuffix(value, s.suffix)
+			multiplier = s.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * float64(multiplier))
+	return nil
 }
 
 var (
+	cgroupPath     string // Path of the managed cgroup in the unified hierarchy
+	ownsCgroup     bool   // Whether the cgroup was created by process-scaler, and must be deleted on exit
+	systemdCgroup  bool   // Whether the cgroup was created through systemd, as a slice
+	cfg            config
+	state          scalerState
 	lastCPUTimes   lastCPUTimeStats
 	lastIOCounters lastIOCountersStats
 	lsblk          map[string]lsblkOutputJSON
 	ioBenchmark    map[string]maxIO // Max read/write in bytes for one second for each device
+	// With -benchmark-async, ioBenchmark is filled while the process runs
+	ioBenchmarkMu sync.Mutex
 )
 
 const (
-	Margin = 0.1
+	CgroupRoot    = "/sys/fs/cgroup"
+	DefaultMargin = 0.1
+	// Times the descendants of the command are searched for, until none is left outside of the cgroup
+	MaxAdoptRounds = 5
+	// Times the monitoring loop is restarted after failing, before giving up
+	MaxMonitorRestarts = 5
+	// Consecutive ticks whose limits can't be applied before the monitoring loop gives up
+	MaxUpdateFailures = 5
+	// Shortest -interval, the stats of the kernel are too noisy below it
+	MinInterval = 100 * time.Millisecond
+	// A core is considered idle if it is busy less than this fraction of the time
+	IdleCoreThreshold = 0.1
+	// Benchmarks older than this are reported as stale
+	BenchmarkStaleAfter = 7 * 24 * time.Hour
+	// Throughputs above these are not plausible for the device class
+	MaxPlausibleRotationalBPS = 1 << 30  // 1GiB/s
+	MaxPlausibleSolidStateBPS = 32 << 30 // 32GiB/s
+	// Devices busier than this before their benchmark are reported, as the result will be depressed
+	BenchmarkIdleUtilization = 0.1
+	// Writes are rarely faster than reads, a larger ratio usually means the page cache was measured
+	MaxPlausibleWriteReadRatio = 5
+	// Disks benchmarked at the same time by default, each one has its own bandwidth
+	DefaultBenchmarkParallel = 4
+	// Bounds and default of cpu.weight
+	MinCPUWeight     = 1
+	MaxCPUWeight     = 10000
+	DefaultCPUWeight = 100
 )
 
-func initCPUTimes(cgManager *cgroup2.Manager) {
+func initCPUTimes(cgManager cgroupManager) {
 	lastCPUTimes.Lock()
 
-	times, err := cpu.Times(false)
+	times, err := systemCPUTimes(cpuAffinity)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	lastCPUTimes.system = times
 
+	numCores, err := cpu.Counts(true)
+	if err != nil {
+		fatal(err)
+	}
+	if cpuAffinity != nil {
+		numCores = len(cpuAffinity)
+	}
+	lastCPUTimes.numCores = numCores
+	lastCPUTimes.available = ewma{}
+
+	if cfg.perCoreCPU {
+		perCore, err := perCoreCPUTimes(cpuAffinity)
+		if err != nil {
+			fatal(err)
+		}
+		lastCPUTimes.perCore = perCore
+	}
+
 	cgStats, err := cgManager.Stat()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	lastCPUTimes.cg = cgStats.GetCPU().GetUsageUsec()
+	lastCPUTimes.nrPeriods = cgStats.GetCPU().GetNrPeriods()
+	lastCPUTimes.nrThrottled = cgStats.GetCPU().GetNrThrottled()
+	lastCPUTimes.throttledUsec = cgStats.GetCPU().GetThrottledUsec()
 
 	lastCPUTimes.Unlock()
 }
 
-func initIOCounters(cgManager *cgroup2.Manager) {
+func initIOCounters(cgManager cgroupManager) {
 	lastIOCounters.Lock()
 
-	counters, err := disk.IOCounters()
+	counters, err := system.IOCounters()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	lastIOCounters.system = counters
+	lastIOCounters.observed = make(map[string]int, len(counters))
+	for name := range counters {
+		lastIOCounters.observed[name] = 1
+	}
 
 	cgStats, err := cgManager.Stat()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
 	lastIOCounters.cg = cgStats.GetIo().GetUsage()
+	lastIOCounters.at = clock.Now()
+	lastIOCounters.warned = make(map[string]bool)
+	lastIOCounters.availableRead = make(map[string]ewma)
+	lastIOCounters.availableWrite = make(map[string]ewma)
 
 	lastIOCounters.Unlock()
 }
 
-func getMaxMemory(cgStat *stats.MemoryStat) int64 {
-	v, err := mem.VirtualMemory()
+type memorySample struct {
+	cgUsage   int64   // Current memory usage of the cgroup
+	cgLimit   int64   // Current memory limit of the cgroup
+	available float64 // Available memory on the system
+	total     float64 // Total memory of the system
+}
+
+func sampleMemory(cgStat *stats.MemoryStat) (memorySample, error) {
+	v, err := system.VirtualMemory()
 	if err != nil {
-		log.Fatal(err)
+		return memorySample{}, err
 	}
 
-	cgMem := int64(cgStat.GetUsageLimit())
-	availableMem := float64(v.Available)
-	totalMem := float64(v.Total)
+	// Available counts the page cache as reclaimable, but reclaiming it slows down the system:
+	// with -cache-reclaim-factor, that fraction of the cache isn't considered available
+	available := float64(v.Available) - cfg.cacheReclaimFactor*float64(v.Cached+v.Buffers)
+	available = math.Max(available, float64(v.Free))
+
+	return memorySample{
+		cgUsage:   int64(cgStat.GetUsage()),
+		cgLimit:   int64(cgStat.GetUsageLimit()),
+		available: available,
+		total:     float64(v.Total),
+	}, nil
+}
 
-	memMargin := totalMem * Margin
+// The gain is the fraction of the headroom (available resources minus margin) granted in one step
+// The reserve is the absolute amount left to the system, the more conservative of margin and reserve is used
+func getMaxMemory(s memorySample, margin, reserve, gain float64) int64 {
+	memMargin := math.Max(s.total*margin, reserve)
 	// If available memory less than margin, readjust
-	if availableMem < memMargin {
-		return cgMem - int64(memMargin-availableMem)
+	if s.available < memMargin {
+		return s.cgLimit - int64(gain*(memMargin-s.available))
 	}
 	// If available memory more than margin, readjust
-	return cgMem + int64(availableMem-memMargin)
+	return s.cgLimit + int64(gain*(s.available-memMargin))
 }
 
 // Copied from https://github.com/shirou/gopsutil/blob/v3.24.2/cpu/cpu.go#L104
@@ -125,12 +510,70 @@ func getAllBusy(t cpu.TimesStat) (float64, float64) {
 	return tot, busy
 }
 
-func getMaxCPU(cgStat *stats.CPUStat) (int64, uint64) {
+// Count the cores that were idle between two per-core samples
+func countIdleCores(last, cur []cpu.TimesStat) int {
+	idle := 0
+	for i := range cur {
+		if i >= len(last) {
+			break
+		}
+		curAll, curBusy := getAllBusy(cur[i])
+		lastAll, lastBusy := getAllBusy(last[i])
+
+		all := curAll - lastAll
+		if all <= 0 {
+			continue
+		}
+		if math.Max(0, curBusy-lastBusy)/all < IdleCoreThreshold {
+			idle++
+		}
+	}
+	return idle
+}
+
+// Max quota (same unit as getMaxCPU) when headroom is computed from fully idle cores only
+// The process can use what it already uses, plus the idle cores
+func getIdleCoresQuota(cgCPU, totalCPU float64, idleCores, numCores int) int64 {
+	if totalCPU == 0 || numCores == 0 {
+		return 0
+	}
+	return int64(100000 * (cgCPU/totalCPU + float64(idleCores)/float64(numCores)))
+}
+
+type cpuSample struct {
+	cg        float64 // CPU time used by the cgroup (µs)
+	total     float64 // CPU time elapsed on the system (µs)
+	available float64 // Idle CPU time on the system (µs)
+	idleCores int     // Fully idle cores, -1 if not measured
+	numCores  int     // Number of logical cores of the system
+	// Periods elapsed, periods in which the cgroup was throttled by its quota, and time throttled (µs)
+	periods, throttled, throttledUsec uint64
+}
+
+// Fraction of the periods in which the cgroup was throttled
+func (s cpuSample) throttledRatio() float64 {
+	if s.periods == 0 {
+		return 0
+	}
+	return float64(s.throttled) / float64(s.periods)
+}
+
+// CPU used by the cgroup, in cores
+func (s cpuSample) cores() float64 {
+	if s.total == 0 {
+		return 0
+	}
+	return s.cg / s.total * float64(s.numCores)
+}
+
+// Return false when the sample can't be used: the CPU count changed (hotplug, elastic VMs)
+// and the CPU times were re-baselined
+func sampleCPU(cgStat *stats.CPUStat) (cpuSample, bool, error) {
 	curCgTimes := cgStat.GetUsageUsec()
 
-	curTimes, err := cpu.Times(false)
+	curTimes, err := systemCPUTimes(cpuAffinity)
 	if err != nil {
-		log.Fatal(err)
+		return cpuSample{}, false, err
 	}
 
 	// Mutex lock
@@ -140,330 +583,2049 @@ func getMaxCPU(cgStat *stats.CPUStat) (int64, uint64) {
 	lastCgTimes := lastCPUTimes.cg
 	lastCPUTimes.cg = curCgTimes
 
+	periods := clampedDelta(cgStat.GetNrPeriods(), lastCPUTimes.nrPeriods)
+	throttled := clampedDelta(cgStat.GetNrThrottled(), lastCPUTimes.nrThrottled)
+	throttledUsec := clampedDelta(cgStat.GetThrottledUsec(), lastCPUTimes.throttledUsec)
+	lastCPUTimes.nrPeriods = cgStat.GetNrPeriods()
+	lastCPUTimes.nrThrottled = cgStat.GetNrThrottled()
+	lastCPUTimes.throttledUsec = cgStat.GetThrottledUsec()
+
 	lastTimes := lastCPUTimes.system
 	lastCPUTimes.system = curTimes
 	if len(lastTimes) == 0 || len(lastTimes) != len(curTimes) {
-		log.Fatal("Error: could not get CPU times")
+		log.Printf("CPU times changed from %d to %d entries, measuring again\n", len(lastTimes), len(curTimes))
+		if numCores, err := cpu.Counts(true); err == nil && cpuAffinity == nil {
+			lastCPUTimes.numCores = numCores
+		}
+		lastCPUTimes.perCore = nil
+		return cpuSample{}, false, nil
 	}
 	curAll, curBusy := getAllBusy(curTimes[0])
 	lastAll, lastBusy := getAllBusy(lastTimes[0])
 
-	cgCPU := math.Max(0, float64(curCgTimes-lastCgTimes))
 	totalCPU := math.Max(0, curAll-lastAll) * 1e6 // Seconds to microseconds
-	availableCPU := math.Max(0, totalCPU-math.Max(0, curBusy-lastBusy)*1e6)
+	sample := cpuSample{
+		cg:        float64(clampedDelta(curCgTimes, lastCgTimes)), // The counter restarts if the cgroup is recreated
+		total:     totalCPU,
+		available: math.Max(0, totalCPU-math.Max(0, curBusy-lastBusy)*1e6),
+		idleCores: -1,
+		numCores:  lastCPUTimes.numCores,
+
+		periods:       periods,
+		throttled:     throttled,
+		throttledUsec: throttledUsec,
+	}
+	if cfg.loadAverageWeight > 0 {
+		sample.available = blendLoadAverage(sample.available, totalCPU, cfg.loadAverageWeight)
+	}
+	// The fraction is smoothed, the CPU time of an interval depends on its length
+	if totalCPU > 0 {
+		sample.available = totalCPU * lastCPUTimes.available.update(sample.available/totalCPU, cfg.smoothing)
+	}
+
+	if cfg.perCoreCPU {
+		// The idle cores are only unknown for this sample
+		curPerCore, err := perCoreCPUTimes(cpuAffinity)
+		if err != nil {
+			log.Printf("Warning: could not read the per-core CPU times: %s\n", err)
+		}
+		lastPerCore := lastCPUTimes.perCore
+		lastCPUTimes.perCore = curPerCore
+
+		if err == nil && len(lastPerCore) == len(curPerCore) {
+			sample.idleCores = countIdleCores(lastPerCore, curPerCore)
+			sample.numCores = len(curPerCore)
+		}
+	}
+
+	return sample, true, nil
+}
+
+// Idle CPU time over the last second can be misleading on bursty systems: the 1-minute load average
+// captures the sustained demand. The idle time is blended with the one implied by the load average
+// (none when the load exceeds the number of CPUs), and only ever lowered by it
+func blendLoadAverage(available, total, weight float64) float64 {
+	avg, err := load.Avg()
+	if err != nil {
+		return available
+	}
+	loadAvailable := total * math.Max(0, 1-avg.Load1/float64(runtime.NumCPU()))
+	return math.Min(available, (1-weight)*available+weight*loadAvailable)
+}
+
+// Burst allowance of the quota: a fraction of the idle headroom (idle CPU minus margin) per period,
+// so that the process can briefly exceed its quota during spikes while the system is idle, without
+// a permanently higher quota. The kernel bounds it by the quota
+func getCPUBurst(s cpuSample, margin, fraction float64, quota int64) int64 {
+	if s.total == 0 {
+		return 0
+	}
+	headroom := math.Max(0, s.available-s.total*margin)
+	burst := int64(fraction * 100000 * headroom / s.total) // Same scale as the quota, 100ms period
+	if burst > quota {
+		burst = quota
+	}
+	return burst
+}
+
+// The reserve is expressed in cores
+func getMaxCPU(s cpuSample, margin, reserve, gain float64) (int64, uint64) {
+	if s.total == 0 {
+		return 0, 100000
+	}
 
-	cpuMargin := totalCPU * Margin
+	var reserveCPU float64
+	if s.numCores > 0 {
+		// Cores to CPU time over the interval
+		reserveCPU = reserve * s.total / float64(s.numCores)
+	}
+
+	var quota int64
+	cpuMargin := math.Max(s.total*margin, reserveCPU)
 	// If available CPU less than margin, readjust
-	if availableCPU < cpuMargin {
-		return int64(100000 * (cgCPU - (cpuMargin - availableCPU)) / totalCPU), 100000 // 100ms period
+	if s.available < cpuMargin {
+		quota = int64(100000 * (s.cg - gain*(cpuMargin-s.available)) / s.total) // 100ms period
+	} else {
+		// If available CPU more than margin, readjust
+		quota = int64(100000 * (s.cg + gain*(s.available-cpuMargin)) / s.total)
+	}
+
+	// Partially busy cores are not real headroom: the process would contend with their load
+	if s.idleCores >= 0 {
+		if maxQuota := getIdleCoresQuota(s.cg, s.total, s.idleCores, s.numCores); quota > maxQuota {
+			quota = maxQuota
+		}
+	}
+
+	return quota, 100000
+}
+
+// With -cpu-mode weight, the share of the machine granted by the quota becomes a cpu.weight instead:
+// against the rest of the system at the default weight, the process gets that share under
+// contention, and can use the idle CPU beyond it
+func getCPUWeight(quota int64, period uint64) uint64 {
+	if period == 0 || quota <= 0 {
+		return MinCPUWeight
+	}
+	share := float64(quota) / float64(period)
+	if share >= 1 {
+		return MaxCPUWeight
+	}
+	weight := math.Round(DefaultCPUWeight * share / (1 - share))
+	return uint64(math.Max(MinCPUWeight, math.Min(MaxCPUWeight, weight)))
+}
+
+// Set cpu.weight from the decided quota with -cpu-mode weight, cpu.max otherwise
+func applyCPUMode(limits *Limits) {
+	limits.CPUWeight = 0
+	if cfg.cpuMode == "weight" && !limits.Skipped[resourceCPU] {
+		limits.CPUWeight = getCPUWeight(limits.CPUQuota, limits.CPUPeriod)
 	}
-	// If available CPU more than margin, readjust
-	return int64(100000 * (cgCPU + (availableCPU - cpuMargin)) / totalCPU), 100000
 }
 
-func setMaxIO(outputCmd []byte, max *maxIO, read bool) {
+// Return whether a value could be parsed
+func setMaxIO(outputCmd []byte, max *maxIO, read bool) bool {
 	// Get last (unit) and before last (value) word of last line of the output
-	words := bytes.Fields(outputCmd)
+	// ex: dd prints "83886080 bytes (84 MB, 80 MiB) copied, 0.05 s, 1.6 GB/s" after its records counts
+	lines := bytes.Split(bytes.TrimSpace(outputCmd), []byte("\n"))
+	words := bytes.Fields(lines[len(lines)-1])
+	if len(words) < 2 {
+		return false
+	}
 	value, err := strconv.ParseFloat(string(words[len(words)-2]), 64)
-	if err != nil {
-		return
+	if err != nil || math.IsNaN(value) || value < 0 {
+		return false
 	}
 
-	var result uint64
 	// ex: MB/sec => MB
 	unit := strings.Split(string(words[len(words)-1]), "/")[0]
 	switch unit {
 	case "kB":
-		result = uint64(value * 1024)
+		value *= 1024
 	case "MB":
-		result = uint64(value * 1024 * 1024)
+		value *= 1024 * 1024
 	case "GB":
-		result = uint64(value * 1024 * 1024 * 1024)
+		value *= 1024 * 1024 * 1024
 	case "TB":
-		result = uint64(value * 1024 * 1024 * 1024 * 1024)
-	default:
-		result = uint64(value)
+		value *= 1024 * 1024 * 1024 * 1024
 	}
+	// Converting a float larger than the max uint64 is undefined
+	if value >= math.MaxUint64 {
+		return false
+	}
+	result := uint64(value)
 
-	if read {
-		max.read += result
-	} else {
-		max.write += result
+	// The devices of a disk share its bandwidth, the highest throughput measured is kept, not their sum
+	if read && result > max.read {
+		max.read = result
+	} else if !read && result > max.write {
+		max.write = result
 	}
+	return true
 }
 
-func benchmarkReadIO(device lsblkOutputJSON, max *maxIO) {
-	hdparm := exec.Command("sudo", "hdparm", "-Tt", "/dev/"+device.Kname)
-	outputHdparmCmd, err := hdparm.Output()
-	if err == nil {
-		setMaxIO(outputHdparmCmd, max, true)
+func saturatingAdd(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
 	}
+	return a + b
 }
 
-func benchmarkWriteIO(device lsblkOutputJSON, uniqueFileName string, max *maxIO) {
-	// Mount the device
-	mount := exec.Command("sudo", "mount", "/dev/"+device.Kname, "/tmp")
-	if err := mount.Run(); err != nil {
-		return
+// Parse the "major:minor" numbers of a device
+func parseMajMin(majMin string) (int64, int64, error) {
+	major, minor, found := strings.Cut(majMin, ":")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid maj:min %q", majMin)
 	}
-
-	dd := exec.Command("sudo dd", "if=/dev/zero", "of="+uniqueFileName, "bs=8k", "count=10k")
-
-	var outputDdCmd bytes.Buffer
-	dd.Stderr = &outputDdCmd
-
-	if err := dd.Run(); err == nil {
-		setMaxIO(outputDdCmd.Bytes(), max, false)
+	majorNumber, err := strconv.ParseUint(strings.TrimSpace(major), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid major number in %q", majMin)
 	}
-
-	_ = exec.Command("sudo", "sync", uniqueFileName).Run()
-	_ = exec.Command("sudo", "rm", "-f", uniqueFileName).Run()
-	_ = exec.Command("sudo", "umount", "/tmp").Run()
-}
-
-func recursiveBenchmarkIO(device lsblkOutputJSON, uniqueFileName *string, max *maxIO) {
-	if device.Children != nil && len(device.Children) > 0 {
-		for _, child := range device.Children {
-			recursiveBenchmarkIO(child, uniqueFileName, max)
-		}
+	minorNumber, err := strconv.ParseUint(strings.TrimSpace(minor), 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid minor number in %q", majMin)
 	}
-	benchmarkReadIO(device, max)
-	benchmarkWriteIO(device, *uniqueFileName, max)
+	return int64(majorNumber), int64(minorNumber), nil
 }
 
-// Benchmark IO speed for each device
-// Method: https://askubuntu.com/a/87036
-func benchmarkIO() {
-	fmt.Println("Before running the process, benchmarking IO...")
-
-	lsblk = make(map[string]lsblkOutputJSON)
-	ioBenchmark = make(map[string]maxIO)
-
-	// Run lsblk command to get the list of block devices with their major and minor numbers
-	lsblkCmd := exec.Command("sudo", "lsblk", "-anJo", "NAME,KNAME,MAJ:MIN,TYPE")
-	outputLsblkCmd, err := lsblkCmd.Output()
-	if err != nil {
-		log.Fatal(err)
-	}
+// Parse the JSON output of lsblk, keeping only the physical disks by kernel name
+func parseLsblk(output []byte) (map[string]lsblkOutputJSON, error) {
 	var lsblkOutput lsblkOutputListJSON
-	if err = json.Unmarshal(outputLsblkCmd, &lsblkOutput); err != nil {
-		log.Fatal(err)
+	if err := json.Unmarshal(output, &lsblkOutput); err != nil {
+		return nil, err
 	}
+
+	devices := make(map[string]lsblkOutputJSON)
 	// Filter to remove all non-physical devices
 	// We don't go deeper than the first level of children
 	// Because physical devices are at the first level
 	for _, device := range lsblkOutput.Blockdevices {
-		if device.Type == "disk" {
-			lsblk[device.Kname] = device
+		if device.Type == "disk" && device.Kname != "" {
+			devices[device.Kname] = device
 		}
 	}
+	return devices, nil
+}
 
-	uniqueFileName := fmt.Sprintf("/tmp/output_%s", uuid.New().String())
+// Runs the read and write benchmarks of a device: hdparm and dd, or the fakes of the tests
+type ioBenchmarker interface {
+	Read(device lsblkOutputJSON, max *maxIO)
+	Write(device lsblkOutputJSON, max *maxIO)
+}
 
-	for _, device := range lsblk {
-		max := maxIO{
-			read:  0,
-			write: 0,
-		}
-		recursiveBenchmarkIO(device, &uniqueFileName, &max)
-		ioBenchmark[device.Kname] = max
-	}
+type toolBenchmarker struct{}
 
-	fmt.Println("Finished benchmarking IO")
-}
+func (toolBenchmarker) Read(device lsblkOutputJSON, max *maxIO) { benchmarkReadIO(device, max) }
 
-func findWithMajorMinor(counters []*stats.IOEntry, major, minor uint64) *stats.IOEntry {
-	for _, v := range counters {
-		if v.Major == major && v.Minor == minor {
-			return v
-		}
+func (toolBenchmarker) Write(device lsblkOutputJSON, max *maxIO) { benchmarkWriteIO(device, max) }
+
+var benchmarker ioBenchmarker = toolBenchmarker{}
+
+func benchmarkReadIO(device lsblkOutputJSON, max *maxIO) {
+	hdparm := exec.Command("sudo", "hdparm", "-Tt", "/dev/"+device.Kname)
+	outputHdparmCmd, err := hdparm.Output()
+	if err == nil && setMaxIO(outputHdparmCmd, max, true) {
+		max.readTool = "hdparm"
 	}
-	return nil
 }
 
-func getMaxIO(cgStat *stats.IOStat) []cgroup2.Entry {
-	curCgCounters := cgStat.GetUsage()
-
-	curCounters, err := disk.IOCounters()
+func benchmarkWriteIO(device lsblkOutputJSON, max *maxIO) {
+	// Mount the device on a dedicated throwaway mountpoint
+	// Never over /tmp, which may be the root filesystem or a tmpfs holding runtime state
+	// The temporary directory is not created when missing, it is up to the system to provide it
+	mountpoint, err := os.MkdirTemp("", "process-scaler-bench-")
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Warning: could not create a mountpoint in %s for the write benchmark of %s: %s\n", os.TempDir(), device.Kname, err)
+		return
 	}
+	defer os.Remove(mountpoint)
 
-	// Mutex lock
-	lastIOCounters.Lock()
-	defer lastIOCounters.Unlock()
-
-	lastCgCounters := lastIOCounters.cg
-	lastIOCounters.cg = curCgCounters
+	// A device may be the child of several disks (e.g. a logical volume spanning them), whose
+	// benchmarks run in parallel: it is mounted by one at a time
+	unlock := lockMount(device.Kname)
+	defer unlock()
+	mount := exec.Command("sudo", "mount", "/dev/"+device.Kname, mountpoint)
+	if err := mount.Run(); err != nil {
+		return
+	}
+	defer func() {
+		_ = exec.Command("sudo", "umount", mountpoint).Run()
+	}()
 
-	lastCounters := lastIOCounters.system
-	lastIOCounters.system = curCounters
+	// A fresh file for each device, removed even if dd fails half way
+	outputFile := filepath.Join(mountpoint, "output_"+uuid.New().String())
+	defer func() {
+		_ = exec.Command("sudo", "rm", "-f", outputFile).Run()
+	}()
 
-	result := make([]cgroup2.Entry, 0)
+	dd := exec.Command("sudo", "dd", "if=/dev/zero", "of="+outputFile, "bs=8k", "count=10k")
 
-	for deviceName, curCounter := range curCounters {
-		device, exists := lsblk[deviceName]
-		if !exists {
-			continue
-		}
+	var outputDdCmd bytes.Buffer
+	dd.Stderr = &outputDdCmd
 
-		var major, minor int64
-		if _, err = fmt.Sscanf(device.MajMin, "%d:%d", &major, &minor); err != nil {
-			continue
-		}
+	err = dd.Run()
+	switch {
+	case bytes.Contains(outputDdCmd.Bytes(), []byte("No space left on device")):
+		log.Printf("Warning: write benchmark of %s failed: no space left on the filesystem\n", device.Kname)
+	case err != nil:
+		log.Printf("Warning: write benchmark of %s failed: %s %s\n", device.Kname, err, bytes.TrimSpace(outputDdCmd.Bytes()))
+	case setMaxIO(outputDdCmd.Bytes(), max, false):
+		max.writeTool = "dd"
+		max.writesTested = true
+	}
 
-		lastCounter := lastCounters[deviceName]
-		curCgCounter := findWithMajorMinor(curCgCounters, uint64(major), uint64(minor))
-		lastCgCounter := findWithMajorMinor(lastCgCounters, uint64(major), uint64(minor))
+	_ = exec.Command("sudo", "sync", outputFile).Run()
+}
 
-		if (lastCounter != disk.IOCountersStat{}) {
-			// Read
-			cgBytesRead := math.Max(0, float64(curCgCounter.GetRbytes()-lastCgCounter.GetRbytes()))
-			maxBytesRead := float64(ioBenchmark[deviceName].read)
-			availableBytesRead := math.Max(0, maxBytesRead-math.Max(0, float64(curCounter.ReadBytes-lastCounter.ReadBytes)))
+var (
+	mountLocksMu sync.Mutex
+	mountLocks   = make(map[string]*sync.Mutex) // By kernel name of the device
+)
 
-			readMargin := maxBytesRead * Margin
+// Serialize the write benchmarks of a device, return the function releasing it
+func lockMount(kname string) func() {
+	mountLocksMu.Lock()
+	lock, exists := mountLocks[kname]
+	if !exists {
+		lock = new(sync.Mutex)
+		mountLocks[kname] = lock
+	}
+	mountLocksMu.Unlock()
 
-			readEntry := cgroup2.Entry{
-				Type:  cgroup2.ReadBPS,
-				Major: major,
-				Minor: minor,
-			}
-			// If available IO read less than margin, readjust
-			if availableBytesRead < readMargin {
-				readEntry.Rate = uint64(cgBytesRead - (readMargin - availableBytesRead))
-			} else {
-				readEntry.Rate = uint64(cgBytesRead + (availableBytesRead - readMargin))
-			}
-			if readEntry.Rate > 0 {
-				result = append(result, readEntry)
-			}
+	lock.Lock()
+	return lock.Unlock
+}
 
-			// Write
-			cgBytesWrite := math.Max(0, float64(curCgCounter.GetWbytes()-lastCgCounter.GetWbytes()))
-			maxBytesWrite := float64(ioBenchmark[deviceName].write)
-			availableBytesWrite := math.Max(0, maxBytesWrite-math.Max(0, float64(curCounter.WriteBytes-lastCounter.WriteBytes)))
+// Fraction of time the device was busy over the window
+func deviceIOUtilization(kname string, window time.Duration) (float64, error) {
+	before, err := system.IOCounters()
+	if err != nil {
+		return 0, err
+	}
+	clock.Sleep(window)
+	after, err := system.IOCounters()
+	if err != nil {
+		return 0, err
+	}
+	if _, exists := before[kname]; !exists {
+		return 0, fmt.Errorf("no IO counters for %s", kname)
+	}
+	busy := time.Duration(clampedDelta(after[kname].IoTime, before[kname].IoTime)) * time.Millisecond
+	return math.Min(1, float64(busy)/float64(window)), nil
+}
 
-			writeMargin := maxBytesWrite * Margin
+func clampedDelta(cur, last uint64) uint64 {
+	if cur < last {
+		return 0
+	}
+	return cur - last
+}
 
-			writeEntry := cgroup2.Entry{
-				Type:  cgroup2.WriteBPS,
-				Major: major,
-				Minor: minor,
-			}
-			// If available IO write less than margin, readjust
-			if availableBytesWrite < writeMargin {
-				writeEntry.Rate = uint64(cgBytesWrite - (writeMargin - availableBytesWrite))
-			} else {
-				writeEntry.Rate = uint64(cgBytesWrite + (availableBytesWrite - writeMargin))
-			}
-			if writeEntry.Rate > 0 {
-				result = append(result, writeEntry)
-			}
+// Measure how busy the device is before benchmarking it, waiting up to -benchmark-wait-idle for it to be idle
+// Without -benchmark-wait-idle, the device is not measured (-1), so that the benchmarks start right away
+func measureBaselineIO(kname string) float64 {
+	if cfg.benchmarkWaitIdle <= 0 {
+		return -1
+	}
+	deadline := clock.Now().Add(cfg.benchmarkWaitIdle)
+	for {
+		util, err := deviceIOUtilization(kname, time.Second)
+		if err != nil {
+			return -1
+		}
+		if util <= BenchmarkIdleUtilization {
+			slog.Info("Device idle enough to be benchmarked", "device", kname, "busy_percent", math.Round(util*100))
+			return util
+		}
+		if clock.Now().After(deadline) {
+			log.Printf("Warning: %s is %.0f%% busy before its benchmark, its measured max will be lower than its real max\n", kname, util*100)
+			return util
 		}
+		slog.Info("Device busy, waiting for it to be idle before benchmarking", "device", kname, "busy_percent", math.Round(util*100))
 	}
+}
 
-	return result
+// The partitions of a disk share its bandwidth: its reads are only measured on the disk itself, and
+// its writes on the first of its filesystems that can be written
+func recursiveBenchmarkIO(device lsblkOutputJSON, max *maxIO, critical, readOnly map[string]bool) {
+	for _, child := range device.Children {
+		recursiveBenchmarkIO(child, max, critical, readOnly)
+	}
+	if device.Type == "disk" {
+		benchmarker.Read(device, max)
+	}
+	if max.writesTested {
+		return
+	}
+	if critical[device.Kname] {
+		slog.Info("Skipping write benchmark, the device backs a critical mountpoint", "device", device.Kname)
+		return
+	}
+	if readOnly[device.Kname] {
+		slog.Info("Skipping write benchmark, the device is mounted read-only", "device", device.Kname)
+		return
+	}
+	benchmarker.Write(device, max)
 }
 
-func monitorResources(cgManager *cgroup2.Manager, processFinished chan bool) {
-	fmt.Println("Monitoring resources usage while the process is running")
-	initCPUTimes(cgManager)
-	initIOCounters(cgManager)
-	time.Sleep(1 * time.Second)
+// Mountpoints whose devices are never write benchmarked
+var criticalMountpoints = []string{"/", "/boot", "/boot/efi"}
 
-	for {
-		select {
-		// Exit when the process has finished
-		case <-processFinished:
-			return
-		default:
-			cgStats, err := cgManager.Stat()
-			if err != nil {
-				log.Fatal(err)
+// Find the kernel names of the devices backing the critical mountpoints
+func getCriticalDevices() map[string]bool {
+	return mountedDevices(func(mountpoint string, _ []string) bool {
+		for _, critical := range criticalMountpoints {
+			if mountpoint == critical {
+				return true
 			}
+		}
+		return false
+	})
+}
 
-			maxMemoryBytes := getMaxMemory(cgStats.GetMemory())
-			cpuQuota, cpuPeriod := getMaxCPU(cgStats.GetCPU())
-			maxIOEntry := getMaxIO(cgStats.GetIo())
-
-			res := cgroup2.Resources{
-				Memory: &cgroup2.Memory{
-					Max: &maxMemoryBytes,
-				},
-				CPU: &cgroup2.CPU{
-					// Runs cpuQuota microseconds every cpuPeriod microseconds
-					Max: cgroup2.NewCPUMax(&cpuQuota, &cpuPeriod),
-				},
-				IO: &cgroup2.IO{
-					Max: maxIOEntry,
-				},
+// Find the kernel names of the devices mounted read-only: mounting them read-write for the write
+// benchmark would write to a filesystem meant to stay untouched (e.g. a recovery partition)
+func getReadOnlyDevices() map[string]bool {
+	return mountedDevices(func(_ string, options []string) bool {
+		for _, option := range options {
+			if option == "ro" {
+				return true
 			}
-			// Update
-			if err = cgManager.Update(&res); err != nil {
-				log.Fatal(err)
-			}
-			time.Sleep(1 * time.Second) // Monitor every second
 		}
-	}
+		return false
+	})
 }
 
-// Create a cgroup and put the process in it
-func createCgroup(proc *exec.Cmd) *cgroup2.Manager {
-	res := cgroup2.Resources{}
+// Find the kernel names of the mounted devices whose mount matches
+func mountedDevices(match func(mountpoint string, options []string) bool) map[string]bool {
+	devices := make(map[string]bool)
 
-	// Create a new cgroup
-	cgName := fmt.Sprintf("process_scaler_%d.slice", proc.Process.Pid)
-	m, err := cgroup2.NewSystemd("/", cgName, -1, &res)
+	mounts, err := os.ReadFile("/proc/mounts")
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
-
-	// Enable the relevant controllers
-	if err = m.ToggleControllers([]string{"memory", "cpu", "io"}, cgroup2.Enable); err != nil {
-		log.Fatal(err)
+	for _, line := range strings.Split(string(mounts), "\n") {
+		// Format: device mountpoint fstype options dump pass
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		if !match(fields[1], strings.Split(fields[3], ",")) {
+			continue
+		}
+		// ex: /dev/mapper/vg-root => /dev/dm-0
+		device, err := filepath.EvalSymlinks(fields[0])
+		if err != nil {
+			device = fields[0]
+		}
+		devices[filepath.Base(device)] = true
 	}
+	return devices
+}
 
-	// Add the process to the cgroup
-	if err = m.AddProc(uint64(proc.Process.Pid)); err != nil {
-		log.Fatal(err)
+// Also mark as critical the devices containing a critical device (e.g. the disk of the root partition)
+// Return whether the device or one of its children is critical
+func markCriticalAncestors(device lsblkOutputJSON, critical map[string]bool) bool {
+	isCritical := critical[device.Kname]
+	for _, child := range device.Children {
+		if markCriticalAncestors(child, critical) {
+			isCritical = true
+		}
 	}
-
-	return m
+	if isCritical {
+		critical[device.Kname] = true
+	}
+	return isCritical
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		log.Fatal("Usage: go run main.go <command> <args>")
+// Benchmark IO speed for each device
+// Method: https://askubuntu.com/a/87036
+func benchmarkIO() {
+	ioBenchmark = make(map[string]maxIO)
+
+	// Without the devices, the io controller is not enabled and the IO is left unconstrained
+	if cfg.skipIOBenchmark || cfg.unmanaged[resourceIO] {
+		log.Println("IO benchmark skipped, IO won't be managed")
+		return
+	}
+	// e.g. containers and CI runners
+	for _, tool := range []string{"sudo", "lsblk", "hdparm"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			softFail("%s not found, skipping the IO benchmark: IO won't be managed", tool)
+			return
+		}
+	}
+
+	// Run lsblk command to get the list of block devices with their major and minor numbers
+	lsblkCmd := exec.Command("sudo", "lsblk", "-anJo", "NAME,KNAME,MAJ:MIN,TYPE,MODEL,SERIAL,ROTA")
+	outputLsblkCmd, err := lsblkCmd.Output()
+	if err != nil {
+		fatal(err)
+	}
+	if lsblk, err = parseLsblk(outputLsblkCmd); err != nil {
+		fatal(err)
+	}
+	if len(lsblk) == 0 {
+		log.Println("Warning: no disk found, IO won't be managed")
+		return
+	}
+
+	// The devices must be known before the cgroup is created, only their benchmark is asynchronous
+	if cfg.benchmarkAsync {
+		slog.Info("Benchmarking IO in the background, each device is throttled once benchmarked", "devices", len(lsblk))
+		go benchmarkDevices()
+		return
+	}
+	slog.Info("Before running the process, benchmarking IO", "devices", len(lsblk))
+	benchmarkDevices()
+}
+
+func setBenchmark(kname string, max maxIO) {
+	ioBenchmarkMu.Lock()
+	ioBenchmark[kname] = max
+	ioBenchmarkMu.Unlock()
+}
+
+func getBenchmark(kname string) (maxIO, bool) {
+	ioBenchmarkMu.Lock()
+	defer ioBenchmarkMu.Unlock()
+	max, exists := ioBenchmark[kname]
+	return max, exists
+}
+
+// Benchmark a disk, with its partitions
+func benchmarkDevice(device lsblkOutputJSON, critical, readOnly map[string]bool) maxIO {
+	max := maxIO{
+		read:   0,
+		write:  0,
+		model:  strings.TrimSpace(device.Model),
+		serial: strings.TrimSpace(device.Serial),
+	}
+	max.baselineUtil = measureBaselineIO(device.Kname)
+	recursiveBenchmarkIO(device, &max, critical, readOnly)
+	max.measuredAt = time.Now()
+	max.source = benchmarkSourceMeasured
+	if max.readTool == "" && max.writeTool == "" {
+		max.source = benchmarkSourceSkipped
+	}
+	setBenchmark(device.Kname, max)
+	if max.readTool == "" {
+		softFailError(&BenchmarkError{Device: device.Kname, Direction: "read", Cause: errors.New("hdparm could not measure it")},
+			"its reads won't be throttled")
+	}
+	if !max.writesTested && !critical[device.Kname] && !readOnly[device.Kname] {
+		softFailError(&BenchmarkError{Device: device.Kname, Direction: "write", Cause: errors.New("none of its filesystems could be written")},
+			"its writes won't be throttled")
+	}
+	checkBenchmarkPlausibility(device, max)
+	return max
+}
+
+func benchmarkDevices() {
+	readOnly := getReadOnlyDevices()
+	critical := make(map[string]bool)
+	if cfg.benchmarkExcludeCritical {
+		critical = getCriticalDevices()
+		for _, device := range lsblk {
+			markCriticalAncestors(device, critical)
+		}
+	}
+
+	var cache benchmarkCache
+	kernel := kernelRelease()
+	if cfg.benchmarkCache != "" {
+		cache = loadBenchmarkCache(cfg.benchmarkCache)
+		cache.prune(lsblk)
+	}
+
+	// The budget is checked between devices, the benchmark of a device is never interrupted
+	var deadline time.Time
+	if cfg.benchmarkBudget > 0 {
+		deadline = time.Now().Add(cfg.benchmarkBudget)
+	}
+	var unbenchmarked []string
+
+	var pending []lsblkOutputJSON
+	for _, device := range lsblk {
+		if saved, valid := resumedState.benchmark(device, kernel); valid && !cfg.benchmarkRefresh {
+			slog.Info("Using the benchmark from the saved state", "device", device.Kname)
+			setBenchmark(device.Kname, saved)
+			continue
+		}
+		if cfg.benchmarkCache != "" && !cfg.benchmarkRefresh {
+			if cached, valid := cache.get(device, kernel); valid {
+				slog.Info("Using cached benchmark", "device", device.Kname)
+				setBenchmark(device.Kname, cached)
+				continue
+			}
+		}
+		pending = append(pending, device)
+	}
+
+	// Each disk has its own bandwidth, they are benchmarked by a bounded pool of workers
+	var (
+		mu      sync.Mutex // Protects cache and unbenchmarked
+		workers sync.WaitGroup
+		queue   = make(chan lsblkOutputJSON)
+	)
+	for i := 0; i < cfg.benchmarkParallel && i < len(pending); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for device := range queue {
+				if !deadline.IsZero() && time.Now().After(deadline) {
+					setBenchmark(device.Kname, maxIO{source: benchmarkSourceUnbenchmarked})
+					mu.Lock()
+					unbenchmarked = append(unbenchmarked, device.Kname)
+					mu.Unlock()
+					continue
+				}
+				max := benchmarkDevice(device, critical, readOnly)
+				if cfg.benchmarkCache != "" && max.source == benchmarkSourceMeasured {
+					mu.Lock()
+					cache.set(device, kernel, max)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, device := range pending {
+		queue <- device
+	}
+	close(queue)
+	workers.Wait()
+
+	if cfg.benchmarkCache != "" {
+		if err := cache.save(cfg.benchmarkCache); err != nil {
+			log.Printf("Warning: could not write benchmark cache %s: %s\n", cfg.benchmarkCache, err)
+		}
+	}
+
+	if len(unbenchmarked) > 0 {
+		sort.Strings(unbenchmarked)
+		log.Printf("Warning: benchmark budget of %s exhausted, %s not benchmarked and won't be throttled\n",
+			cfg.benchmarkBudget, strings.Join(unbenchmarked, ", "))
+	}
+	slog.Info("Finished benchmarking IO")
+}
+
+// Warn about benchmark results that are likely wrong, before they cause bad throttling
+func checkBenchmarkPlausibility(device lsblkOutputJSON, max maxIO) {
+	maxPlausible := uint64(MaxPlausibleSolidStateBPS)
+	class := "solid state"
+	if device.Rota {
+		maxPlausible = MaxPlausibleRotationalBPS
+		class = "rotational"
+	}
+
+	var problems []string
+	if max.writesTested && max.readTool != "" && max.write > MaxPlausibleWriteReadRatio*max.read {
+		problems = append(problems, fmt.Sprintf("write throughput (%d B/s) is more than %d times the read throughput (%d B/s)",
+			max.write, MaxPlausibleWriteReadRatio, max.read))
+	}
+	if max.read > maxPlausible {
+		problems = append(problems, fmt.Sprintf("read throughput (%d B/s) is implausibly high for a %s device", max.read, class))
+	}
+	if max.write > maxPlausible {
+		problems = append(problems, fmt.Sprintf("write throughput (%d B/s) is implausibly high for a %s device", max.write, class))
+	}
+
+	for _, problem := range problems {
+		softFail("benchmark of %s looks wrong: %s. The page cache was probably measured, "+
+			"IO throttling of this device will be inaccurate", device.Kname, problem)
+	}
+}
+
+func findWithMajorMinor(counters []*stats.IOEntry, major, minor uint64) *stats.IOEntry {
+	for _, v := range counters {
+		if v.Major == major && v.Minor == minor {
+			return v
+		}
+	}
+	return nil
+}
+
+type ioSample struct {
+	major, minor int64
+	// Bytes read/written by the cgroup, max of the device, and bytes the device could still read/write
+	cgRead, maxRead, availableRead    float64
+	cgWrite, maxWrite, availableWrite float64
+	// Whether the max was measured, otherwise that direction is not throttled
+	readTested, writeTested bool
+	// Average service time of the IOs of the device over the interval (ms), and whether it exceeds
+	// -io-latency-threshold: the device is saturated whatever its throughput
+	latency   float64
+	saturated bool
+}
+
+// io.max can only be set on whole disks, so IO is throttled at the disk level:
+// the system counters of a disk already include its partitions, and the cgroup counters
+// of its partitions (if the kernel reports them) are added to the disk's
+func diskCgCounters(counters []*stats.IOEntry, device lsblkOutputJSON) (rbytes, wbytes uint64) {
+	devices := []lsblkOutputJSON{device}
+	for _, child := range device.Children {
+		if child.Type == "part" {
+			devices = append(devices, child)
+		}
+	}
+
+	for _, d := range devices {
+		major, minor, err := parseMajMin(d.MajMin)
+		if err != nil {
+			continue
+		}
+		entry := findWithMajorMinor(counters, uint64(major), uint64(minor))
+		rbytes = saturatingAdd(rbytes, entry.GetRbytes())
+		wbytes = saturatingAdd(wbytes, entry.GetWbytes())
+	}
+	return rbytes, wbytes
+}
+
+// Without cgroup accounting (a nil cgStat), all the IO of each device is attributed to the process
+func sampleIO(cgStat *stats.IOStat) ([]ioSample, error) {
+	curCgCounters := cgStat.GetUsage()
+	systemAccounting := cgStat == nil
+
+	curCounters, err := system.IOCounters()
+	if err != nil {
+		return nil, err
+	}
+
+	// Mutex lock
+	lastIOCounters.Lock()
+	defer lastIOCounters.Unlock()
+
+	lastCgCounters := lastIOCounters.cg
+	// Kept while io.stat is unavailable, in case it becomes available again
+	if !systemAccounting {
+		lastIOCounters.cg = curCgCounters
+	}
+
+	lastCounters := lastIOCounters.system
+	lastIOCounters.system = curCounters
+
+	// Throughputs are per second, like the benchmark, whatever the interval between samples
+	now := clock.Now()
+	elapsed := now.Sub(lastIOCounters.at).Seconds()
+	lastIOCounters.at = now
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+
+	// A device that appears (or reappears) mid-run has no previous counters: its first observation
+	// is only a baseline
+	for name := range lastIOCounters.observed {
+		if _, exists := curCounters[name]; !exists {
+			delete(lastIOCounters.observed, name)
+			delete(lastIOCounters.availableRead, name)
+			delete(lastIOCounters.availableWrite, name)
+		}
+	}
+	for name := range curCounters {
+		lastIOCounters.observed[name]++
+	}
+
+	result := make([]ioSample, 0)
+
+	for deviceName, curCounter := range curCounters {
+		device, exists := lsblk[deviceName]
+		if !exists {
+			continue
+		}
+
+		major, minor, err := parseMajMin(device.MajMin)
+		if err != nil {
+			if !lastIOCounters.warned[deviceName] {
+				lastIOCounters.warned[deviceName] = true
+				softFail("%s, its IO won't be throttled", err)
+			}
+			continue
+		}
+
+		lastCounter := lastCounters[deviceName]
+		curCgRead, curCgWrite := diskCgCounters(curCgCounters, device)
+		lastCgRead, lastCgWrite := diskCgCounters(lastCgCounters, device)
+		if systemAccounting {
+			curCgRead, curCgWrite = curCounter.ReadBytes, curCounter.WriteBytes
+			lastCgRead, lastCgWrite = lastCounter.ReadBytes, lastCounter.WriteBytes
+		}
+
+		benchmark, benchmarked := getBenchmark(deviceName)
+		if !benchmarked && cfg.benchmarkAsync {
+			// Not benchmarked yet
+			continue
+		}
+		if !benchmark.trusted() || benchmark.stale() {
+			if !lastIOCounters.warned[deviceName] {
+				lastIOCounters.warned[deviceName] = true
+				if !benchmark.trusted() {
+					softFail("benchmark of %s is %s, its IO won't be throttled", deviceName, benchmark.source)
+				} else {
+					softFail("benchmark of %s is stale (measured %s)", deviceName, benchmark.measuredAt.Format(time.RFC3339))
+				}
+			}
+			if !benchmark.trusted() {
+				continue
+			}
+		}
+
+		if lastIOCounters.observed[deviceName] >= 2 {
+			maxBytesRead := float64(benchmark.read)
+			writeCap, writeTested := benchmark.writeCap()
+			maxBytesWrite := float64(writeCap)
+
+			var latency float64
+			ops := clampedDelta(curCounter.ReadCount+curCounter.WriteCount, lastCounter.ReadCount+lastCounter.WriteCount)
+			if ops > 0 {
+				latency = float64(clampedDelta(curCounter.ReadTime+curCounter.WriteTime, lastCounter.ReadTime+lastCounter.WriteTime)) / float64(ops)
+			}
+
+			availableRead := lastIOCounters.availableRead[deviceName]
+			availableWrite := lastIOCounters.availableWrite[deviceName]
+			result = append(result, ioSample{
+				major:          major,
+				minor:          minor,
+				cgRead:         float64(clampedDelta(curCgRead, lastCgRead)) / elapsed,
+				maxRead:        maxBytesRead,
+				availableRead:  availableRead.update(math.Max(0, maxBytesRead-float64(clampedDelta(curCounter.ReadBytes, lastCounter.ReadBytes))/elapsed), cfg.smoothing),
+				cgWrite:        float64(clampedDelta(curCgWrite, lastCgWrite)) / elapsed,
+				maxWrite:       maxBytesWrite,
+				availableWrite: availableWrite.update(math.Max(0, maxBytesWrite-float64(clampedDelta(curCounter.WriteBytes, lastCounter.WriteBytes))/elapsed), cfg.smoothing),
+				readTested:     benchmark.readTool != "",
+				writeTested:    writeTested,
+				latency:        latency,
+				saturated:      cfg.ioLatencyThreshold > 0 && latency > float64(cfg.ioLatencyThreshold)/float64(time.Millisecond),
+			})
+			lastIOCounters.availableRead[deviceName] = availableRead
+			lastIOCounters.availableWrite[deviceName] = availableWrite
+		}
+	}
+
+	return result, nil
+}
+
+// The reserve is expressed in bytes per second, for both read and write
+// Samples are per disk (see diskCgCounters), so the partitions of a disk share a single budget
+// The margin is a fraction of the max throughput of the device, or with marginOfAvailable,
+// of its idle throughput, so that an idle device is almost entirely granted
+func getMaxIO(samples []ioSample, margin, reserve, gain float64, marginOfAvailable bool) []cgroup2.Entry {
+	result := make([]cgroup2.Entry, 0)
+
+	for _, s := range samples {
+		readBase, writeBase := s.maxRead, s.maxWrite
+		if marginOfAvailable {
+			readBase, writeBase = s.availableRead, s.availableWrite
+		}
+		// A latency spike means the device is saturated, even if the throughput suggests headroom
+		if s.saturated {
+			s.availableRead, s.availableWrite = 0, 0
+		}
+
+		// Read
+		readMargin := math.Max(readBase*margin, reserve)
+
+		readEntry := cgroup2.Entry{
+			Type:  cgroup2.ReadBPS,
+			Major: s.major,
+			Minor: s.minor,
+		}
+		// If available IO read less than margin, readjust
+		if s.availableRead < readMargin {
+			readEntry.Rate = uint64(s.cgRead - gain*(readMargin-s.availableRead))
+		} else {
+			readEntry.Rate = uint64(s.cgRead + gain*(s.availableRead-readMargin))
+		}
+		if s.readTested && readEntry.Rate > 0 {
+			result = append(result, readEntry)
+		}
+
+		// Write
+		writeMargin := math.Max(writeBase*margin, reserve)
+
+		writeEntry := cgroup2.Entry{
+			Type:  cgroup2.WriteBPS,
+			Major: s.major,
+			Minor: s.minor,
+		}
+		// If available IO write less than margin, readjust
+		if s.availableWrite < writeMargin {
+			writeEntry.Rate = uint64(s.cgWrite - gain*(writeMargin-s.availableWrite))
+		} else {
+			writeEntry.Rate = uint64(s.cgWrite + gain*(s.availableWrite-writeMargin))
+		}
+		if s.writeTested && writeEntry.Rate > 0 {
+			result = append(result, writeEntry)
+		}
+	}
+
+	return result
+}
+
+// Return whether the process has finished (ctx is cancelled), anything else is unexpected
+func monitorResources(ctx context.Context, cgManager cgroupManager) bool {
+	slog.Info("Monitoring resources usage while the process is running", "interval", cfg.interval)
+	scaler := NewScaler(cgManager, activePolicy, shadowPolicies)
+	// A restarted loop measures from scratch, the saved state is outdated by then
+	resumeOnce.Do(func() {
+		if resumedState != nil {
+			scaler.resume(resumedState)
+		}
+	})
+	if cfg.initialSamples > 1 && !scaler.appliedOnce {
+		if err := scaler.Warmup(cfg.initialSamples, cfg.initialSampleInterval); err != nil {
+			failMonitor(err)
+			return true
+		}
+	}
+	// A ticker keeps the period steady, whatever the time taken by a step
+	ticks, stop := clock.Tick(cfg.interval)
+	defer stop()
+
+	for {
+		select {
+		// Exit when the process has finished
+		case <-ctx.Done():
+			scaler.saveState(true)
+			return true
+		case <-ticks:
+			// Restarting wouldn't help, the process is stopped and the cgroup torn down
+			if err := scaler.Step(); err != nil {
+				scaler.saveState(true)
+				failMonitor(err)
+				return true
+			}
+		}
+	}
+}
+
+// Error of the monitoring loop once it has given up, the process is then stopped (or released with
+// -pid and -detach) and the cgroup torn down as when it exits
+var monitorFailed = make(chan error, 1)
+
+func failMonitor(err error) {
+	select {
+	case monitorFailed <- err:
+	default:
+	}
+}
+
+// Restart the monitoring loop if it panics or exits while the process is running, otherwise
+// the process would keep running with frozen limits without anyone noticing
+// Each restart measures new stats baselines
+func superviseMonitor(ctx context.Context, cgManager cgroupManager) {
+	for restarts := 0; ; restarts++ {
+		if runMonitor(ctx, cgManager) {
+			return
+		}
+		if restarts >= MaxMonitorRestarts {
+			failMonitor(fmt.Errorf("monitoring loop failed %d times, giving up", restarts+1))
+			return
+		}
+		log.Printf("Restarting the monitoring loop (%d/%d)\n", restarts+1, MaxMonitorRestarts)
+	}
+}
+
+func runMonitor(ctx context.Context, cgManager cgroupManager) (finished bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Monitoring loop panicked: %v\n%s", r, debug.Stack())
+			finished = false
+		}
+	}()
+	if finished = monitorResources(ctx, cgManager); !finished {
+		log.Println("Monitoring loop exited unexpectedly")
+	}
+	return finished
+}
+
+// Controllers of the scaled resources selected with -controllers, io is left disabled when there
+// is no disk to throttle (diskless, netboot or all virtual storage hosts)
+func scaledControllers() []string {
+	var controllers []string
+	for _, controller := range []string{resourceMemory, resourceCPU, resourceIO} {
+		if !cfg.unmanaged[controller] && (controller != resourceIO || len(lsblk) > 0) {
+			controllers = append(controllers, controller)
+		}
+	}
+	return controllers
+}
+
+// Enable the controllers one by one, so that the error names the ones that are unavailable
+func enableControllers(m cgroupManager, controllers []string) error {
+	var errs []error
+	for _, controller := range controllers {
+		if err := m.ToggleControllers([]string{controller}, cgroup2.Enable); err != nil {
+			errs = append(errs, controllerError(cgroupPath, controller, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Operations of process-scaler on its cgroup, implemented by *cgroup2.Manager
+// The control loop only depends on it, so that it can run against a fake cgroup
+type cgroupManager interface {
+	Stat() (*stats.Metrics, error)
+	Update(resources *cgroup2.Resources) error
+	AddProc(pid uint64) error
+	Procs(recursive bool) ([]uint64, error)
+	ToggleControllers(controllers []string, t cgroup2.ControllerToggle) error
+	Freeze() error
+	Delete() error
+	DeleteSystemd() error
+}
+
+var _ cgroupManager = (*cgroup2.Manager)(nil)
+
+// Delete the cgroup, unless it wasn't created by process-scaler
+func deleteCgroup(m cgroupManager) error {
+	if !ownsCgroup {
+		return nil
+	}
+	if systemdCgroup {
+		return m.DeleteSystemd()
+	}
+	return m.Delete()
+}
+
+// Whether systemd is the init system, see sd_booted(3)
+func systemdBooted() bool {
+	_, err := os.Stat("/run/systemd/system")
+	return err == nil
+}
+
+// Check that cgroups can be created and limited, before the benchmark and the command are started,
+// rather than failing on the first update (e.g. read-only cgroup filesystem on immutable hosts)
+func probeCgroupWritable() error {
+	probe := filepath.Join(CgroupRoot, fmt.Sprintf("process_scaler_probe_%d", os.Getpid()))
+	explain := func(action string, err error) error {
+		switch {
+		case errors.Is(err, syscall.EROFS):
+			return fmt.Errorf("cannot %s: %s is read-only", action, CgroupRoot)
+		case errors.Is(err, os.ErrPermission):
+			return fmt.Errorf("cannot %s: permission denied, run as root or use -cgroup-path with a delegated cgroup", action)
+		}
+		return fmt.Errorf("cannot %s: %w", action, err)
+	}
+
+	if err := os.Mkdir(probe, 0755); err != nil {
+		return explain("create a cgroup in "+CgroupRoot, err)
+	}
+	defer os.Remove(probe)
+
+	// Exists whatever the controllers enabled
+	limit := filepath.Join(probe, "cgroup.max.descendants")
+	if err := os.WriteFile(limit, []byte("1"), 0); err != nil {
+		return explain("write a cgroup limit", err)
+	}
+	content, err := os.ReadFile(limit)
+	if err != nil {
+		return explain("read a cgroup limit", err)
+	}
+	if strings.TrimSpace(string(content)) != "1" {
+		return fmt.Errorf("cgroup limit written as 1 but read back as %q", strings.TrimSpace(string(content)))
+	}
+	return nil
+}
+
+// Create a cgroup and put the processes in it
+func createCgroup(pids []int) cgroupManager {
+	res := cgroup2.Resources{}
+
+	// Create a new cgroup
+	cgName := fmt.Sprintf("process_scaler_%d.slice", pids[0])
+	var m *cgroup2.Manager
+	var err error
+	if systemdBooted() {
+		if m, err = cgroup2.NewSystemd("/", cgName, -1, &res); err == nil {
+			systemdCgroup = true
+		} else {
+			log.Printf("Warning: could not create the cgroup through systemd, creating it directly: %s\n", err)
+		}
+	}
+	// Without systemd (OpenRC, runit, minimal containers), the unified hierarchy is managed directly
+	if !systemdCgroup {
+		if m, err = cgroup2.NewManager(CgroupRoot, "/"+cgName, &res); err != nil {
+			fatal(err)
+		}
+	}
+	cgroupPath = filepath.Join(CgroupRoot, cgName)
+	ownsCgroup = true
+
+	// Enable the relevant controllers, a dry run only needs their stats
+	controllers := append(scaledControllers(), cfg.static.controllers()...)
+	if err = enableControllers(m, controllers); err != nil && cfg.dryRun {
+		log.Printf("Warning: %s, the corresponding resources may not be measured\n", err)
+	} else if err != nil {
+		_ = deleteCgroup(m)
+		fatal(err)
+	}
+	if cfg.dryRun {
+		addProcs(m, pids)
+		return m
+	}
+	if err = cfg.static.apply(m, cgroupPath); err != nil {
+		_ = deleteCgroup(m)
+		fatal(err)
+	}
+
+	applyInitialLimits(m)
+	addProcs(m, pids)
+	return m
+}
+
+// Conservative limits applied before the process joins the cgroup, so that it is never unbounded
+// until the first monitoring tick: a fraction of the headroom (available resources minus margin)
+func applyInitialLimits(m cgroupManager) {
+	if cfg.initialFraction <= 0 {
+		return
+	}
+
+	v, err := system.VirtualMemory()
+	if err != nil {
+		fatal(err)
+	}
+	last, err := systemCPUTimes(cpuAffinity)
+	if err != nil {
+		fatal(err)
+	}
+	clock.Sleep(100 * time.Millisecond)
+	cur, err := systemCPUTimes(cpuAffinity)
+	if err != nil || len(last) == 0 || len(cur) == 0 {
+		fatal("Error: could not get CPU times")
+	}
+	curAll, curBusy := getAllBusy(cur[0])
+	lastAll, lastBusy := getAllBusy(last[0])
+	idle := 1.0
+	if curAll > lastAll {
+		idle = math.Max(0, 1-(curBusy-lastBusy)/(curAll-lastAll))
+	}
+	numCores := runtime.NumCPU()
+	if cpuAffinity != nil {
+		numCores = len(cpuAffinity)
+	}
+
+	// Samples of a process that doesn't use anything yet
+	snapshot := Snapshot{
+		Memory: memorySample{
+			available: float64(v.Available),
+			total:     float64(v.Total),
+		},
+		CPU: cpuSample{
+			total:     1e6,
+			available: 1e6 * idle,
+			idleCores: -1,
+			numCores:  numCores,
+		},
+		Margins: cfg.margins,
+		Reserve: cfg.reserve,
+
+		IOMarginOfAvailable: cfg.ioMarginBase == "available",
+		Skipped:             make(map[string]bool),
+	}
+	for resource := range cfg.unmanaged {
+		snapshot.Skipped[resource] = true
+	}
+	for kname := range lsblk {
+		// The control loop never writes io.max with -io-mode latency, or for the disks throttled
+		// through io.bfq.weight: bandwidth limits applied now would stay for the whole run
+		if cfg.ioMode == "latency" {
+			break
+		}
+		scheduler, err := ioScheduler(kname)
+		if err != nil {
+			scheduler = "unknown"
+		}
+		if weightedDisk(cfg.ioStrategy, scheduler) {
+			continue
+		}
+		benchmark, _ := getBenchmark(kname)
+		major, minor, err := parseMajMin(lsblk[kname].MajMin)
+		if err != nil || !benchmark.trusted() {
+			continue
+		}
+		writeCap, writeTested := benchmark.writeCap()
+		snapshot.IO = append(snapshot.IO, ioSample{
+			major:          major,
+			minor:          minor,
+			maxRead:        float64(benchmark.read),
+			availableRead:  float64(benchmark.read),
+			maxWrite:       float64(writeCap),
+			availableWrite: float64(writeCap),
+			readTested:     benchmark.readTool != "",
+			writeTested:    writeTested,
+		})
+	}
+
+	limits := decideLimits(snapshot, cfg.initialFraction)
+	// Without headroom, nothing sensible can be applied until the first tick
+	if limits.MemoryMax <= 0 {
+		limits.Skipped[resourceMemory] = true
+	}
+	if limits.CPUQuota <= 0 {
+		limits.Skipped[resourceCPU] = true
+	}
+	limits = limits.atLeastBaseline()
+	cfg.floors.apply(&limits, numCores)
+	if cfg.softMemory {
+		limits.soften(cfg.ceilings)
+	}
+	applyCPUMode(&limits)
+
+	res := limits.resources()
+	if err = m.Update(&res); err != nil {
+		_ = deleteCgroup(m)
+		fatal(newCgroupUpdateError(err))
+	}
+	slog.Info("Initial limits applied", limitAttrs(limits)...)
+}
+
+// Use an existing cgroup (e.g. delegated by an orchestrator) instead of creating one
+// It is never deleted by process-scaler
+func attachCgroup(path string, pids []int) cgroupManager {
+	// Accept both /sys/fs/cgroup/my.slice/task and /my.slice/task
+	group := strings.TrimPrefix(filepath.Clean("/"+path), CgroupRoot)
+	m, err := cgroup2.Load(group)
+	if err != nil {
+		fatal(err)
+	}
+	cgroupPath = filepath.Join(CgroupRoot, group)
+	ownsCgroup = false
+
+	if _, err = os.Stat(filepath.Join(cgroupPath, "cgroup.procs")); err != nil {
+		fatalf("%s is not a cgroup: %s", cgroupPath, err)
+	}
+
+	// The controllers should already be delegated, try to enable them anyway
+	controllers := append(scaledControllers(), cfg.static.controllers()...)
+	if err = enableControllers(m, controllers); err != nil {
+		softFailError(err, "the corresponding resources may not be limited")
+	}
+	if !cfg.dryRun {
+		if err = cfg.static.apply(m, cgroupPath); err != nil {
+			fatal(err)
+		}
+		applyInitialLimits(m)
+	}
+
+	// Processes started from inside the cgroup are already there
+	var outside []int
+	for _, pid := range pids {
+		if !inCgroup(m, pid) {
+			outside = append(outside, pid)
+		}
+	}
+	if len(outside) > 0 {
+		addProcs(m, outside)
+	}
+	slog.Info("Attached to cgroup", "cgroup", cgroupPath)
+	return m
+}
+
+func inCgroup(m cgroupManager, pid int) bool {
+	procs, err := m.Procs(false)
+	if err != nil {
+		_ = deleteCgroup(m)
+		fatal(err)
+	}
+	for _, p := range procs {
+		if p == uint64(pid) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the processes to the cgroup, those that exit in the meantime are skipped
+func addProcs(m cgroupManager, pids []int) {
+	added := 0
+	for _, pid := range pids {
+		if err := m.AddProc(uint64(pid)); err != nil {
+			if !processAlive(pid) {
+				log.Printf("Warning: process %d exited before it could be added to the cgroup\n", pid)
+				continue
+			}
+			_ = deleteCgroup(m)
+			fatal(err)
+		}
+
+		// Make sure the process is really in the cgroup, otherwise nothing would be limited
+		if !inCgroup(m, pid) {
+			if !processAlive(pid) {
+				log.Printf("Warning: process %d exited during cgroup setup\n", pid)
+				continue
+			}
+			_ = deleteCgroup(m)
+			fatalf("Process %d is not in cgroup %s after being added", pid, cgroupPath)
+		}
+		added++
+	}
+
+	if added == 0 {
+		_ = deleteCgroup(m)
+		if len(cfg.pids) > 0 {
+			exitExitedDuringSetup()
+		}
+		fatal("All processes exited before they could be added to the cgroup")
+	}
+}
+
+// Check that a process exists and is not a zombie
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// Format: pid (comm) state ...
+	// comm can contain spaces and parentheses, so look for the last ')'
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 || i+2 >= len(stat) {
+		return false
+	}
+	return stat[i+2] != 'Z' && stat[i+2] != 'X'
+}
+
+// Signals that can be used to toggle the paused state
+var pauseSignals = map[string]syscall.Signal{
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGHUP":  syscall.SIGHUP,
+}
+
+func setPaused(paused bool, source string) {
+	state.Lock()
+	changed := state.paused != paused
+	state.paused = paused
+	state.Unlock()
+
+	if !changed {
+		return
+	}
+	if paused {
+		log.Printf("Scaling paused (%s), current limits are kept\n", source)
+	} else {
+		log.Printf("Scaling resumed (%s)\n", source)
+	}
+}
+
+func setResourcePaused(resource string, paused bool, source string) error {
+	if resource != resourceMemory && resource != resourceCPU && resource != resourceIO && resource != resourceGPU {
+		return fmt.Errorf("unknown resource %q, expected %s, %s, %s or %s", resource, resourceMemory, resourceCPU, resourceIO, resourceGPU)
+	}
+
+	state.Lock()
+	changed := state.pausedResources[resource] != paused
+	state.pausedResources[resource] = paused
+	state.Unlock()
+
+	if !changed {
+		return nil
+	}
+	if paused {
+		log.Printf("Scaling of %s paused (%s), its current limits are kept\n", resource, source)
+	} else {
+		log.Printf("Scaling of %s resumed (%s)\n", resource, source)
+	}
+	return nil
+}
+
+// Toggle the paused state each time sig is received
+func handlePauseSignal(sig syscall.Signal) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+
+	go func() {
+		for range signals {
+			state.Lock()
+			paused := state.paused
+			state.Unlock()
+			setPaused(!paused, sig.String())
+		}
+	}()
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage:
+  %[1]s [options] <command> <args>
+        run a command and scale its resources
+  %[1]s [options] -pid <pid>[,<pid>...]
+        scale the resources of already running processes, as a group
+  %[1]s benchmark [-output <path>]
+        only benchmark IO and write the cache used by later runs
+  %[1]s version
+        print the version
+  %[1]s [options] -- <command> <args>
+        run a command named like a subcommand
+
+Examples:
+  sudo %[1]s ./miner --threads 8
+  sudo %[1]s -reserve-memory 2G -reserve-cpu 2 ./batch-job
+  sudo %[1]s -policy target -shadow-policies greedy -control-socket /run/process-scaler.sock ./server
+
+Options:
+`, filepath.Base(os.Args[0]))
+	flag.PrintDefaults()
+}
+
+func parseFlags() {
+	flag.Usage = usage
+	printVersion := flag.Bool("version", false, "print the version and exit")
+	flag.BoolVar(&cfg.strict, "strict", false, "exit on failures that are otherwise worked around (failed benchmarks, missing stats...), instead of throttling less")
+	systemdUnit := flag.String("systemd-unit", "", "read options from the X-ProcessScaler-<option> keys of this systemd unit, or auto for the unit of -pid")
+	flag.Var(&cfg.pids, "pid", "manage these already running processes instead of running a command, comma-separated (can be repeated)")
+	flag.StringVar(&cfg.metricsAddr, "metrics-addr", "", "address of an HTTP server serving Prometheus metrics on /metrics (e.g. localhost:9100)")
+	flag.StringVar(&cfg.controlAddr, "control-addr", "", "address of an HTTP server serving the control API, to read the state and change the margins (e.g. localhost:9091)")
+	flag.StringVar(&cfg.httpListen, "http-listen", "", "address of an HTTP server serving the decision history (e.g. localhost:9090)")
+	flag.StringVar(&cfg.remoteWriteURL, "remote-write-url", "", "push the usage, limits and benchmarks to this Prometheus remote-write endpoint (e.g. http://prometheus:9090/api/v1/write)")
+	flag.DurationVar(&cfg.remoteWriteInterval, "remote-write-interval", 15*time.Second, "interval between the pushes of -remote-write-url, the last push is on exit")
+	flag.IntVar(&cfg.historySize, "history-size", 600, "number of decisions (one per tick) kept for the HTTP history")
+	flag.StringVar(&cfg.controlSocket, "control-socket", "", "path of a Unix socket serving JSON-RPC control requests (e.g. /run/process-scaler.sock)")
+	flag.StringVar(&cfg.pauseSignal, "pause-on-signal", "", "signal toggling pause/resume of scaling: SIGUSR1, SIGUSR2 or SIGHUP")
+	cpuset := flag.String("cpuset", "", "confine the processes to these CPUs, e.g. 0-3,8, the CPU limit is then a share of them")
+	flag.StringVar(&cfg.cpuAffinity, "cpu-affinity", "", "compute CPU headroom over these CPUs only, e.g. 0-3, or auto for the affinity of the process")
+	flag.BoolVar(&cfg.perCoreCPU, "per-core-cpu", false, "compute CPU headroom from fully idle cores only")
+	flag.StringVar(&cfg.policy, "policy", "greedy", "scaling policy applied to the cgroup: "+policyNames()+", or several of them separated by commas to apply the tightest limits")
+	flag.StringVar(&cfg.shadowPolicies, "shadow-policies", "", "comma-separated policies evaluated each tick and logged, but not applied")
+	flag.Float64Var(&cfg.reserve.cpu, "reserve-cpu", 0, "cores always left to the rest of the system")
+	flag.Var(&cfg.reserve.memory, "reserve-memory", "memory always left to the rest of the system, in bytes (suffixes like 2G or 512Mi are accepted)")
+	flag.Var(&cfg.floors.cpu, "min-cpu", "lowest CPU limit of the process, in cores (e.g. 0.5) or in microseconds of quota per 100ms period (e.g. 20000us)")
+	flag.Var(&cfg.floors.memory, "min-memory", "lowest memory limit of the process, in bytes (suffixes like 2G or 512Mi are accepted)")
+	flag.Float64Var(&cfg.reserveMemoryPercent, "reserve-memory-percent", 0, "memory always left to the rest of the system, in percent of the memory of the machine (or of the parent cgroup)")
+	flag.Float64Var(&cfg.maxCPUPercent, "max-cpu-percent", 0, "ceiling of the CPU of the process, in percent of the cores of the machine (or of the parent cgroup)")
+	flag.Float64Var(&cfg.maxMemoryPercent, "max-memory-percent", 0, "ceiling of the memory of the process, in percent of the memory of the machine (or of the parent cgroup)")
+	flag.Var(&cfg.reserve.ioBPS, "reserve-io-bps", "IO throughput always left to the rest of the system on each device, in bytes per second")
+	flag.StringVar(&cfg.benchmarkCache, "benchmark-cache", DefaultBenchmarkCache, "JSON file caching IO benchmark results across runs, empty to disable")
+	flag.DurationVar(&cfg.benchmarkCacheTTL, "benchmark-cache-ttl", 0, "benchmark again the devices whose cached benchmark is older than this duration (0 to never expire)")
+	flag.DurationVar(&cfg.benchmarkWaitIdle, "benchmark-wait-idle", 0, "wait up to this duration for each device to be idle before benchmarking it")
+	flag.DurationVar(&cfg.benchmarkBudget, "benchmark-budget", 0, "stop benchmarking devices after this duration, the remaining ones are not throttled")
+	flag.IntVar(&cfg.benchmarkParallel, "benchmark-parallel", DefaultBenchmarkParallel, "number of disks benchmarked at the same time")
+	flag.IntVar(&cfg.sharedStatsFD, "shared-stats-fd", -1, "read the system stats sampled by the daemon from this file descriptor (set by the daemon for its jobs)")
+	flag.BoolVar(&cfg.benchmarkAsync, "benchmark-async", false, "start the process immediately and benchmark IO in the background, each device is throttled once benchmarked")
+	flag.BoolVar(&cfg.writeCapFromRead, "write-cap-from-read", false, "throttle the writes of devices that were not write benchmarked, using their read max as an approximate write max")
+	flag.BoolVar(&cfg.benchmarkExcludeCritical, "benchmark-exclude-critical", true, "never write benchmark the devices backing /, /boot and /boot/efi")
+	flag.BoolVar(&cfg.detach, "detach", false, "on SIGINT or SIGTERM, exit and leave the command running without limits instead of stopping it")
+	flag.BoolVar(&cfg.dryRun, "dry-run", false, "compute and log the limits each tick without applying them")
+	flag.BoolVar(&cfg.skipIOBenchmark, "skip-io-benchmark", false, "don't benchmark the disks nor manage the IO, e.g. in containers without hdparm or sudo")
+	controllers := flag.String("controllers", "memory,cpu,io", "resources managed, as a comma-separated subset of memory, cpu and io")
+	flag.Var(&cfg.static.hugetlb2MB, "hugetlb-2MB-max", "static limit of 2MB hugepages usage, in bytes")
+	flag.Var(&cfg.static.hugetlb1GB, "hugetlb-1GB-max", "static limit of 1GB hugepages usage, in bytes")
+	flag.Var(&cfg.static.misc, "misc-max", "static limit of a misc controller resource, as key=value (can be repeated)")
+	schedulePath := flag.String("schedule", "", "JSON file of time windows overriding the margin and ceilings")
+	flag.StringVar(&cfg.memoryPolicy, "memory-policy", "available", "how the memory is limited: available (from available memory) or psi (also drive memory.high from the memory pressure)")
+	flag.Float64Var(&cfg.psiMemoryTarget, "psi-memory-target", 5, "with -memory-policy psi, max memory pressure (some avg10, in percent) of the process")
+	flag.BoolVar(&cfg.softMemory, "soft-memory", false, "set memory.high at the decided memory limit, so that the kernel reclaims instead of OOM killing, and memory.max 10% above it")
+	flag.BoolVar(&cfg.gpu, "gpu", false, "also scale the share of the NVIDIA GPUs granted to the process, through MPS (no-op without nvidia-smi)")
+	flag.StringVar(&cfg.capacityEndpoint, "capacity-endpoint", "", "URL polled each tick for the capacity the process is allowed to use, bounding the limits (e.g. http://localhost:8080/capacity)")
+	flag.StringVar(&cfg.ioMarginBase, "io-margin-base", "total", "what the IO margin is a fraction of: total (max throughput of the device) or available (its idle throughput)")
+	flag.StringVar(&cfg.ioMode, "io-mode", "bps", "how the IO is managed: bps (limit the throughput) or latency (protect the process with io.latency targets)")
+	flag.StringVar(&cfg.ioAccounting, "io-accounting-source", "auto", "IO of the process: cgroup (io.stat), system (all the IO of each disk, conservative), or auto (cgroup, system when io.stat is unavailable)")
+	flag.StringVar(&cfg.ioStrategy, "io-strategy", "auto", "with -io-mode bps, how the IO is throttled on each disk: auto (weight for the disks using the bfq scheduler, bps for the others), bps or weight")
+	flag.DurationVar(&cfg.ioLatencyThreshold, "io-latency-threshold", 0, "with -io-mode bps, tighten the IO limits of a disk whose average IO latency exceeds this duration, whatever its throughput (0 to disable)")
+	flag.DurationVar(&cfg.ioLatencyTarget, "io-latency-target", 0, "with -io-mode latency, static io.latency target of each disk, adaptive to the measured latency if not set")
+	flag.Float64Var(&cfg.cpuBudget, "cpu-budget", 0, "total CPU the process may use, in core-hours (0 for no budget)")
+	flag.Var(&cfg.ioBudget, "io-budget", "total IO the process may read and write, in bytes (e.g. 1Ti, 0 for no budget)")
+	flag.StringVar(&cfg.budgetState, "budget-state", "", "file where the consumed budget is saved, and resumed from on the next run")
+	flag.StringVar(&cfg.budgetAction, "budget-exhausted-action", "terminate", "when a budget is exhausted: terminate (stop signal) or pause (freeze the cgroup)")
+	flag.StringVar(&cfg.stateFile, "state-file", "", "file where the runtime state (last limits, benchmarks, budget consumption, averages) is saved, and resumed from on the next run")
+	flag.StringVar(&cfg.cpuMode, "cpu-mode", "quota", "how the CPU is limited: quota (cpu.max, a hard limit) or weight (cpu.weight, a share under contention, the idle CPU stays usable, and -max-cpu and the capacity only bound the share, they are no longer hard limits)")
+	flag.Float64Var(&cfg.cpuBurst, "cpu-burst", 0, "set cpu.max.burst to this fraction of the idle CPU headroom, in (0, 1], so that the process can briefly exceed its quota during spikes (0 to disable)")
+	flag.Float64Var(&cfg.idleCPUThreshold, "idle-cpu-threshold", 0, "hold the limits while the process uses less than this CPU, in cores, and less IO than -idle-io-threshold (0 to always scale)")
+	cfg.idleIOThreshold = 64 << 10
+	flag.Var(&cfg.idleIOThreshold, "idle-io-threshold", "IO throughput of the process on each device below which it is idle, in bytes per second (default 64Ki)")
+	flag.Float64Var(&cfg.smoothing, "smoothing", 0.3, "weight of the past in the moving average of the available CPU and IO, in [0, 1), so that bursts don't make the limits oscillate (0 to decide from the last interval only)")
+	flag.Float64Var(&cfg.loadAverageWeight, "load-average-weight", 0, "weight of the 1-minute load average in the idle CPU, in [0, 1], so that sustained load tightens the CPU grant even when the system looks idle")
+	flag.Float64Var(&cfg.cacheReclaimFactor, "cache-reclaim-factor", 0, "fraction of the page cache considered not available for the process, as reclaiming it hurts performance, in [0, 1]")
+	flag.BoolVar(&cfg.aggressiveReclaim, "aggressive-reclaim", false, "proactively reclaim memory through memory.reclaim when the memory limit is lowered")
+	flag.StringVar(&cfg.cgroupPath, "cgroup-path", "", "manage this existing cgroup (e.g. /sys/fs/cgroup/my.slice/task) instead of creating one")
+	flag.Float64Var(&cfg.initialFraction, "initial-fraction", 0, "apply limits of this fraction of the headroom as soon as the cgroup is created, until the first monitoring tick (e.g. 0.5)")
+	flag.IntVar(&cfg.initialSamples, "initial-samples", 1, "average this number of measurements before the first adjustment, to reduce the influence of startup noise")
+	flag.Float64Var(&cfg.margins.CPU, "cpu-margin", DefaultMargin, "fraction of the CPU left to the rest of the system, in (0, 1)")
+	flag.Float64Var(&cfg.margins.Memory, "mem-margin", DefaultMargin, "fraction of the memory left to the rest of the system, in (0, 1)")
+	flag.Float64Var(&cfg.margins.IO, "io-margin", DefaultMargin, "fraction of the IO throughput of each disk left to the rest of the system, in (0, 1)")
+	flag.Float64Var(&cfg.margins.GPU, "gpu-margin", DefaultMargin, "with -gpu, fraction of the compute and of the memory of each GPU left to the other processes, in (0, 1)")
+	flag.DurationVar(&cfg.interval, "interval", time.Second, "interval between the readjustments of the limits, at least 100ms")
+	flag.DurationVar(&cfg.initialSampleInterval, "initial-sample-interval", time.Second, "interval between the measurements of -initial-samples")
+	flag.Var(&cfg.labels, "label", "metadata attached to logs and status, as key=value (can be repeated)")
+	flag.BoolVar(&cfg.detectLabels, "detect-labels", true, "detect container ID and Kubernetes pod metadata (POD_NAME, POD_NAMESPACE, NODE_NAME, CONTAINER_NAME) as labels")
+	stopSignal := flag.String("stop-signal", "SIGTERM", "signal sent to the process group of the command to stop it")
+	flag.DurationVar(&cfg.stopGrace, "stop-grace", 10*time.Second, "time given to the command to stop before it is killed")
+	flag.StringVar(&cfg.onExitCommand, "on-exit-command", "", "shell command run after the process exited and the cgroup was deleted, with the exit info in PROCESS_SCALER_* environment variables")
+	flag.DurationVar(&cfg.onExitTimeout, "on-exit-timeout", 30*time.Second, "timeout of -on-exit-command")
+	flag.StringVar(&cfg.exitInfoFile, "exit-info-file", "", "write why process-scaler exited to this file, as JSON")
+	flag.StringVar(&cfg.logFile, "log-file", "", "write logs to this file instead of stderr")
+	cfg.logMaxSize = 10 << 20
+	flag.Var(&cfg.logMaxSize, "log-max-size", "size at which the log file is rotated, in bytes (default 10Mi)")
+	flag.IntVar(&cfg.logMaxFiles, "log-max-files", 5, "number of rotated log files kept")
+	flag.StringVar(&cfg.logFormat, "log-format", LogFormatText, "format of the logs: text or json")
+	flag.TextVar(&cfg.logLevel, "log-level", slog.LevelInfo, "lowest level logged: debug, info, warn or error")
+	configPath := flag.String("config", "", "YAML file of settings, overridden by the flags given on the command line")
+	flag.Parse()
+
+	if *printVersion {
+		fmt.Println(versionInfo())
+		os.Exit(0)
+	}
+	if *systemdUnit != "" {
+		var pid int
+		if len(cfg.pids) > 0 {
+			pid = cfg.pids[0]
+		}
+		options, err := unitOptions(*systemdUnit, pid)
+		if err == nil {
+			err = applyOptions(options, unitOptionOrigin)
+		}
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if *configPath != "" {
+		config, err := loadConfig(*configPath)
+		if err == nil {
+			err = applyOptions(config.flags(), func(name string) string {
+				return fmt.Sprintf("%s in %s", name, *configPath)
+			})
+		}
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if flag.NArg() < 1 && len(cfg.pids) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if flag.NArg() > 0 && len(cfg.pids) > 0 {
+		fatal("Either a command or -pid must be given, not both")
+	}
+	for _, pid := range cfg.pids {
+		if !processAlive(pid) {
+			fatalf("Process %d does not exist", pid)
+		}
+	}
+
+	if cfg.sharedStatsFD >= 0 {
+		useSharedStats(cfg.sharedStatsFD)
+	}
+
+	var err error
+	if activePolicy, err = parsePolicy(cfg.policy); err != nil {
+		fatal(err)
+	}
+	if cfg.shadowPolicies != "" {
+		for _, name := range strings.Split(cfg.shadowPolicies, ",") {
+			shadow, ok := policies[strings.TrimSpace(name)]
+			if !ok {
+				fatalf("Unknown shadow policy %q, expected one of: %s", name, policyNames())
+			}
+			shadowPolicies = append(shadowPolicies, shadow)
+		}
+	}
+	for name, margin := range map[string]float64{"cpu": cfg.margins.CPU, "mem": cfg.margins.Memory, "io": cfg.margins.IO, "gpu": cfg.margins.GPU} {
+		if !validMargin(margin) {
+			fatalf("-%s-margin must be in (0, 1)", name)
+		}
+	}
+	if cfg.interval < MinInterval {
+		fatalf("-interval must be at least %s", MinInterval)
+	}
+	if cfg.initialSamples < 1 || cfg.initialSampleInterval <= 0 {
+		fatal("-initial-samples and -initial-sample-interval must be positive")
+	}
+	if cfg.initialFraction < 0 || cfg.initialFraction > 1 {
+		fatal("-initial-fraction must be in [0, 1]")
+	}
+	if cfg.detectLabels {
+		cfg.labels.detect()
+	}
+	if cfg.cpuAffinity != "" && cfg.cpuAffinity != "auto" {
+		if cpuAffinity, err = parseCPUSet(cfg.cpuAffinity); err != nil {
+			fatal(err)
+		}
+	}
+	if *cpuset != "" {
+		if cfg.static.cpuset, err = parseCPUSet(*cpuset); err != nil {
+			fatal(err)
+		}
+		online, err := onlineCPUs()
+		if err != nil {
+			fatalf("Could not read the online CPUs: %s", err)
+		}
+		if missing := cfg.static.cpuset.offline(online); len(missing) > 0 {
+			fatalf("-cpuset %s: CPUs %s are not online (online: %s)", *cpuset, missing, online)
+		}
+		// The quota is scaled over the cores of the cpuset, unless the headroom is computed over others
+		if cfg.cpuAffinity == "" {
+			cpuAffinity = cfg.static.cpuset
+		}
+	}
+
+	if cfg.stopSignal, err = parseSignal(*stopSignal); err != nil {
+		fatal(err)
+	}
+	if cfg.memoryPolicy != "available" && cfg.memoryPolicy != "psi" {
+		fatalf("Unknown memory policy %q, expected available or psi", cfg.memoryPolicy)
+	}
+	if cfg.softMemory && cfg.memoryPolicy == "psi" {
+		fatal("-soft-memory can't be combined with -memory-policy psi, which drives memory.high itself")
+	}
+	if cfg.ioMode != "bps" && cfg.ioMode != "latency" {
+		fatalf("Unknown IO mode %q, expected bps or latency", cfg.ioMode)
+	}
+	if cfg.ioAccounting != "auto" && cfg.ioAccounting != "cgroup" && cfg.ioAccounting != "system" {
+		fatalf("Unknown IO accounting source %q, expected auto, cgroup or system", cfg.ioAccounting)
+	}
+	if cfg.ioStrategy != "auto" && cfg.ioStrategy != "bps" && cfg.ioStrategy != "weight" {
+		fatalf("Unknown IO strategy %q, expected auto, bps or weight", cfg.ioStrategy)
+	}
+	if cfg.ioMarginBase != "total" && cfg.ioMarginBase != "available" {
+		fatalf("Unknown IO margin base %q, expected total or available", cfg.ioMarginBase)
+	}
+	if cfg.ioLatencyThreshold < 0 {
+		fatal("-io-latency-threshold must not be negative")
+	}
+	if cfg.ioLatencyTarget < 0 {
+		fatal("-io-latency-target must be positive")
+	}
+	if cfg.cpuBudget < 0 {
+		fatal("-cpu-budget must not be negative")
+	}
+	if cfg.budgetAction != "terminate" && cfg.budgetAction != "pause" {
+		fatalf("Unknown budget exhausted action %q, expected terminate or pause", cfg.budgetAction)
+	}
+	if cfg.stateFile != "" {
+		if resumedState, err = loadState(cfg.stateFile); err != nil {
+			fatal(err)
+		}
+	}
+	if cfg.cpuBudget > 0 || cfg.ioBudget > 0 {
+		if resourceBudget, err = newBudget(cfg.cpuBudget, uint64(cfg.ioBudget), cfg.budgetState); err != nil {
+			fatal(err)
+		}
+		// -budget-state has precedence, it may be shared by several runs
+		if cfg.budgetState == "" && resumedState != nil && resumedState.Budget != nil {
+			resourceBudget.resume(*resumedState.Budget)
+		}
+	}
+	if cfg.cpuBurst < 0 || cfg.cpuBurst > 1 {
+		fatal("-cpu-burst must be in [0, 1]")
+	}
+	if cfg.cpuMode != "quota" && cfg.cpuMode != "weight" {
+		fatalf("Unknown CPU mode %q, expected quota or weight", cfg.cpuMode)
+	}
+	if cfg.cpuMode == "weight" && cfg.cpuBurst > 0 {
+		fatal("-cpu-burst requires -cpu-mode quota")
+	}
+	if cfg.idleCPUThreshold < 0 {
+		fatal("-idle-cpu-threshold must not be negative")
+	}
+	if cfg.smoothing < 0 || cfg.smoothing >= 1 {
+		fatal("-smoothing must be in [0, 1)")
+	}
+	if cfg.loadAverageWeight < 0 || cfg.loadAverageWeight > 1 {
+		fatal("-load-average-weight must be in [0, 1]")
+	}
+	if cfg.cacheReclaimFactor < 0 || cfg.cacheReclaimFactor > 1 {
+		fatal("-cache-reclaim-factor must be in [0, 1]")
+	}
+	if cfg.onExitTimeout <= 0 {
+		fatal("-on-exit-timeout must be positive")
+	}
+	if cfg.remoteWriteInterval <= 0 {
+		fatal("-remote-write-interval must be positive")
+	}
+	if cfg.historySize <= 0 {
+		fatal("-history-size must be positive")
+	}
+	if cfg.psiMemoryTarget <= 0 || cfg.psiMemoryTarget >= 100 {
+		fatal("-psi-memory-target must be in (0, 100)")
+	}
+	if *schedulePath != "" {
+		if cfg.schedule, err = loadSchedule(*schedulePath); err != nil {
+			fatal(err)
+		}
+	}
+	if cfg.benchmarkParallel < 1 {
+		fatal("-benchmark-parallel must be at least 1")
+	}
+	if cfg.logMaxSize == 0 || cfg.logMaxFiles < 0 {
+		fatal("-log-max-size must be positive and -log-max-files must not be negative")
+	}
+	cfg.unmanaged = map[string]bool{resourceMemory: true, resourceCPU: true, resourceIO: true}
+	for _, controller := range strings.Split(*controllers, ",") {
+		controller = strings.TrimSpace(controller)
+		if controller != resourceMemory && controller != resourceCPU && controller != resourceIO {
+			fatalf("-controllers: unknown controller %q, expected memory, cpu or io", controller)
+		}
+		delete(cfg.unmanaged, controller)
+	}
+	if cfg.logFormat != LogFormatText && cfg.logFormat != LogFormatJSON {
+		fatalf("-log-format must be %s or %s", LogFormatText, LogFormatJSON)
+	}
+	if cfg.reserve.cpu < 0 {
+		fatal("-reserve-cpu must be positive")
+	}
+	for _, percent := range []float64{cfg.maxCPUPercent, cfg.maxMemoryPercent, cfg.reserveMemoryPercent} {
+		if percent < 0 || percent > 100 {
+			fatal("-max-cpu-percent, -max-memory-percent and -reserve-memory-percent must be in [0, 100]")
+		}
+	}
+	if cfg.pauseSignal != "" {
+		if _, ok := pauseSignals[strings.ToUpper(cfg.pauseSignal)]; !ok {
+			fatalf("Unsupported signal for -pause-on-signal: %s", cfg.pauseSignal)
+		}
+	}
+}
+
+// Resolve the limits given as percentages against the detected capacity
+func resolvePercentages() {
+	if cfg.maxCPUPercent == 0 && cfg.maxMemoryPercent == 0 && cfg.reserveMemoryPercent == 0 {
+		return
+	}
+	cores, memory, err := detectCapacity()
+	if err != nil {
+		fatal(err)
+	}
+	slog.Info("Detected capacity", "cores", cores, "memory", memory)
+
+	if cfg.maxCPUPercent > 0 {
+		maxCPU := cores * cfg.maxCPUPercent / 100
+		cfg.ceilings.CPU = &maxCPU
+		slog.Info("CPU ceiling", "cores", maxCPU)
+	}
+	if cfg.maxMemoryPercent > 0 {
+		maxMemory := int64(float64(memory) * cfg.maxMemoryPercent / 100)
+		cfg.ceilings.Memory = &maxMemory
+		slog.Info("Memory ceiling", "bytes", maxMemory)
+	}
+	// The more conservative of the absolute and relative reserves is used
+	if reserve := byteSize(float64(memory) * cfg.reserveMemoryPercent / 100); reserve > cfg.reserve.memory {
+		cfg.reserve.memory = reserve
+		slog.Info("Memory reserve", "bytes", int64(reserve))
+	}
+}
+
+// The floors must be reachable: within the capacity of the machine (or of the parent cgroup) and
+// below the ceilings
+func checkFloors() {
+	if cfg.floors.cpu == (cpuFloor{}) && cfg.floors.memory == 0 {
+		return
+	}
+	cores, memory, err := detectCapacity()
+	if err != nil {
+		fatal(err)
+	}
+	if cfg.floors.cpu.quota > 100000 {
+		fatalf("-min-cpu %s exceeds the period of 100000us", &cfg.floors.cpu)
+	}
+	if cfg.floors.cpu.cores > cores {
+		fatalf("-min-cpu %s exceeds the capacity of %.2f cores", &cfg.floors.cpu, cores)
+	}
+	if ceiling := cfg.ceilings.CPU; ceiling != nil && cfg.floors.cpu.cores > *ceiling {
+		fatalf("-min-cpu %s exceeds the CPU ceiling of %.2f cores", &cfg.floors.cpu, *ceiling)
+	}
+	if int64(cfg.floors.memory) > memory {
+		fatalf("-min-memory %d exceeds the capacity of %d bytes", cfg.floors.memory, memory)
+	}
+	if ceiling := cfg.ceilings.Memory; ceiling != nil && int64(cfg.floors.memory) > *ceiling {
+		fatalf("-min-memory %d exceeds the memory ceiling of %d bytes", cfg.floors.memory, *ceiling)
+	}
+}
+
+// Report a failure that process-scaler can work around, or exit with -strict
+func softFail(format string, args ...interface{}) {
+	if cfg.strict {
+		fatalf("Error: "+format+" (-strict)", args...)
+	}
+	log.Printf("Warning: "+format+"\n", args...)
+}
+
+// Like softFail, for the typed errors: with -strict, exit with the code of their category
+func softFailError(err error, consequence string) {
+	if cfg.strict {
+		fatal(err)
+	}
+	log.Printf("Warning: %s, %s\n", err, consequence)
+}
+
+// Exit code of a command that could not be started, following shell conventions
+func startExitCode(err error) int {
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return 127 // Command not found
+	case errors.Is(err, os.ErrPermission), errors.Is(err, syscall.ENOEXEC):
+		return 126 // Not executable
+	}
+	return 1
+}
+
+// Exit code reflecting how the command exited, like a shell: its own code, or 128+N when killed by signal N
+func childExitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	if code := state.ExitCode(); code > 0 {
+		return code
+	}
+	return 1
+}
+
+// Benchmark IO once, administratively, so that routine runs only read the cache
+func runBenchmark(args []string) {
+	flags := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	flags.StringVar(&cfg.benchmarkCache, "output", DefaultBenchmarkCache, "JSON file where the benchmark results are written")
+	flags.DurationVar(&cfg.benchmarkWaitIdle, "benchmark-wait-idle", 0, "wait up to this duration for each device to be idle before benchmarking it")
+	flags.DurationVar(&cfg.benchmarkBudget, "benchmark-budget", 0, "stop benchmarking devices after this duration, the remaining ones are not throttled")
+	flags.IntVar(&cfg.benchmarkParallel, "benchmark-parallel", DefaultBenchmarkParallel, "number of disks benchmarked at the same time")
+	flags.BoolVar(&cfg.benchmarkExcludeCritical, "benchmark-exclude-critical", true, "never write benchmark the devices backing /, /boot and /boot/efi")
+	_ = flags.Parse(args)
+
+	if cfg.benchmarkCache == "" {
+		fatal("-output must not be empty")
+	}
+	if cfg.benchmarkParallel < 1 {
+		fatal("-benchmark-parallel must be at least 1")
+	}
+	cfg.benchmarkRefresh = true
+	benchmarkIO()
+	if len(lsblk) == 0 {
+		return
+	}
+	slog.Info("Benchmark results written", "path", cfg.benchmarkCache)
+}
+
+func main() {
+	// Subcommands, "--" must be used to run a command with the same name
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "version":
+			fmt.Println(versionInfo())
+			return
+		case "benchmark":
+			runBenchmark(os.Args[2:])
+			return
+		case "cleanup":
+			runCleanup(os.Args[2:])
+			return
+		case "daemon":
+			runDaemon(os.Args[2:])
+			return
+		}
+	}
+
+	parseFlags()
+
+	var logWriter *rotatingWriter
+	if cfg.logFile != "" {
+		var err error
+		if logWriter, err = newRotatingWriter(cfg.logFile, int64(cfg.logMaxSize), cfg.logMaxFiles); err != nil {
+			fatal(err)
+		}
+		setupLogging(logWriter)
+	} else {
+		setupLogging(os.Stderr)
 	}
 	if cgroups.Mode() != cgroups.Unified {
-		log.Fatal("This program requires cgroup v2")
+		fatal(ErrNotCgroupV2)
+	}
+	// An existing cgroup may be writable even if the hierarchy isn't, and the daemon has already
+	// checked it for its jobs
+	if cfg.cgroupPath == "" && cfg.sharedStatsFD < 0 {
+		if err := probeCgroupWritable(); err != nil {
+			fatal(err)
+		}
 	}
 
+	state.margins = cfg.margins
+	state.pausedResources = make(map[string]bool)
+
+	resolvePercentages()
+	checkFloors()
+
 	benchmarkIO()
 
-	// Run external program
-	proc := exec.Command(os.Args[1], os.Args[2:]...)
-	if err := proc.Start(); err != nil {
-		log.Fatal(err)
+	var (
+		proc       *exec.Cmd
+		terminator *terminator
+		origins    map[int]string
+		pids       = []int(cfg.pids)
+	)
+	if len(pids) > 0 {
+		pids = alivePIDs(pids)
+		origins = originalCgroups(pids)
+	} else {
+		// Run external program
+		args := flag.Args()
+		proc = exec.Command(args[0], args[1:]...)
+		// Own process group, so that the whole process tree can be stopped
+		proc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if err := proc.Start(); err != nil {
+			log.Print(err)
+			exit(exitReasonStartFailed, err.Error(), startExitCode(err))
+		}
+		slog.Info("Process started", "pid", proc.Process.Pid, "command", proc.Path)
+		pids = []int{proc.Process.Pid}
+
+		terminator = newTerminator(proc)
+		terminator.handleSignals()
 	}
-	fmt.Printf("Process started with PID %d\n", proc.Process.Pid)
 
-	cgManager := createCgroup(proc)
+	// With taskset, the affinity is inherited by the command
+	if cfg.cpuAffinity == "auto" {
+		var err error
+		if cpuAffinity, err = processAffinity(pids[0]); err != nil {
+			fatal(err)
+		}
+		slog.Info("CPU headroom computed over the affinity of the process", "cpus", cpuAffinity.String())
+	}
 
-	// Channel to signal when the process has finished
-	processFinished := make(chan bool)
+	state.Lock()
+	state.pid = pids[0]
+	state.pids = append([]int(nil), pids...)
+	state.startedAt = time.Now()
+	state.Unlock()
 
-	go monitorResources(cgManager, processFinished)
+	var cgManager cgroupManager
+	if cfg.cgroupPath != "" {
+		cgManager = attachCgroup(cfg.cgroupPath, pids)
+	} else {
+		cgManager = createCgroup(pids)
+	}
+	if proc != nil {
+		adoptDescendants(cgManager, proc.Process.Pid)
+	}
 
-	// Wait for the program to finish
-	if err := proc.Wait(); err != nil {
-		log.Fatal(err)
+	if cfg.pauseSignal != "" {
+		handlePauseSignal(pauseSignals[strings.ToUpper(cfg.pauseSignal)])
 	}
 
-	fmt.Println("Process finished")
-	processFinished <- true
-	if err := cgManager.DeleteSystemd(); err != nil {
-		log.Fatal(err)
+	var control *controlServer
+	if cfg.controlSocket != "" {
+		control = startControlServer(cfg.controlSocket)
+	}
+	var httpServer *http.Server
+	if cfg.httpListen != "" {
+		decisions = newHistory(cfg.historySize)
+		httpServer = startHTTPServer(cfg.httpListen)
+	}
+	var metricsServer *http.Server
+	if cfg.metricsAddr != "" {
+		metrics = newMetricsEndpoint()
+		metricsServer = startMetricsServer(cfg.metricsAddr)
+	}
+	var controlAPIServer *http.Server
+	if cfg.controlAddr != "" {
+		controlAPIServer = startControlAPIServer(cfg.controlAddr)
+	}
+	if cfg.remoteWriteURL != "" {
+		remoteWrite = newRemoteWriter(cfg.remoteWriteURL, cfg.remoteWriteInterval)
+	}
+
+	// Cancelled when the process has finished, the teardown waits for the loop to stop
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	var monitor sync.WaitGroup
+	monitor.Add(1)
+	go func() {
+		defer monitor.Done()
+		superviseMonitor(monitorCtx, cgManager)
+	}()
+
+	reason, message, exitCode := exitReasonCompleted, "", 0
+	var monitorErr error
+	if proc != nil {
+		// Wait for the program to finish, unless process-scaler detaches from it
+		waited := make(chan error, 1)
+		go func() {
+			waited <- proc.Wait()
+		}()
+		var waitErr error
+		detached, exited := false, false
+		select {
+		case <-terminator.detached:
+			detached = true
+		case monitorErr = <-monitorFailed:
+			slog.Error("Monitoring failed, the process can't be left running without limits", "error", monitorErr)
+			detached = cfg.detach
+		case waitErr = <-waited:
+			exited = true
+		}
+		if detached {
+			if ownsCgroup {
+				detachProcesses(cgManager)
+			}
+			reason = exitReasonDetached
+			slog.Info("Detached, the process keeps running")
+		} else {
+			if !exited {
+				go terminator.stop("monitoring failed")
+				waitErr = <-waited
+			}
+			terminator.reaped()
+			recordChildExit(proc.ProcessState)
+			recordOOMKill()
+			if waitErr != nil {
+				if _, exited := waitErr.(*exec.ExitError); !exited {
+					fatal(waitErr)
+				}
+				// Exiting on the stop signal is expected when process-scaler stopped it, but its status
+				// is still the one of process-scaler, like a shell
+				if !terminator.requested() {
+					log.Print(waitErr)
+				}
+				reason, message, exitCode = exitReasonChildFailed, waitErr.Error(), childExitCode(proc.ProcessState)
+			}
+			if terminator.requested() {
+				reason = exitReasonStopped
+			}
+			slog.Info("Process finished", "exit_code", proc.ProcessState.ExitCode())
+		}
+	} else {
+		var stopped bool
+		if stopped, monitorErr = waitPIDs(pids); !stopped {
+			slog.Info("All processes finished")
+		} else if monitorErr == nil {
+			reason = exitReasonStopped
+		}
+		recordOOMKill()
+	}
+	if monitorErr != nil {
+		reason, message, exitCode = exitReasonError, monitorErr.Error(), errorExitCode(monitorErr)
+	}
+
+	if resourceBudget != nil {
+		resourceBudget.save()
+		if resourceBudget.isExhausted() {
+			reason, message, exitCode = exitReasonBudget, "budget exhausted", 1
+		}
+	}
+
+	stopMonitor()
+	monitor.Wait()
+	if control != nil {
+		control.close()
+	}
+	if httpServer != nil {
+		_ = httpServer.Close()
+	}
+	if metricsServer != nil {
+		_ = metricsServer.Close()
+	}
+	if controlAPIServer != nil {
+		_ = controlAPIServer.Close()
+	}
+	if remoteWrite != nil {
+		remoteWrite.close()
+	}
+	// The processes were not started by process-scaler, they and their children keep running without its cgroup
+	if origins != nil && ownsCgroup {
+		releaseProcesses(cgManager, origins)
+	}
+	if err := deleteCgroup(cgManager); err != nil {
+		fatal(err)
+	}
+	runOnExitCommand(reason)
+	writeExitInfo(reason, message)
+	if logWriter != nil {
+		_ = logWriter.Close()
+	}
+	if exitCode != 0 {
+		os.Exit(exitCode)
 	}
 }
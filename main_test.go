@@ -0,0 +1,846 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/containerd/cgroups/v3/cgroup2"
+	"github.com/containerd/cgroups/v3/cgroup2/stats"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Outputs of the benchmark tools, as parsed by setMaxIO
+var benchmarkOutputs = []string{
+	"\n/dev/sda:\n Timing cached reads:   20480 MB in  1.99 seconds = 10291.95 MB/sec\n Timing buffered disk reads: 1538 MB in  3.00 seconds = 512.46 MB/sec\n",
+	"\n/dev/nvme0n1:\n Timing cached reads:   35644 MB in  2.00 seconds = 17848.17 MB/sec\n Timing buffered disk reads: 6146 MB in  3.00 seconds = 2048.33 MB/sec\n",
+	"1280+0 records in\n1280+0 records out\n83886080 bytes (84 MB, 80 MiB) copied, 0.0523 s, 1.6 GB/s\n",
+	"1024+0 records in\n1024+0 records out\n1073741824 bytes (1.1 GB, 1.0 GiB) copied, 7.84 s, 137 MB/s\n",
+	"512+0 records in\n512+0 records out\n524288 bytes (524 kB, 512 KiB) copied, 0.01 s, 52.4 kB/s\n",
+}
+
+// Bytes per second, converted like setMaxIO
+func rate(value, unit float64) uint64 {
+	return uint64(value * unit)
+}
+
+func TestSetMaxIO(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		read   bool
+		ok     bool
+		want   uint64
+	}{
+		{"hdparm", benchmarkOutputs[0], true, true, rate(512.46, 1024*1024)},
+		{"dd", benchmarkOutputs[2], false, true, rate(1.6, 1024*1024*1024)},
+		{"dd kB", benchmarkOutputs[4], false, true, rate(52.4, 1024)},
+		{"empty", "", true, false, 0},
+		{"no unit", "1234", true, false, 0},
+		{"not a number", "copied, 0.05 s, fast GB/s", false, false, 0},
+		{"negative", "copied, 0.05 s, -1 GB/s", false, false, 0},
+		{"NaN", "copied, 0.05 s, NaN GB/s", false, false, 0},
+		{"overflow", "copied, 0.05 s, 1e300 TB/s", false, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var max maxIO
+			if ok := setMaxIO([]byte(test.output), &max, test.read); ok != test.ok {
+				t.Fatalf("setMaxIO returned %t, want %t", ok, test.ok)
+			}
+			got := max.write
+			if test.read {
+				got = max.read
+			}
+			if got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetMaxIOKeepsHighest(t *testing.T) {
+	max := maxIO{read: math.MaxUint64}
+	if !setMaxIO([]byte(benchmarkOutputs[0]), &max, true) {
+		t.Fatal("setMaxIO failed")
+	}
+	if max.read != math.MaxUint64 {
+		t.Errorf("a lower measure replaced the max: %d", max.read)
+	}
+}
+
+func FuzzSetMaxIO(f *testing.F) {
+	for _, output := range benchmarkOutputs {
+		f.Add([]byte(output), true)
+		f.Add([]byte(output), false)
+	}
+	f.Add([]byte("\n\n"), true)
+	f.Add([]byte("1e400 MB/s"), false)
+	f.Fuzz(func(t *testing.T, output []byte, read bool) {
+		max := maxIO{read: 1, write: 1}
+		ok := setMaxIO(output, &max, read)
+		if !ok && (max.read != 1 || max.write != 1) {
+			t.Errorf("max changed on an invalid output: %+v", max)
+		}
+		if max.read < 1 || max.write < 1 {
+			t.Errorf("max decreased: %+v", max)
+		}
+		if read && max.write != 1 || !read && max.read != 1 {
+			t.Errorf("the other direction changed: %+v", max)
+		}
+	})
+}
+
+// Outputs of lsblk -J, from util-linux 2.34 (booleans as strings) and 2.37 (booleans as booleans)
+var lsblkOutputs = []string{
+	`{"blockdevices": [
+		{"name":"sda", "kname":"sda", "maj:min":"8:0", "type":"disk", "model":"Samsung SSD 860", "serial":"S3Z9NB0K", "rota":"0",
+			"children": [
+				{"name":"sda1", "kname":"sda1", "maj:min":"8:1", "type":"part", "model":null, "serial":null, "rota":"0"},
+				{"name":"sda2", "kname":"sda2", "maj:min":"8:2", "type":"part", "model":null, "serial":null, "rota":"0"}
+			]
+		},
+		{"name":"sr0", "kname":"sr0", "maj:min":"11:0", "type":"rom", "model":"DVD-RAM", "serial":"123", "rota":"1"}
+	]}`,
+	`{"blockdevices": [
+		{"name":"loop0", "kname":"loop0", "maj:min":"7:0", "type":"loop", "model":null, "serial":null, "rota":false},
+		{"name":"nvme0n1", "kname":"nvme0n1", "maj:min":"259:0", "type":"disk", "model":"WDC PC SN730", "serial":"20207B", "rota":false,
+			"children": [
+				{"name":"nvme0n1p1", "kname":"nvme0n1p1", "maj:min":"259:1", "type":"part", "model":null, "serial":null, "rota":false,
+					"children": [
+						{"name":"vg-root", "kname":"dm-0", "maj:min":"253:0", "type":"lvm", "model":null, "serial":null, "rota":false}
+					]
+				}
+			]
+		},
+		{"name":"sdb", "kname":"sdb", "maj:min":"8:16", "type":"disk", "model":"ST2000DM008", "serial":"ZFL1", "rota":true}
+	]}`,
+}
+
+func TestParseLsblk(t *testing.T) {
+	devices, err := parseLsblk([]byte(lsblkOutputs[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("got %d disks, want 2: %v", len(devices), devices)
+	}
+	if !bool(devices["sdb"].Rota) || bool(devices["nvme0n1"].Rota) {
+		t.Errorf("wrong rota: %+v", devices)
+	}
+	if children := devices["nvme0n1"].Children; len(children) != 1 || len(children[0].Children) != 1 {
+		t.Errorf("children not kept: %+v", children)
+	}
+
+	devices, err = parseLsblk([]byte(lsblkOutputs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sda, exists := devices["sda"]; len(devices) != 1 || !exists || bool(sda.Rota) {
+		t.Errorf("got %v, want only sda, not rotational", devices)
+	}
+
+	if _, err = parseLsblk([]byte(`{"blockdevices": [{"kname":"sda", "type":"disk", "rota":"maybe"}]}`)); err == nil {
+		t.Error("invalid rota accepted")
+	}
+}
+
+func FuzzParseLsblk(f *testing.F) {
+	for _, output := range lsblkOutputs {
+		f.Add([]byte(output))
+	}
+	f.Add([]byte(`{"blockdevices": []}`))
+	f.Add([]byte(`{"blockdevices": [{"type":"disk"}]}`))
+	f.Fuzz(func(t *testing.T, output []byte) {
+		devices, err := parseLsblk(output)
+		if err != nil {
+			return
+		}
+		for kname, device := range devices {
+			if device.Type != "disk" || kname == "" || kname != device.Kname {
+				t.Errorf("unexpected device %q: %+v", kname, device)
+			}
+		}
+	})
+}
+
+func FuzzParseMajMin(f *testing.F) {
+	for _, majMin := range []string{"8:0", "259:1", "253:0", " 8 : 16 ", "8", "8:", ":0", "-1:0", "4294967296:0"} {
+		f.Add(majMin)
+	}
+	f.Fuzz(func(t *testing.T, majMin string) {
+		major, minor, err := parseMajMin(majMin)
+		if err == nil && (major < 0 || minor < 0 || major > math.MaxUint32 || minor > math.MaxUint32) {
+			t.Errorf("parseMajMin(%q) = %d, %d", majMin, major, minor)
+		}
+	})
+}
+
+func TestCountIdleCores(t *testing.T) {
+	last := []cpu.TimesStat{{CPU: "cpu0"}, {CPU: "cpu1"}, {CPU: "cpu2"}, {CPU: "cpu3"}, {CPU: "cpu4", Idle: 1}}
+	cur := []cpu.TimesStat{
+		{CPU: "cpu0", User: 1},              // Busy
+		{CPU: "cpu1", User: 0.5, Idle: 0.5}, // Partially busy
+		{CPU: "cpu2", Idle: 1},              // Idle
+		{CPU: "cpu3", System: 0.05, Idle: 0.95},
+		{CPU: "cpu4", Idle: 1}, // No time elapsed
+		{CPU: "cpu5", Idle: 1}, // Not in the last sample
+	}
+	if idle := countIdleCores(last, cur); idle != 2 {
+		t.Errorf("got %d idle cores, want 2", idle)
+	}
+}
+
+func TestPerCoreCPUQuota(t *testing.T) {
+	// 4 cores over 1s, the process uses half a core and 2.5 cores are idle, spread over the cores
+	sample := cpuSample{cg: 0.5e6, total: 4e6, available: 2.5e6, idleCores: -1, numCores: 4}
+	if quota, _ := getMaxCPU(sample, 0.1, 0, 1); quota != 65000 {
+		t.Errorf("got quota %d without -per-core-cpu, want 65000", quota)
+	}
+	// Only one of them is fully idle: the process gets what it uses plus that core
+	sample.idleCores = 1
+	if quota, _ := getMaxCPU(sample, 0.1, 0, 1); quota != 37500 {
+		t.Errorf("got quota %d with 1 idle core, want 37500", quota)
+	}
+	sample.idleCores = 4
+	if quota, _ := getMaxCPU(sample, 0.1, 0, 1); quota != 65000 {
+		t.Errorf("got quota %d with 4 idle cores, want the headroom 65000", quota)
+	}
+}
+
+func TestDiskCgCounters(t *testing.T) {
+	sda := lsblkOutputJSON{Kname: "sda", MajMin: "8:0", Type: "disk", Children: []lsblkOutputJSON{
+		{Kname: "sda1", MajMin: "8:1", Type: "part"},
+		{Kname: "sda2", MajMin: "8:2", Type: "part", Children: []lsblkOutputJSON{
+			{Kname: "dm-0", MajMin: "253:0", Type: "lvm"},
+		}},
+		{Kname: "sda3", MajMin: "invalid", Type: "part"},
+	}}
+	counters := []*stats.IOEntry{
+		{Major: 8, Minor: 0, Rbytes: 100, Wbytes: 10},
+		{Major: 8, Minor: 1, Rbytes: 200, Wbytes: 20},
+		{Major: 8, Minor: 2, Rbytes: 300, Wbytes: 30},
+		{Major: 253, Minor: 0, Rbytes: 1000, Wbytes: 1000}, // Already counted on its partition
+		{Major: 8, Minor: 16, Rbytes: 1000, Wbytes: 1000},  // Another disk
+	}
+	if rbytes, wbytes := diskCgCounters(counters, sda); rbytes != 600 || wbytes != 60 {
+		t.Errorf("got %d read and %d written, want 600 and 60", rbytes, wbytes)
+	}
+
+	counters[1].Rbytes = math.MaxUint64
+	if rbytes, _ := diskCgCounters(counters, sda); rbytes != math.MaxUint64 {
+		t.Errorf("got %d read, want the counters to saturate", rbytes)
+	}
+	if rbytes, wbytes := diskCgCounters(nil, sda); rbytes != 0 || wbytes != 0 {
+		t.Errorf("got %d read and %d written without counters, want 0", rbytes, wbytes)
+	}
+}
+
+func TestIOMarginBase(t *testing.T) {
+	// 1000B/s device with 400B/s idle, the process reads 100B/s, writes were not benchmarked
+	sample := ioSample{major: 8, cgRead: 100, maxRead: 1000, availableRead: 400, readTested: true, cgWrite: 100, maxWrite: 1000, availableWrite: 400}
+	tests := []struct {
+		name              string
+		marginOfAvailable bool
+		saturated         bool
+		want              uint64 // 0 when not throttled
+	}{
+		// The margin is 10% of the max: 100B/s are left idle
+		{"total", false, false, 400},
+		// The margin is 10% of the idle throughput: 40B/s are left idle
+		{"available", true, false, 460},
+		{"total saturated", false, true, 0},
+		{"available saturated", true, true, 60},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sample := sample
+			sample.saturated = test.saturated
+			entries := getMaxIO([]ioSample{sample}, 0.1, 0, 1, test.marginOfAvailable)
+			if test.want == 0 {
+				if len(entries) != 0 {
+					t.Errorf("got %+v, want no limit", entries)
+				}
+				return
+			}
+			if len(entries) != 1 || entries[0].Type != cgroup2.ReadBPS || entries[0].Rate != test.want {
+				t.Errorf("got %+v, want a read limit of %d", entries, test.want)
+			}
+		})
+	}
+}
+
+func TestScaledControllers(t *testing.T) {
+	disk := map[string]lsblkOutputJSON{"sda": {Kname: "sda", MajMin: "8:0", Type: "disk"}}
+	tests := []struct {
+		name      string
+		disks     map[string]lsblkOutputJSON
+		unmanaged map[string]bool
+		want      []string
+	}{
+		{"disks", disk, nil, []string{"memory", "cpu", "io"}},
+		// Diskless, netboot or all virtual storage hosts
+		{"no disk", nil, nil, []string{"memory", "cpu"}},
+		{"left out of -controllers", disk, map[string]bool{resourceCPU: true}, []string{"memory", "io"}},
+		{"only io, no disk", nil, map[string]bool{resourceMemory: true, resourceCPU: true}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetGlobals(t)
+			savedLsblk := lsblk
+			t.Cleanup(func() { lsblk = savedLsblk })
+			lsblk, cfg.unmanaged = test.disks, test.unmanaged
+			if got := scaledControllers(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// The CPU times are measured again when the CPUs change (hotplug, elastic VMs), instead of exiting
+func TestSampleCPUAfterCPUCountChange(t *testing.T) {
+	c, system := useFakeTime(t)
+	cfg.perCoreCPU = true
+	m := newFakeCgroup()
+	initCPUTimes(m)
+
+	c.advance(time.Second)
+	sample, ok, err := sampleCPU(m.stats.CPU)
+	if err != nil || !ok {
+		t.Fatalf("got %t, %v", ok, err)
+	}
+	if sample.idleCores != 3 || sample.total != 4e6 {
+		t.Errorf("got %d idle cores over %.0fµs, want 3 over 4s", sample.idleCores, sample.total)
+	}
+
+	// The idle cores are only unknown for the sample where the count changed
+	system.cores = 6
+	c.advance(time.Second)
+	if sample, ok, err = sampleCPU(m.stats.CPU); err != nil || !ok {
+		t.Fatalf("got %t, %v", ok, err)
+	}
+	if sample.idleCores != -1 {
+		t.Errorf("got %d idle cores while the CPUs changed, want -1", sample.idleCores)
+	}
+	c.advance(time.Second)
+	if sample, _, _ = sampleCPU(m.stats.CPU); sample.idleCores != 5 || sample.numCores != 6 {
+		t.Errorf("got %d idle cores of %d, want 5 of 6", sample.idleCores, sample.numCores)
+	}
+
+	// Without previous times, the sample is skipped and the next one is measured from this one
+	lastCPUTimes.system = nil
+	c.advance(time.Second)
+	if _, ok, err = sampleCPU(m.stats.CPU); err != nil || ok {
+		t.Fatalf("got %t, %v, want the sample skipped", ok, err)
+	}
+	c.advance(time.Second)
+	if sample, ok, _ = sampleCPU(m.stats.CPU); !ok || sample.total != 6e6 {
+		t.Errorf("got %t and %.0fµs, want the 6 cores over 1s", ok, sample.total)
+	}
+}
+
+// A disk that disappears (e.g. unplugged) is a new disk when it reappears: its counters restarted
+func TestReappearingDiskIsABaseline(t *testing.T) {
+	sda := lsblkOutputJSON{Name: "sda", Kname: "sda", MajMin: "8:0", Type: "disk"}
+	c, system := useFakeTime(t, sda)
+	system.setIO("sda", disk.IOCountersStat{ReadBytes: 1 << 30})
+	initIOCounters(newFakeCgroup())
+
+	step := func() []ioSample {
+		t.Helper()
+		c.advance(time.Second)
+		samples, err := sampleIO(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return samples
+	}
+	if samples := step(); len(samples) != 1 {
+		t.Fatalf("got %+v, want sda measured from its second observation", samples)
+	}
+
+	delete(system.io, "sda")
+	if samples := step(); len(samples) != 0 {
+		t.Fatalf("got %+v while sda is gone", samples)
+	}
+	system.setIO("sda", disk.IOCountersStat{ReadBytes: 10 << 20})
+	if samples := step(); len(samples) != 0 {
+		t.Errorf("got %+v, want the reappeared sda to be a baseline", samples)
+	}
+	system.setIO("sda", disk.IOCountersStat{ReadBytes: 20 << 20})
+	if samples := step(); len(samples) != 1 || samples[0].cgRead != 10<<20 {
+		t.Errorf("got %+v, want 10MiB/s read", samples)
+	}
+}
+
+// Run the monitoring loop on the fake cgroup, the test sends the ticks of the fake clock
+func startTestMonitor(t *testing.T, m cgroupManager) (*fakeClock, context.CancelFunc, <-chan bool) {
+	t.Helper()
+	c, _ := useFakeTime(t)
+	cfg.interval = time.Second
+	cfg.initialSamples = 1
+	savedPolicy, savedShadows := activePolicy, shadowPolicies
+	activePolicy, shadowPolicies = greedyPolicy{}, nil
+	t.Cleanup(func() { activePolicy, shadowPolicies = savedPolicy, savedShadows })
+	select {
+	case <-monitorFailed:
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	finished := make(chan bool, 1)
+	go func() {
+		finished <- monitorResources(ctx, m)
+	}()
+	return c, cancel, finished
+}
+
+func TestMonitorStopsWithItsContext(t *testing.T) {
+	m := newFakeCgroup()
+	c, cancel, finished := startTestMonitor(t, m)
+	for i := 0; i < 3; i++ {
+		c.ticks <- c.advance(time.Second)
+	}
+	cancel()
+	select {
+	case ok := <-finished:
+		if !ok {
+			t.Error("the loop reported an unexpected exit")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the loop didn't stop with its context")
+	}
+	if len(m.updates) < 2 {
+		t.Errorf("got %d updates, want one per tick handled", len(m.updates))
+	}
+	select {
+	case err := <-monitorFailed:
+		t.Errorf("the loop failed: %s", err)
+	default:
+	}
+}
+
+func TestMonitorGivesUpAfterUpdateFailures(t *testing.T) {
+	m := newFakeCgroup()
+	m.updateErr = errors.New("no space left on device")
+	c, _, finished := startTestMonitor(t, m)
+	for i := 0; i < MaxUpdateFailures; i++ {
+		c.ticks <- c.advance(time.Second)
+	}
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the loop didn't give up")
+	}
+	select {
+	case err := <-monitorFailed:
+		var updateErr *CgroupUpdateError
+		if !errors.As(err, &updateErr) {
+			t.Errorf("got %v, want a CgroupUpdateError", err)
+		}
+	default:
+		t.Error("the failure was not reported")
+	}
+}
+
+// The counters of the cgroup restart when it is recreated, the delta is then 0, not a wrapped one
+func TestSampleCPUAfterCounterReset(t *testing.T) {
+	c, _ := useFakeTime(t)
+	m := newFakeCgroup()
+	m.stats.CPU = &stats.CPUStat{UsageUsec: 5e6, NrPeriods: 100, NrThrottled: 50, ThrottledUsec: 1e6}
+	initCPUTimes(m)
+
+	c.advance(time.Second)
+	m.stats.CPU = &stats.CPUStat{UsageUsec: 1e6, NrPeriods: 10, NrThrottled: 5, ThrottledUsec: 1e5}
+	sample, ok, err := sampleCPU(m.stats.CPU)
+	if err != nil || !ok {
+		t.Fatalf("got %t, %v", ok, err)
+	}
+	if sample.cg != 0 || sample.periods != 0 || sample.throttled != 0 || sample.throttledUsec != 0 {
+		t.Errorf("got %+v, want no usage nor throttling after the reset", sample)
+	}
+
+	// Measured from the new counters
+	c.advance(time.Second)
+	m.stats.CPU = &stats.CPUStat{UsageUsec: 1.5e6, NrPeriods: 20, NrThrottled: 6, ThrottledUsec: 2e5}
+	if sample, _, _ = sampleCPU(m.stats.CPU); sample.cg != 0.5e6 || sample.periods != 10 || sample.throttled != 1 {
+		t.Errorf("got %+v, want 0.5s used and 1 of 10 periods throttled", sample)
+	}
+}
+
+// Counters going back (cgroup recreated, device reset) give no IO for the interval, not a wrapped one
+func TestSampleIOAfterCounterReset(t *testing.T) {
+	sda := lsblkOutputJSON{Name: "sda", Kname: "sda", MajMin: "8:0", Type: "disk"}
+	c, system := useFakeTime(t, sda)
+	m := newFakeCgroup()
+	m.stats.Io = &stats.IOStat{Usage: []*stats.IOEntry{{Major: 8, Minor: 0, Rbytes: 500 << 20, Wbytes: 500 << 20}}}
+	system.setIO("sda", disk.IOCountersStat{ReadBytes: 1 << 30, WriteBytes: 1 << 30})
+	initIOCounters(m)
+
+	c.advance(time.Second)
+	m.stats.Io = &stats.IOStat{Usage: []*stats.IOEntry{{Major: 8, Minor: 0, Rbytes: 10 << 20, Wbytes: 10 << 20}}}
+	system.setIO("sda", disk.IOCountersStat{ReadBytes: 20 << 20, WriteBytes: 20 << 20})
+	samples, err := sampleIO(m.stats.Io)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("got %d samples, want 1", len(samples))
+	}
+	if s := samples[0]; s.cgRead != 0 || s.cgWrite != 0 || s.availableRead != s.maxRead || s.availableWrite != s.maxWrite {
+		t.Errorf("got %+v, want no IO after the reset", s)
+	}
+}
+
+func TestCPUFloorSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  cpuFloor
+		ok    bool
+	}{
+		{"0.5", cpuFloor{cores: 0.5}, true},
+		{"2", cpuFloor{cores: 2}, true},
+		{"20000us", cpuFloor{quota: 20000}, true},
+		{" 1.5 ", cpuFloor{cores: 1.5}, true},
+		{"-1", cpuFloor{}, false},
+		{"-5us", cpuFloor{}, false},
+		{"1.5us", cpuFloor{}, false},
+		{"half", cpuFloor{}, false},
+	}
+	for _, test := range tests {
+		var floor cpuFloor
+		err := floor.Set(test.value)
+		if (err == nil) != test.ok || floor != test.want {
+			t.Errorf("Set(%q) = %+v, %v, want %+v", test.value, floor, err, test.want)
+		}
+		if test.ok && floor.String() != strings.TrimSpace(test.value) {
+			t.Errorf("String() = %q, want %q", floor.String(), strings.TrimSpace(test.value))
+		}
+	}
+}
+
+func TestByteSizeSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  byteSize
+	}{
+		{"512", 512},
+		{"2G", 2e9},
+		{"2GB", 2e9},
+		{"512Mi", 512 << 20},
+		{"1.5Ki", 1536},
+		{"1k", 1000},
+		{"1K", 1000},
+		{"3Ti", 3 << 40},
+	}
+	for _, test := range tests {
+		var size byteSize
+		if err := size.Set(test.value); err != nil || size != test.want {
+			t.Errorf("Set(%q) = %d, %v, want %d", test.value, size, err, test.want)
+		}
+	}
+	for _, value := range []string{"", "-1G", "lots", "1Pi"} {
+		var size byteSize
+		if err := size.Set(value); err == nil {
+			t.Errorf("Set(%q) = %d, want an error", value, size)
+		}
+	}
+}
+
+func TestFloorsApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		floors floors
+		limits Limits
+		want   Limits
+	}{
+		{"below", floors{memory: 1 << 30, cpu: cpuFloor{cores: 2}}, Limits{MemoryMax: 1 << 20, CPUQuota: 1000, CPUPeriod: 100000}, Limits{MemoryMax: 1 << 30, CPUQuota: 50000, CPUPeriod: 100000}},
+		{"above", floors{memory: 1 << 20, cpu: cpuFloor{cores: 1}}, Limits{MemoryMax: 1 << 30, CPUQuota: 80000, CPUPeriod: 100000}, Limits{MemoryMax: 1 << 30, CPUQuota: 80000, CPUPeriod: 100000}},
+		{"quota", floors{cpu: cpuFloor{quota: 20000}}, Limits{MemoryMax: 1 << 20, CPUQuota: 1000, CPUPeriod: 100000}, Limits{MemoryMax: 1 << 20, CPUQuota: 20000, CPUPeriod: 100000}},
+		{"not set", floors{}, Limits{MemoryMax: 1, CPUQuota: 1, CPUPeriod: 100000}, Limits{MemoryMax: 1, CPUQuota: 1, CPUPeriod: 100000}},
+		// The CPU was not decided
+		{"no period", floors{cpu: cpuFloor{cores: 2}}, Limits{MemoryMax: 1}, Limits{MemoryMax: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limits := test.limits
+			test.floors.apply(&limits, 4)
+			if !reflect.DeepEqual(limits, test.want) {
+				t.Errorf("got %+v, want %+v", limits, test.want)
+			}
+		})
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	var e ewma
+	// Seeded with the first value
+	if got := e.update(100, 0.5); got != 100 {
+		t.Errorf("got %g, want the first value", got)
+	}
+	if got := e.update(0, 0.5); got != 50 {
+		t.Errorf("got %g, want 50", got)
+	}
+	if got := e.update(0, 0.5); got != 25 {
+		t.Errorf("got %g, want 25", got)
+	}
+	// Without smoothing, the last value
+	if got := e.update(80, 0); got != 80 {
+		t.Errorf("got %g, want 80", got)
+	}
+}
+
+// With -smoothing, the available throughput of a device is averaged over the intervals
+func TestSmoothedAvailableIO(t *testing.T) {
+	sda := lsblkOutputJSON{Name: "sda", Kname: "sda", MajMin: "8:0", Type: "disk"}
+	c, system := useFakeTime(t, sda)
+	cfg.smoothing = 0.5
+	system.setIO("sda", disk.IOCountersStat{})
+	initIOCounters(newFakeCgroup())
+
+	var available []float64
+	for _, read := range []uint64{100 << 20, 600 << 20, 600 << 20} {
+		c.advance(time.Second)
+		system.setIO("sda", disk.IOCountersStat{ReadBytes: read})
+		samples, err := sampleIO(nil)
+		if err != nil || len(samples) != 1 {
+			t.Fatalf("got %+v, %v", samples, err)
+		}
+		available = append(available, samples[0].availableRead)
+	}
+	// 100MiB/s, then 500MiB/s, then nothing read out of 1GiB/s
+	want := []float64{924 << 20, (924<<20 + 524<<20) / 2, ((924<<20+524<<20)/2 + 1<<30) / 2}
+	if !reflect.DeepEqual(available, want) {
+		t.Errorf("got %v, want %v", available, want)
+	}
+}
+
+// The write benchmarks of a device are serialized, those of different devices are not
+func TestLockMount(t *testing.T) {
+	unlock := lockMount("sda")
+
+	otherLocked := make(chan struct{})
+	go func() {
+		lockMount("sdb")()
+		close(otherLocked)
+	}()
+	select {
+	case <-otherLocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sdb waited for the benchmark of sda")
+	}
+
+	sameLocked := make(chan struct{})
+	go func() {
+		lockMount("sda")()
+		close(sameLocked)
+	}()
+	select {
+	case <-sameLocked:
+		t.Fatal("sda benchmarked twice at the same time")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-sameLocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sda still locked once released")
+	}
+}
+
+// Every pending device is handled once by the pool of workers, whatever their number
+func TestBenchmarkDevicesInParallel(t *testing.T) {
+	for _, parallel := range []int{1, 3, 20} {
+		t.Run(strconv.Itoa(parallel), func(t *testing.T) {
+			useFakeTime(t)
+			cfg.benchmarkParallel = parallel
+			// Exhausted before any benchmark, the devices are not measured
+			cfg.benchmarkBudget = time.Nanosecond
+			for i := 0; i < 8; i++ {
+				kname := fmt.Sprintf("sd%c", 'a'+i)
+				lsblk[kname] = lsblkOutputJSON{Name: kname, Kname: kname, MajMin: fmt.Sprintf("8:%d", 16*i), Type: "disk"}
+			}
+
+			benchmarkDevices()
+			if len(ioBenchmark) != len(lsblk) {
+				t.Fatalf("got %d benchmarks, want %d", len(ioBenchmark), len(lsblk))
+			}
+			for kname, max := range ioBenchmark {
+				if max.source != benchmarkSourceUnbenchmarked {
+					t.Errorf("%s: got source %q, want it unbenchmarked", kname, max.source)
+				}
+			}
+		})
+	}
+}
+
+// Benchmarker reporting the throughputs set by the test, in MB/s, through the outputs of hdparm and dd
+type fakeBenchmarker struct {
+	mu            sync.Mutex
+	read, write   map[string]int // By kernel name, the devices left out can't be measured
+	reads, writes []string       // Devices benchmarked
+}
+
+func useFakeBenchmarker(t *testing.T) *fakeBenchmarker {
+	saved := benchmarker
+	t.Cleanup(func() { benchmarker = saved })
+	fake := &fakeBenchmarker{read: make(map[string]int), write: make(map[string]int)}
+	benchmarker = fake
+	return fake
+}
+
+func (b *fakeBenchmarker) Read(device lsblkOutputJSON, max *maxIO) {
+	b.mu.Lock()
+	b.reads = append(b.reads, device.Kname)
+	rate, ok := b.read[device.Kname]
+	b.mu.Unlock()
+	output := fmt.Sprintf(" Timing buffered disk reads: %d MB in  1.00 seconds = %d MB/sec\n", rate, rate)
+	if ok && setMaxIO([]byte(output), max, true) {
+		max.readTool = "hdparm"
+	}
+}
+
+func (b *fakeBenchmarker) Write(device lsblkOutputJSON, max *maxIO) {
+	b.mu.Lock()
+	b.writes = append(b.writes, device.Kname)
+	rate, ok := b.write[device.Kname]
+	b.mu.Unlock()
+	output := fmt.Sprintf("83886080 bytes (84 MB, 80 MiB) copied, 1 s, %d MB/s\n", rate)
+	if ok && setMaxIO([]byte(output), max, false) {
+		max.writeTool = "dd"
+		max.writesTested = true
+	}
+}
+
+// The benchmarks run in parallel give the results of the serial ones
+func TestParallelBenchmarkMatchesSerial(t *testing.T) {
+	benchmarks := func(parallel int) map[string]maxIO {
+		useFakeTime(t)
+		fake := useFakeBenchmarker(t)
+		cfg.benchmarkParallel = parallel
+		for i := 0; i < 8; i++ {
+			kname := fmt.Sprintf("sd%c", 'a'+i)
+			part := kname + "1"
+			lsblk[kname] = lsblkOutputJSON{
+				Name:     kname,
+				Kname:    kname,
+				MajMin:   fmt.Sprintf("8:%d", 16*i),
+				Type:     "disk",
+				Children: []lsblkOutputJSON{{Name: part, Kname: part, MajMin: fmt.Sprintf("8:%d", 16*i+1), Type: "part"}},
+			}
+			fake.read[kname] = 100 + 50*i
+			fake.write[part] = 50 + 20*i
+		}
+
+		benchmarkDevices()
+		results := make(map[string]maxIO, len(ioBenchmark))
+		for kname, max := range ioBenchmark {
+			max.measuredAt = time.Time{}
+			results[kname] = max
+		}
+		return results
+	}
+
+	serial := benchmarks(1)
+	if len(serial) != 8 || serial["sdc"].read != 200<<20 || serial["sdc"].write != 90<<20 {
+		t.Fatalf("got %+v, want the throughputs of the 8 disks", serial)
+	}
+	for _, parallel := range []int{2, 3, 8} {
+		if got := benchmarks(parallel); !reflect.DeepEqual(got, serial) {
+			t.Errorf("%d in parallel: got %+v, want %+v", parallel, got, serial)
+		}
+	}
+}
+
+// A disk and its partitions share a bandwidth, measured once rather than added up
+func TestBenchmarkDiskWithPartitions(t *testing.T) {
+	useFakeTime(t)
+	fake := useFakeBenchmarker(t)
+	sda := lsblkOutputJSON{
+		Name:   "sda",
+		Kname:  "sda",
+		MajMin: "8:0",
+		Type:   "disk",
+		Children: []lsblkOutputJSON{
+			{Name: "sda1", Kname: "sda1", MajMin: "8:1", Type: "part"},
+			{Name: "sda2", Kname: "sda2", MajMin: "8:2", Type: "part"},
+		},
+	}
+	// Each of them would report the throughput of the disk
+	for _, kname := range []string{"sda", "sda1", "sda2"} {
+		fake.read[kname] = 500
+		fake.write[kname] = 200
+	}
+	lsblk["sda"] = sda
+	cfg.benchmarkParallel = 1
+
+	benchmarkDevices()
+	max := ioBenchmark["sda"]
+	if max.read != 500<<20 || max.write != 200<<20 {
+		t.Errorf("got %d read and %d written per second, want %d and %d", max.read, max.write, 500<<20, 200<<20)
+	}
+	if !reflect.DeepEqual(fake.reads, []string{"sda"}) || !reflect.DeepEqual(fake.writes, []string{"sda1"}) {
+		t.Errorf("read benchmarks of %v and write benchmarks of %v, want sda and sda1", fake.reads, fake.writes)
+	}
+	if len(ioBenchmark) != 1 {
+		t.Errorf("got benchmarks of %d devices, want only the disk", len(ioBenchmark))
+	}
+}
+
+func TestGetCPUWeight(t *testing.T) {
+	for _, test := range []struct {
+		quota  int64
+		period uint64
+		weight uint64
+	}{
+		{0, 100000, MinCPUWeight},
+		{-1, 100000, MinCPUWeight},
+		{50000, 0, MinCPUWeight},
+		{100, 100000, MinCPUWeight}, // Rounded to 0
+		{25000, 100000, 33},
+		{50000, 100000, DefaultCPUWeight},
+		{75000, 100000, 300},
+		{99999, 100000, MaxCPUWeight}, // Clamped
+		{100000, 100000, MaxCPUWeight},
+		{400000, 100000, MaxCPUWeight},
+	} {
+		if got := getCPUWeight(test.quota, test.period); got != test.weight {
+			t.Errorf("getCPUWeight(%d, %d) = %d, want %d", test.quota, test.period, got, test.weight)
+		}
+	}
+}
+
+func TestApplyCPUMode(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		mode    string
+		skipped bool
+		weight  uint64
+	}{
+		{"quota", "quota", false, 0},
+		{"weight", "weight", false, 300},
+		{"weight of a skipped CPU", "weight", true, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resetGlobals(t)
+			cfg.cpuMode = test.mode
+			// The weight of a previous decision is not kept
+			limits := Limits{CPUQuota: 75000, CPUPeriod: 100000, CPUWeight: 42, Skipped: map[string]bool{resourceCPU: test.skipped}}
+			applyCPUMode(&limits)
+			if limits.CPUWeight != test.weight {
+				t.Errorf("got cpu.weight %d, want %d", limits.CPUWeight, test.weight)
+			}
+			if limits.CPUQuota != 75000 || limits.CPUPeriod != 100000 {
+				t.Errorf("quota changed to %d/%d", limits.CPUQuota, limits.CPUPeriod)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Serves the last decision of the control loop in the Prometheus text format, to be scraped
+// The series are the ones pushed with -remote-write-url
+type metricsEndpoint struct {
+	mu     sync.Mutex
+	last   *HistoryEntry // nil before the first tick
+	labels []remoteWriteLabel
+}
+
+// Served on -metrics-addr, nil without it
+var metrics *metricsEndpoint
+
+func newMetricsEndpoint() *metricsEndpoint {
+	return &metricsEndpoint{labels: processLabels()}
+}
+
+func (m *metricsEndpoint) record(entry HistoryEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last = &entry
+}
+
+type exposedSample struct {
+	name   string
+	labels []remoteWriteLabel
+	value  float64
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// GET /metrics
+func (m *metricsEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var samples []exposedSample
+	add := func(name string, value float64, labels ...remoteWriteLabel) {
+		all := append(append([]remoteWriteLabel(nil), m.labels...), labels...)
+		sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+		samples = append(samples, exposedSample{name: name, labels: all, value: value})
+	}
+	m.mu.Lock()
+	if m.last != nil {
+		decisionSeries(*m.last, add)
+	}
+	m.mu.Unlock()
+	benchmarkSeries(add)
+	// The samples of a metric must be grouped
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].name < samples[j].name })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bufio.NewWriter(w)
+	for i, sample := range samples {
+		if i == 0 || samples[i-1].name != sample.name {
+			out.WriteString("# TYPE " + sample.name + " gauge\n")
+		}
+		out.WriteString(sample.name + "{")
+		for j, label := range sample.labels {
+			if j > 0 {
+				out.WriteByte(',')
+			}
+			out.WriteString(label.name + `="` + labelValueEscaper.Replace(label.value) + `"`)
+		}
+		out.WriteString("} " + strconv.FormatFloat(sample.value, 'g', -1, 64) + "\n")
+	}
+	if err := out.Flush(); err != nil {
+		log.Printf("Warning: could not send the metrics: %s\n", err)
+	}
+}
+
+// Serve the metrics over HTTP (see listenHTTP)
+func startMetricsServer(address string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	return listenHTTP("Metrics server", address, mux)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Already running processes to manage, ex: -pid 100,101 -pid 102
+type pidList []int
+
+func (p *pidList) String() string {
+	pids := make([]string, len(*p))
+	for i, pid := range *p {
+		pids[i] = strconv.Itoa(pid)
+	}
+	return strings.Join(pids, ",")
+}
+
+func (p *pidList) Set(value string) error {
+	for _, field := range strings.Split(value, ",") {
+		pid, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || pid <= 0 {
+			return fmt.Errorf("invalid PID %q", field)
+		}
+		*p = append(*p, pid)
+	}
+	return nil
+}
+
+// cgroup of a process, relative to the cgroup root
+func processCgroup(pid int) (string, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	// cgroup v2 has a single hierarchy: "0::/path"
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "0::") {
+			return strings.TrimPrefix(scanner.Text(), "0::"), nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 entry for process %d", pid)
+}
+
+// The processes may exit during the setup (the IO benchmark can take minutes): keep the ones
+// still running, and exit cleanly if none is, as there is nothing left to scale
+func alivePIDs(pids []int) []int {
+	alive := make([]int, 0, len(pids))
+	for _, pid := range pids {
+		if processAlive(pid) {
+			alive = append(alive, pid)
+		} else {
+			log.Printf("Process %d exited during setup\n", pid)
+		}
+	}
+	if len(alive) == 0 {
+		exitExitedDuringSetup()
+	}
+	return alive
+}
+
+func exitExitedDuringSetup() {
+	log.Println("All the processes exited during setup, nothing to scale")
+	exit(exitReasonCompleted, "the processes exited during setup", 0)
+}
+
+// Parent PID of a process, from /proc/<pid>/stat
+func parentPID(pid int) (int, error) {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// Format: pid (comm) state ppid ..., comm may contain spaces and parentheses
+	end := bytes.LastIndexByte(content, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(content[end+1:]))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("invalid /proc/%d/stat", pid)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// Descendants of a process, from the parent PIDs of all the processes
+func descendants(root int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if ppid, err := parentPID(pid); err == nil {
+			children[ppid] = append(children[ppid], pid)
+		}
+	}
+
+	var result []int
+	queue := children[root]
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		result = append(result, pid)
+		queue = append(queue, children[pid]...)
+	}
+	return result
+}
+
+// The command may fork before it is moved to the cgroup, and its children would then escape the
+// limits: move its descendants as well. This only runs once, at setup, not on every tick: the processes
+// forked once they are all in the cgroup inherit it, so the rounds are repeated until no process is
+// left outside, at most MaxAdoptRounds times
+func adoptDescendants(m cgroupManager, root int) {
+	for round := 0; round < MaxAdoptRounds; round++ {
+		procs, err := m.Procs(true)
+		if err != nil {
+			log.Printf("Warning: could not list the processes of the cgroup: %s\n", err)
+			return
+		}
+		inside := make(map[int]bool, len(procs))
+		for _, pid := range procs {
+			inside[int(pid)] = true
+		}
+
+		adopted := 0
+		for _, pid := range descendants(root) {
+			if inside[pid] {
+				continue
+			}
+			// Exited in the meantime
+			if err := m.AddProc(uint64(pid)); err != nil {
+				continue
+			}
+			log.Printf("Process %d, forked by the command before it joined the cgroup, added to it\n", pid)
+			adopted++
+		}
+		if adopted == 0 {
+			return
+		}
+	}
+}
+
+// Remember where the processes come from, so that they can be released when process-scaler stops
+func originalCgroups(pids []int) map[int]string {
+	origins := make(map[int]string, len(pids))
+	for _, pid := range pids {
+		group, err := processCgroup(pid)
+		if err != nil {
+			if !processAlive(pid) {
+				// Exited since alivePIDs, addProcs skips it
+				continue
+			}
+			fatalf("Process %d: %s", pid, err)
+		}
+		origins[pid] = group
+	}
+	return origins
+}
+
+// Move the processes still running back to their original cgroup, without limits from process-scaler
+func releasePIDs(origins map[int]string) {
+	for pid, group := range origins {
+		if !processAlive(pid) {
+			continue
+		}
+		procs := filepath.Join(CgroupRoot, group, "cgroup.procs")
+		if err := os.WriteFile(procs, []byte(strconv.Itoa(pid)), 0); err != nil {
+			log.Printf("Warning: could not move process %d back to %s: %s\n", pid, group, err)
+			continue
+		}
+		log.Printf("Process %d moved back to %s\n", pid, group)
+	}
+}
+
+// Move all the processes of the cgroup out of it before it is deleted, as deleting it through systemd
+// kills the processes left inside: the -pid processes go back to their original cgroup, and so do
+// the processes they forked since. The others go to the cgroup of process-scaler
+func releaseProcesses(m cgroupManager, origins map[int]string) {
+	procs, err := m.Procs(true)
+	if err != nil {
+		log.Printf("Warning: could not list the processes to release: %s\n", err)
+		releasePIDs(origins)
+		return
+	}
+	fallback, err := processCgroup(os.Getpid())
+	if err != nil {
+		log.Printf("Warning: could not read the cgroup of process-scaler: %s\n", err)
+	}
+	destinations := make(map[int]string, len(procs))
+	for _, proc := range procs {
+		pid := int(proc)
+		if group := ancestorOrigin(pid, origins); group != "" {
+			destinations[pid] = group
+		} else if fallback != "" {
+			destinations[pid] = fallback
+		}
+	}
+	releasePIDs(destinations)
+}
+
+// Original cgroup of the process or of its closest ancestor among the -pid processes, "" if none
+func ancestorOrigin(pid int, origins map[int]string) string {
+	for pid > 1 {
+		if group, exists := origins[pid]; exists {
+			return group
+		}
+		ppid, err := parentPID(pid)
+		if err != nil {
+			return ""
+		}
+		pid = ppid
+	}
+	return ""
+}
+
+// Move the processes of the cgroup to the cgroup of process-scaler, so that they keep running without
+// its limits once it has exited (-detach)
+func detachProcesses(m cgroupManager) {
+	group, err := processCgroup(os.Getpid())
+	if err != nil {
+		log.Printf("Warning: could not detach the processes: %s\n", err)
+		return
+	}
+	procs, err := m.Procs(true)
+	if err != nil {
+		log.Printf("Warning: could not list the processes to detach: %s\n", err)
+		return
+	}
+	origins := make(map[int]string, len(procs))
+	for _, pid := range procs {
+		origins[int(pid)] = group
+	}
+	releasePIDs(origins)
+}
+
+// Wait until all the processes have exited, or until process-scaler is asked to stop or the
+// monitoring loop gives up
+// Return whether it was asked to stop, and the error of the monitoring loop
+func waitPIDs(pids []int) (bool, error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	// The processes are not children of process-scaler, they can only be polled
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	remaining := append([]int(nil), pids...)
+	for {
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s, releasing the processes\n", sig)
+			return true, nil
+		case err := <-monitorFailed:
+			log.Printf("Monitoring failed, releasing the processes: %s\n", err)
+			return true, err
+		case <-ticker.C:
+		}
+
+		alive := remaining[:0]
+		for _, pid := range remaining {
+			if processAlive(pid) {
+				alive = append(alive, pid)
+			} else {
+				slog.Info("Process exited", "pid", pid)
+			}
+		}
+		remaining = alive
+
+		state.Lock()
+		state.pids = append([]int(nil), remaining...)
+		state.Unlock()
+
+		if len(remaining) == 0 {
+			return false, nil
+		}
+	}
+}
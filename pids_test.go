@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Start a process that exits right away, it stays a zombie until the test ends
+func exitedProcess(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("could not start a process: %s", err)
+	}
+	t.Cleanup(func() { _ = cmd.Wait() })
+	for deadline := time.Now().Add(5 * time.Second); processAlive(cmd.Process.Pid); {
+		if time.Now().After(deadline) {
+			t.Fatalf("process %d still running", cmd.Process.Pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cmd.Process.Pid
+}
+
+func TestProcessAlive(t *testing.T) {
+	if !processAlive(os.Getpid()) {
+		t.Error("the test process is not alive")
+	}
+	if processAlive(exitedProcess(t)) {
+		t.Error("a zombie is alive")
+	}
+}
+
+// The processes that exited during the setup are left out
+func TestAlivePIDs(t *testing.T) {
+	exited := exitedProcess(t)
+	if got := alivePIDs([]int{exited, os.Getpid()}); !reflect.DeepEqual(got, []int{os.Getpid()}) {
+		t.Errorf("got %v, want only %d", got, os.Getpid())
+	}
+}
+
+// The children forked by the command before it joined the cgroup are moved to it as well
+func TestAdoptDescendants(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 30 & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("could not start a process: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		_ = cmd.Wait()
+	})
+	var forked []int
+	for deadline := time.Now().Add(5 * time.Second); len(forked) == 0; forked = descendants(cmd.Process.Pid) {
+		if time.Now().After(deadline) {
+			t.Fatal("the command didn't fork")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Only the command joined the cgroup
+	m := newFakeCgroup()
+	m.procs = []uint64{uint64(cmd.Process.Pid)}
+	adoptDescendants(m, cmd.Process.Pid)
+
+	var got []int
+	for _, pid := range m.procs {
+		got = append(got, int(pid))
+	}
+	want := append([]int{cmd.Process.Pid}, forked...)
+	sort.Ints(got)
+	sort.Ints(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v in the cgroup, want the command and its child %v", got, want)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"github.com/containerd/cgroups/v3/cgroup2"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	// Fraction of the headroom the target policy moves towards each tick
+	TargetPolicyGain = 0.5
+	// The CPU quota is considered too low when the cgroup is throttled in more than this fraction of the periods
+	HeavyThrottlingRatio = 0.5
+
+	// Lowest limits applied before the process has been measured once, an idle process that just
+	// started has a usage of ~0 and must not be throttled to nothing
+	BaselineMemoryMax = 64 * 1024 * 1024 // 64MiB
+	BaselineCPUQuota  = 1000             // 1% of the machine with a 100ms period
+	BaselineIOBPS     = 1024 * 1024      // 1MiB/s
+
+	// With -soft-memory, fraction of memory.high added to get memory.max
+	SoftMemoryCeilingGap = 0.1
+)
+
+// Resources managed by process-scaler, named after their cgroup controller
+const (
+	resourceMemory = "memory"
+	resourceCPU    = "cpu"
+	resourceIO     = "io"
+	resourceGPU    = "gpu" // Only with -gpu, not a cgroup controller
+)
+
+// Resources usage measured over the last monitoring interval
+type Snapshot struct {
+	Memory  memorySample
+	CPU     cpuSample
+	IO      []ioSample
+	Margins Margins
+	Reserve reserve
+	Skipped map[string]bool // Resources that could not be measured, their limits are left unchanged
+
+	IOMarginOfAvailable bool // The IO margin is a fraction of the idle throughput instead of the max
+}
+
+// Fraction of each resource left to the rest of the system, e.g. a tight memory margin and a loose
+// CPU one
+type Margins struct {
+	CPU    float64 `json:"cpu"`
+	Memory float64 `json:"memory"`
+	IO     float64 `json:"io"`
+	GPU    float64 `json:"gpu"` // Of the compute and of the memory of each GPU, with -gpu
+}
+
+// A margin of 0 would leave nothing to the rest of the system, and a margin of 1 nothing to the process
+func validMargin(margin float64) bool {
+	return margin > 0 && margin < 1
+}
+
+// The same margin for all the resources
+func uniformMargins(margin float64) Margins {
+	return Margins{CPU: margin, Memory: margin, IO: margin, GPU: margin}
+}
+
+// Limits to apply to the cgroup
+type Limits struct {
+	MemoryMax  int64
+	MemoryHigh int64 // 0 if not set
+	CPUQuota   int64
+	CPUPeriod  uint64
+	CPUBurst   int64  // cpu.max.burst (µs), with -cpu-burst
+	CPUWeight  uint64 // cpu.weight set instead of cpu.max, with -cpu-mode weight
+	IO         []cgroup2.Entry
+	Skipped    map[string]bool // Resources whose limits are left unchanged
+}
+
+// A Policy decides the limits of the cgroup from the resources usage
+type Policy interface {
+	Name() string
+	Decide(s Snapshot) Limits
+}
+
+// Grants the whole headroom (available resources minus margin) immediately
+type greedyPolicy struct{}
+
+func (greedyPolicy) Name() string { return "greedy" }
+
+func (greedyPolicy) Decide(s Snapshot) Limits {
+	return decideLimits(s, 1)
+}
+
+// Moves the system utilization towards its target (1 - margin) by a fraction of the gap each tick,
+// so that limits change more smoothly than with the greedy policy
+type targetPolicy struct{}
+
+func (targetPolicy) Name() string { return "target" }
+
+func (targetPolicy) Decide(s Snapshot) Limits {
+	return decideLimits(s, TargetPolicyGain)
+}
+
+// Like the target policy, but uses the cpu.stat throttling as feedback: when the process is heavily
+// throttled by its quota while the system still has headroom, the quota is too low and is raised
+// with all the headroom at once
+type feedbackPolicy struct{}
+
+func (feedbackPolicy) Name() string { return "feedback" }
+
+func (feedbackPolicy) Decide(s Snapshot) Limits {
+	limits := decideLimits(s, TargetPolicyGain)
+	if !s.Skipped[resourceCPU] && s.CPU.throttledRatio() > HeavyThrottlingRatio && s.CPU.available > s.CPU.total*s.Margins.CPU {
+		limits.CPUQuota, limits.CPUPeriod = getMaxCPU(s.CPU, s.Margins.CPU, s.Reserve.cpu, 1)
+	}
+	return limits
+}
+
+// Applies the most conservative limit of several policies for each resource, so that the process
+// only gets the capacity all of them agree is safe
+type tightestPolicy struct {
+	policies []Policy
+	binding  map[string]string // Policy deciding each resource on the last tick, to log changes
+}
+
+func newTightestPolicy(policies []Policy) *tightestPolicy {
+	return &tightestPolicy{policies: policies, binding: make(map[string]string)}
+}
+
+func (p *tightestPolicy) Name() string {
+	names := make([]string, len(p.policies))
+	for i, policy := range p.policies {
+		names[i] = policy.Name()
+	}
+	return "tightest(" + strings.Join(names, ",") + ")"
+}
+
+func (p *tightestPolicy) Decide(s Snapshot) Limits {
+	var limits Limits
+	binding := make(map[string]string)
+	ioRates := make(map[cgroup2.Entry]uint64)
+	var ioOrder []cgroup2.Entry
+	for i, policy := range p.policies {
+		decided := policy.Decide(s)
+		if i == 0 {
+			limits = decided
+			binding[resourceMemory], binding[resourceCPU], binding[resourceIO] = policy.Name(), policy.Name(), policy.Name()
+		} else {
+			if decided.MemoryMax < limits.MemoryMax {
+				limits.MemoryMax = decided.MemoryMax
+				binding[resourceMemory] = policy.Name()
+			}
+			if decided.MemoryHigh > 0 && (limits.MemoryHigh == 0 || decided.MemoryHigh < limits.MemoryHigh) {
+				limits.MemoryHigh = decided.MemoryHigh
+			}
+			// Quotas are compared as a fraction of their period
+			if decided.CPUPeriod > 0 && float64(decided.CPUQuota)/float64(decided.CPUPeriod) < float64(limits.CPUQuota)/float64(limits.CPUPeriod) {
+				limits.CPUQuota, limits.CPUPeriod = decided.CPUQuota, decided.CPUPeriod
+				binding[resourceCPU] = policy.Name()
+			}
+		}
+		for _, entry := range decided.IO {
+			device := entry
+			device.Rate = 0
+			rate, exists := ioRates[device]
+			if !exists {
+				ioOrder = append(ioOrder, device)
+			}
+			if !exists || entry.Rate < rate {
+				ioRates[device] = entry.Rate
+				if exists {
+					binding[resourceIO] = policy.Name()
+				}
+			}
+		}
+	}
+	limits.IO = make([]cgroup2.Entry, len(ioOrder))
+	for i, entry := range ioOrder {
+		entry.Rate = ioRates[entry]
+		limits.IO[i] = entry
+	}
+
+	for _, resource := range []string{resourceMemory, resourceCPU, resourceIO} {
+		if !s.Skipped[resource] && binding[resource] != p.binding[resource] {
+			log.Printf("Policy %s now binding for %s\n", binding[resource], resource)
+		}
+	}
+	p.binding = binding
+	return limits
+}
+
+// Policy of a comma separated list of names: several policies are combined into the tightest one
+func parsePolicy(value string) (Policy, error) {
+	var selected []Policy
+	for _, name := range strings.Split(value, ",") {
+		policy, ok := policies[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown policy %q, expected one of: %s", strings.TrimSpace(name), policyNames())
+		}
+		selected = append(selected, policy)
+	}
+	if len(selected) == 1 {
+		return selected[0], nil
+	}
+	return newTightestPolicy(selected), nil
+}
+
+var (
+	policies = map[string]Policy{
+		"greedy":   greedyPolicy{},
+		"target":   targetPolicy{},
+		"feedback": feedbackPolicy{},
+	}
+	activePolicy   Policy
+	shadowPolicies []Policy
+)
+
+func policyNames() string {
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func decideLimits(s Snapshot, gain float64) Limits {
+	limits := Limits{Skipped: s.Skipped}
+	if !s.Skipped[resourceMemory] {
+		limits.MemoryMax = getMaxMemory(s.Memory, s.Margins.Memory, float64(s.Reserve.memory), gain)
+	}
+	if !s.Skipped[resourceCPU] {
+		limits.CPUQuota, limits.CPUPeriod = getMaxCPU(s.CPU, s.Margins.CPU, s.Reserve.cpu, gain)
+	}
+	if !s.Skipped[resourceIO] {
+		limits.IO = getMaxIO(s.IO, s.Margins.IO, float64(s.Reserve.ioBPS), gain, s.IOMarginOfAvailable)
+	}
+	return limits
+}
+
+// Copy of the limits leaving the given resources unchanged
+func (l Limits) without(resources map[string]bool) Limits {
+	skipped := make(map[string]bool)
+	for resource, skip := range l.Skipped {
+		skipped[resource] = skip
+	}
+	for resource, skip := range resources {
+		if skip {
+			skipped[resource] = true
+		}
+	}
+	l.Skipped = skipped
+	return l
+}
+
+// With -soft-memory, the decided memory limit becomes memory.high: above it, the kernel throttles the
+// process and reclaims its memory instead of OOM killing it. memory.max is kept SoftMemoryCeilingGap
+// above, as a safety ceiling for what reclaim can't keep up with, within the given capacities
+// The next decision starts from memory.high, so the gap doesn't compound from tick to tick
+func (l *Limits) soften(capacities ...Capacity) {
+	if l.Skipped[resourceMemory] {
+		return
+	}
+	l.MemoryHigh = l.MemoryMax
+	l.MemoryMax += int64(float64(l.MemoryMax) * SoftMemoryCeilingGap)
+	for _, c := range capacities {
+		if c.Memory != nil && l.MemoryMax > *c.Memory {
+			l.MemoryMax = *c.Memory
+		}
+	}
+	if l.MemoryHigh > l.MemoryMax {
+		l.MemoryHigh = l.MemoryMax
+	}
+}
+
+// Copy of the limits raised to the safe baseline
+func (l Limits) atLeastBaseline() Limits {
+	if l.MemoryMax < BaselineMemoryMax {
+		l.MemoryMax = BaselineMemoryMax
+	}
+	if l.MemoryHigh > 0 && l.MemoryHigh < BaselineMemoryMax {
+		l.MemoryHigh = BaselineMemoryMax
+	}
+	if l.CPUQuota < BaselineCPUQuota {
+		l.CPUQuota = BaselineCPUQuota
+	}
+	io := make([]cgroup2.Entry, len(l.IO))
+	for i, entry := range l.IO {
+		if entry.Rate < BaselineIOBPS {
+			entry.Rate = BaselineIOBPS
+		}
+		io[i] = entry
+	}
+	l.IO = io
+	return l
+}
+
+func (l Limits) resources() cgroup2.Resources {
+	var res cgroup2.Resources
+	if !l.Skipped[resourceMemory] {
+		memoryMax := l.MemoryMax
+		res.Memory = &cgroup2.Memory{
+			Max: &memoryMax,
+		}
+		if l.MemoryHigh > 0 {
+			memoryHigh := l.MemoryHigh
+			res.Memory.High = &memoryHigh
+		}
+	}
+	if !l.Skipped[resourceCPU] && l.CPUWeight > 0 {
+		// cpu.max is left as is, the process can use the idle CPU
+		cpuWeight := l.CPUWeight
+		res.CPU = &cgroup2.CPU{Weight: &cpuWeight}
+	} else if !l.Skipped[resourceCPU] {
+		cpuQuota, cpuPeriod := l.CPUQuota, l.CPUPeriod
+		res.CPU = &cgroup2.CPU{
+			// Runs cpuQuota microseconds every cpuPeriod microseconds
+			Max: cgroup2.NewCPUMax(&cpuQuota, &cpuPeriod),
+		}
+	}
+	if !l.Skipped[resourceIO] {
+		res.IO = &cgroup2.IO{
+			Max: l.IO,
+		}
+	}
+	return res
+}
+
+// Structured log fields of the limits, the skipped resources are left out
+func limitAttrs(l Limits) []any {
+	var attrs []any
+	if !l.Skipped[resourceMemory] {
+		attrs = append(attrs, "mem_max", l.MemoryMax)
+		if l.MemoryHigh > 0 {
+			attrs = append(attrs, "mem_high", l.MemoryHigh)
+		}
+	}
+	if !l.Skipped[resourceCPU] {
+		attrs = append(attrs, "cpu_quota", l.CPUQuota, "cpu_period", l.CPUPeriod)
+		if l.CPUWeight > 0 {
+			attrs = append(attrs, "cpu_weight", l.CPUWeight)
+		}
+	}
+	if !l.Skipped[resourceIO] {
+		entries := make([]string, len(l.IO))
+		for i, entry := range l.IO {
+			entries[i] = entry.String()
+		}
+		attrs = append(attrs, "io_max", strings.Join(entries, ", "))
+	}
+	return attrs
+}
+
+// Log how the limits decided by a shadow policy differ from the applied ones
+func logDivergence(appliedName string, applied Limits, shadowName string, shadow Limits) {
+	ioRates := func(entries []cgroup2.Entry) map[cgroup2.Entry]uint64 {
+		rates := make(map[cgroup2.Entry]uint64)
+		for _, e := range entries {
+			rate := e.Rate
+			e.Rate = 0
+			rates[e] = rate
+		}
+		return rates
+	}
+	appliedIO := ioRates(applied.IO)
+	shadowIO := ioRates(shadow.IO)
+
+	var ioDiff []string
+	for entry, rate := range shadowIO {
+		if appliedIO[entry] != rate {
+			ioDiff = append(ioDiff, formatIODiff(entry, appliedIO[entry], rate))
+		}
+	}
+	for entry, rate := range appliedIO {
+		if _, exists := shadowIO[entry]; !exists {
+			ioDiff = append(ioDiff, formatIODiff(entry, rate, 0))
+		}
+	}
+	sort.Strings(ioDiff)
+
+	log.Printf("Policy %s vs %s: memory.max %d vs %d (%+d), cpu quota %d vs %d (%+d), io %s\n",
+		shadowName, appliedName,
+		shadow.MemoryMax, applied.MemoryMax, shadow.MemoryMax-applied.MemoryMax,
+		shadow.CPUQuota, applied.CPUQuota, shadow.CPUQuota-applied.CPUQuota,
+		formatIODiffs(ioDiff))
+}
+
+func formatIODiff(entry cgroup2.Entry, applied, shadow uint64) string {
+	return fmt.Sprintf("%s %d:%d %d vs %d", entry.Type, entry.Major, entry.Minor, shadow, applied)
+}
+
+func formatIODiffs(diffs []string) string {
+	if len(diffs) == 0 {
+		return "identical"
+	}
+	return "[" + strings.Join(diffs, ", ") + "]"
+}
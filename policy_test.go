@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/containerd/cgroups/v3/cgroup2"
+	"testing"
+)
+
+func TestAtLeastBaseline(t *testing.T) {
+	limits := Limits{
+		MemoryMax:  1 << 20,
+		MemoryHigh: 2 << 20,
+		CPUQuota:   10,
+		CPUPeriod:  100000,
+		IO:         []cgroup2.Entry{{Major: 8, Minor: 0, Type: cgroup2.ReadBPS, Rate: 1024}, {Major: 8, Minor: 0, Type: cgroup2.WriteBPS, Rate: 1 << 30}},
+	}
+	raised := limits.atLeastBaseline()
+	if raised.MemoryMax != BaselineMemoryMax || raised.MemoryHigh != BaselineMemoryMax || raised.CPUQuota != BaselineCPUQuota {
+		t.Errorf("got %+v, want the baseline", raised)
+	}
+	if raised.IO[0].Rate != BaselineIOBPS || raised.IO[1].Rate != 1<<30 {
+		t.Errorf("got IO %+v, want only the read raised", raised.IO)
+	}
+	// A copy: the limits decided are left as is
+	if limits.IO[0].Rate != 1024 || limits.MemoryMax != 1<<20 {
+		t.Errorf("limits modified: %+v", limits)
+	}
+
+	// memory.high stays unset
+	if raised = (Limits{}).atLeastBaseline(); raised.MemoryHigh != 0 {
+		t.Errorf("memory.high set to %d", raised.MemoryHigh)
+	}
+}
+
+// Only the first limits are raised to the baseline, the next ones follow the usage
+func TestBaselineOnFirstTickOnly(t *testing.T) {
+	resetGlobals(t)
+	m := newFakeCgroup()
+	s := newTestScaler(m, fixedPolicy{Limits{MemoryMax: 1 << 20, CPUQuota: 10, CPUPeriod: 100000}})
+	for i := 0; i < 2; i++ {
+		if err := s.step(testSnapshot()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.updates) != 2 {
+		t.Fatalf("got %d updates, want 2", len(m.updates))
+	}
+	if first := m.updates[0]; *first.Memory.Max != BaselineMemoryMax || first.CPU.Max != "1000 100000" {
+		t.Errorf("first limits %d %q, want the baseline", *first.Memory.Max, first.CPU.Max)
+	}
+	if second := m.updates[1]; *second.Memory.Max != 1<<20 || second.CPU.Max != "10 100000" {
+		t.Errorf("second limits %d %q, want the decided ones", *second.Memory.Max, second.CPU.Max)
+	}
+}
+
+// Paused or held, the first limits are raised once they are applied
+func TestBaselineWhilePaused(t *testing.T) {
+	resetGlobals(t)
+	m := newFakeCgroup()
+	s := newTestScaler(m, fixedPolicy{Limits{MemoryMax: 1 << 20, CPUQuota: 10, CPUPeriod: 100000}})
+	state.paused = true
+	if err := s.step(testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	state.paused = false
+	if err := s.step(testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.updates) != 1 || *m.updates[0].Memory.Max != BaselineMemoryMax {
+		t.Errorf("got %+v, want the baseline once resumed", m.updates)
+	}
+}
+
+func TestSoften(t *testing.T) {
+	capacity := func(memory int64) Capacity { return Capacity{Memory: &memory} }
+	tests := []struct {
+		name       string
+		capacities []Capacity
+		high, max  int64
+	}{
+		{"gap", nil, 1000 << 20, 1100 << 20},
+		{"gap within the capacity", []Capacity{{}, capacity(1050 << 20)}, 1000 << 20, 1050 << 20},
+		{"capacity below the limit", []Capacity{capacity(900 << 20)}, 900 << 20, 900 << 20},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limits := Limits{MemoryMax: 1000 << 20}
+			limits.soften(test.capacities...)
+			if limits.MemoryHigh != test.high || limits.MemoryMax != test.max {
+				t.Errorf("got memory.high %d and memory.max %d, want %d and %d", limits.MemoryHigh, limits.MemoryMax, test.high, test.max)
+			}
+		})
+	}
+
+	limits := Limits{MemoryMax: 1000, Skipped: map[string]bool{resourceMemory: true}}
+	if limits.soften(); limits.MemoryHigh != 0 || limits.MemoryMax != 1000 {
+		t.Errorf("skipped memory softened: %+v", limits)
+	}
+}
+
+// The next decision starts from memory.high, so that the gap doesn't compound from tick to tick
+func TestSoftMemoryStep(t *testing.T) {
+	resetGlobals(t)
+	cfg.softMemory = true
+	m := newFakeCgroup()
+	var decidedFrom []int64
+	s := newTestScaler(m, policyFunc(func(snapshot Snapshot) Limits {
+		decidedFrom = append(decidedFrom, snapshot.Memory.cgLimit)
+		return Limits{MemoryMax: 512 << 20, CPUQuota: 50000, CPUPeriod: 100000}
+	}))
+	for i := 0; i < 2; i++ {
+		if err := s.step(testSnapshot()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.updates) != 2 {
+		t.Fatalf("got %d updates, want 2", len(m.updates))
+	}
+	memory := m.updates[1].Memory
+	if memory.High == nil || *memory.High != 512<<20 || *memory.Max != 512<<20+512<<20/10 {
+		t.Errorf("got memory.high %v and memory.max %d, want %d and 10%% above", memory.High, *memory.Max, 512<<20)
+	}
+	if decidedFrom[1] != 512<<20 {
+		t.Errorf("second decision from a limit of %d, want memory.high %d", decidedFrom[1], 512<<20)
+	}
+}
+
+// Policy deciding with a function, to look at the snapshots
+type policyFunc func(Snapshot) Limits
+
+func (policyFunc) Name() string { return "func" }
+
+func (f policyFunc) Decide(s Snapshot) Limits { return f(s) }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Fraction of memory.high removed each tick while there is no pressure
+	PSIMemoryStepDown = 0.02
+	// Fraction of memory.high added each tick while the pressure is above target
+	PSIMemoryBackoff = 0.1
+)
+
+// Read the "some avg10" value of a pressure file (percentage of time stalled over the last 10s)
+func readPressureAvg10(path string) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	// Format: some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		if !strings.HasPrefix(fields[1], "avg10=") {
+			break
+		}
+		return strconv.ParseFloat(strings.TrimPrefix(fields[1], "avg10="), 64)
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no avg10 in %s", path)
+}
+
+// Drive memory.high so that the memory pressure of the cgroup stays below a target:
+// memory.high is lowered step by step until pressure appears, then backs off
+// This finds the smallest memory.high that doesn't stall the process
+type psiMemoryController struct {
+	target float64 // Max "some avg10" pressure, in percent
+	high   int64   // Last memory.high, 0 before the first tick
+}
+
+// Compute the next memory.high, never above the ceiling (the memory.max decided by the policy) nor
+// below the floor, so that it doesn't decay while the process is idle
+func (c *psiMemoryController) next(pressure float64, usage, floor, ceiling int64) int64 {
+	if c.high == 0 {
+		c.high = ceiling
+	}
+
+	if pressure > c.target {
+		// Stalling: give memory back
+		c.high += int64(float64(c.high) * PSIMemoryBackoff)
+		// Reclaim should not start right away again
+		if c.high < usage {
+			c.high = usage
+		}
+	} else {
+		// No stall: probe for a lower limit
+		c.high -= int64(float64(c.high) * PSIMemoryStepDown)
+	}
+
+	if c.high < floor {
+		c.high = floor
+	}
+	if c.high > ceiling {
+		c.high = ceiling
+	}
+	return c.high
+}
+
+func memoryPressurePath() string {
+	return filepath.Join(cgroupPath, "memory.pressure")
+}
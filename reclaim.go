@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Proactively reclaim memory of the cgroup by writing to memory.reclaim
+// The kernel returns EAGAIN when it could not reclaim the requested amount
+func reclaimMemory(bytes int64) error {
+	return os.WriteFile(filepath.Join(cgroupPath, "memory.reclaim"), []byte(strconv.FormatInt(bytes, 10)), 0)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/containerd/cgroups/v3/cgroup2"
+	"google.golang.org/protobuf/encoding/protowire"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Timeout of a push to the remote-write endpoint
+	RemoteWriteTimeout = 10 * time.Second
+	// Samples kept while the endpoint fails, the oldest are dropped beyond
+	MaxRemoteWritePending = 100000
+)
+
+type remoteWriteLabel struct {
+	name, value string
+}
+
+type remoteWriteSample struct {
+	name      string
+	labels    []remoteWriteLabel // Sorted by name, including __name__
+	value     float64
+	timestamp int64 // ms
+}
+
+// Pushes the decisions of the control loop to a Prometheus remote-write endpoint, for short-lived
+// jobs that would finish before being scraped
+type remoteWriter struct {
+	url     string
+	client  *http.Client
+	labels  []remoteWriteLabel // Common to all series
+	mu      sync.Mutex
+	pending []remoteWriteSample
+	stop    chan struct{}
+	done    chan struct{}
+	warned  bool // Whether the current outage has been reported
+}
+
+// Pushes to the remote-write endpoint, nil without -remote-write-url
+var remoteWrite *remoteWriter
+
+func newRemoteWriter(url string, interval time.Duration) *remoteWriter {
+	w := &remoteWriter{
+		url:    url,
+		client: &http.Client{Timeout: RemoteWriteTimeout},
+		labels: append([]remoteWriteLabel{{"job", "process-scaler"}}, processLabels()...),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.flush()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// Labels identifying the process in all the series: its PID and the -labels
+func processLabels() []remoteWriteLabel {
+	labels := []remoteWriteLabel{{"pid", strconv.Itoa(state.pid)}}
+	for key, value := range cfg.labels {
+		labels = append(labels, remoteWriteLabel{metricLabelName(key), value})
+	}
+	return labels
+}
+
+// Prometheus label names only allow [a-zA-Z0-9_], and can't start with a digit
+func metricLabelName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+func (w *remoteWriter) add(at time.Time, name string, value float64, labels ...remoteWriteLabel) {
+	all := append([]remoteWriteLabel{{"__name__", name}}, w.labels...)
+	all = append(all, labels...)
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	w.pending = append(w.pending, remoteWriteSample{name: name, labels: all, value: value, timestamp: at.UnixMilli()})
+}
+
+// Receives the series of the metrics
+type addSeries func(name string, value float64, labels ...remoteWriteLabel)
+
+// Series of a decision, pushed by the remote write and served by the metrics endpoint
+func decisionSeries(entry HistoryEntry, add addSeries) {
+	add("process_scaler_memory_usage_bytes", float64(entry.Usage.MemoryBytes))
+	add("process_scaler_memory_limit_bytes", float64(entry.Limits.MemoryMax))
+	add("process_scaler_cpu_usage_cores", entry.Usage.CPUCores)
+	if entry.Limits.CPUPeriod > 0 {
+		add("process_scaler_cpu_quota_ratio", float64(entry.Limits.CPUQuota)/float64(entry.Limits.CPUPeriod))
+		add("process_scaler_cpu_quota_microseconds", float64(entry.Limits.CPUQuota))
+		add("process_scaler_cpu_period_microseconds", float64(entry.Limits.CPUPeriod))
+	}
+	for _, io := range entry.Usage.IO {
+		device := remoteWriteLabel{"device", io.Device}
+		add("process_scaler_io_usage_bytes_per_second", io.ReadBPS, device, remoteWriteLabel{"direction", "read"})
+		add("process_scaler_io_usage_bytes_per_second", io.WriteBPS, device, remoteWriteLabel{"direction", "write"})
+	}
+	for _, io := range entry.Limits.IO {
+		direction := "read"
+		if io.Type == string(cgroup2.WriteBPS) {
+			direction = "write"
+		}
+		add("process_scaler_io_limit_bytes_per_second", float64(io.Rate),
+			remoteWriteLabel{"device", io.Device}, remoteWriteLabel{"direction", direction})
+	}
+	applied := 0.0
+	if entry.Applied {
+		applied = 1
+	}
+	add("process_scaler_limits_applied", applied)
+}
+
+// Series of the max throughput of the benchmarked devices
+func benchmarkSeries(add addSeries) {
+	for kname, device := range lsblk {
+		benchmark, benchmarked := getBenchmark(kname)
+		if !benchmarked || !benchmark.trusted() {
+			continue
+		}
+		labels := []remoteWriteLabel{{"device", device.MajMin}, {"kname", kname}}
+		add("process_scaler_io_benchmark_bytes_per_second", float64(benchmark.read),
+			append(labels, remoteWriteLabel{"direction", "read"})...)
+		if write, tested := benchmark.writeCap(); tested {
+			add("process_scaler_io_benchmark_bytes_per_second", float64(write),
+				append(labels, remoteWriteLabel{"direction", "write"})...)
+		}
+	}
+}
+
+// Queue the samples of a decision
+func (w *remoteWriter) record(entry HistoryEntry) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	decisionSeries(entry, func(name string, value float64, labels ...remoteWriteLabel) {
+		w.add(entry.Time, name, value, labels...)
+	})
+	if excess := len(w.pending) - MaxRemoteWritePending; excess > 0 {
+		w.pending = append(w.pending[:0], w.pending[excess:]...)
+	}
+}
+
+// Queue the max throughput of the benchmarked devices
+func (w *remoteWriter) recordBenchmarks(at time.Time) {
+	benchmarkSeries(func(name string, value float64, labels ...remoteWriteLabel) {
+		w.add(at, name, value, labels...)
+	})
+}
+
+// Push the queued samples, they are kept for the next flush if the push fails
+func (w *remoteWriter) flush() {
+	w.mu.Lock()
+	w.recordBenchmarks(time.Now())
+	samples := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+	if len(samples) == 0 {
+		return
+	}
+
+	err := w.push(samples)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err != nil {
+		if !w.warned {
+			w.warned = true
+			log.Printf("Warning: could not push metrics to %s, retrying: %s\n", w.url, err)
+		}
+		// Benchmarks are recorded again on each flush
+		kept := samples[:0]
+		for _, sample := range samples {
+			if sample.name != "process_scaler_io_benchmark_bytes_per_second" {
+				kept = append(kept, sample)
+			}
+		}
+		w.pending = append(kept, w.pending...)
+		if excess := len(w.pending) - MaxRemoteWritePending; excess > 0 {
+			w.pending = w.pending[excess:]
+		}
+		return
+	}
+	if w.warned {
+		w.warned = false
+		log.Printf("Metrics pushed to %s again\n", w.url)
+	}
+}
+
+func (w *remoteWriter) push(samples []remoteWriteSample) error {
+	body := snappyEncode(encodeWriteRequest(samples))
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("remote-write endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Stop the periodic pushes and push what is left
+func (w *remoteWriter) close() {
+	close(w.stop)
+	<-w.done
+	w.flush()
+}
+
+// Encode a prometheus.WriteRequest: each sample is a time series of one sample
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(samples []remoteWriteSample) []byte {
+	var request []byte
+	for _, sample := range samples {
+		var series []byte
+		for _, label := range sample.labels {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label.name)
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label.value)
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, l)
+		}
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(sample.value))
+		s = protowire.AppendTag(s, 2, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(sample.timestamp))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, s)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+	}
+	return request
+}
+
+// Encode in the snappy block format, which remote-write requires, with literals only: valid for
+// any decoder, without compression, which doesn't matter for the size of a batch
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		chunk := src
+		if len(chunk) > 1<<16 {
+			chunk = chunk[:1<<16]
+		}
+		src = src[len(chunk):]
+
+		// Literal tag: length-1 in the tag byte below 60, otherwise in the next 1 or 2 bytes
+		n := len(chunk) - 1
+		switch {
+		case n < 60:
+			dst = append(dst, byte(n<<2))
+		case n < 1<<8:
+			dst = append(dst, 60<<2, byte(n))
+		default:
+			dst = append(dst, 61<<2, byte(n), byte(n>>8))
+		}
+		dst = append(dst, chunk...)
+	}
+	return dst
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/mem"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stats of the whole system, sampled once by the daemon for all its jobs
+type SystemStats struct {
+	SampledAt time.Time                      `json:"sampledAt"`
+	CPU       []cpu.TimesStat                `json:"cpu"` // Of each core
+	IO        map[string]disk.IOCountersStat `json:"io"`
+	Memory    *mem.VirtualMemoryStat         `json:"memory"`
+}
+
+func sampleSystem() (SystemStats, error) {
+	stats := SystemStats{SampledAt: time.Now()}
+	var err error
+	if stats.CPU, err = cpu.Times(true); err != nil {
+		return stats, err
+	}
+	if stats.IO, err = disk.IOCounters(); err != nil {
+		return stats, err
+	}
+	stats.Memory, err = mem.VirtualMemory()
+	return stats, err
+}
+
+// Where the control loop reads the stats of the system from: /proc, or the samples of the daemon for
+// its jobs, so that the jobs don't all read the same files each tick
+type systemSource interface {
+	CPUTimes(perCPU bool) ([]cpu.TimesStat, error)
+	IOCounters() (map[string]disk.IOCountersStat, error)
+	VirtualMemory() (*mem.VirtualMemoryStat, error)
+}
+
+type localSystem struct{}
+
+func (localSystem) CPUTimes(perCPU bool) ([]cpu.TimesStat, error) { return cpu.Times(perCPU) }
+
+func (localSystem) IOCounters() (map[string]disk.IOCountersStat, error) { return disk.IOCounters() }
+
+func (localSystem) VirtualMemory() (*mem.VirtualMemoryStat, error) { return mem.VirtualMemory() }
+
+var system systemSource = localSystem{}
+
+// Samples of the daemon, received on a pipe: they are read as they arrive, and the control loop
+// ticks on them (see Tick), so that the stats of the cgroup are read right after the ones of the system
+// Once the daemon is gone, the stats are read from /proc again and the loop ticks on its own
+type sharedSystem struct {
+	mu      sync.Mutex
+	last    *SystemStats
+	arrived chan struct{} // Closed and replaced when a sample arrives
+	closed  bool
+}
+
+func newSharedSystem(feed io.Reader) *sharedSystem {
+	s := &sharedSystem{arrived: make(chan struct{})}
+	go s.receive(feed)
+	return s
+}
+
+// One JSON sample per line
+func (s *sharedSystem) receive(feed io.Reader) {
+	scanner := bufio.NewScanner(feed)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var sample SystemStats
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			log.Printf("Warning: invalid system stats from the daemon: %s\n", err)
+			continue
+		}
+		s.mu.Lock()
+		s.last = &sample
+		close(s.arrived)
+		s.arrived = make(chan struct{})
+		s.mu.Unlock()
+	}
+	log.Println("Warning: the daemon no longer samples the system stats, reading them locally")
+	s.mu.Lock()
+	s.closed = true
+	close(s.arrived)
+	s.mu.Unlock()
+}
+
+// Last sample, nil before the first one and once the daemon is gone
+func (s *sharedSystem) sample() (*SystemStats, <-chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, nil, true
+	}
+	return s.last, s.arrived, false
+}
+
+func (s *sharedSystem) CPUTimes(perCPU bool) ([]cpu.TimesStat, error) {
+	sample, _, _ := s.sample()
+	if sample == nil {
+		return localSystem{}.CPUTimes(perCPU)
+	}
+	if perCPU {
+		return append([]cpu.TimesStat(nil), sample.CPU...), nil
+	}
+	return []cpu.TimesStat{sumCPUTimes("cpu-total", sample.CPU)}, nil
+}
+
+func (s *sharedSystem) IOCounters() (map[string]disk.IOCountersStat, error) {
+	sample, _, _ := s.sample()
+	if sample == nil {
+		return localSystem{}.IOCounters()
+	}
+	counters := make(map[string]disk.IOCountersStat, len(sample.IO))
+	for name, counter := range sample.IO {
+		counters[name] = counter
+	}
+	return counters, nil
+}
+
+func (s *sharedSystem) VirtualMemory() (*mem.VirtualMemoryStat, error) {
+	sample, _, _ := s.sample()
+	if sample == nil || sample.Memory == nil {
+		return localSystem{}.VirtualMemory()
+	}
+	memory := *sample.Memory
+	return &memory, nil
+}
+
+// Clock of the jobs of the daemon: the ticks follow the samples, at least d apart
+type sampledClock struct {
+	realClock
+	system *sharedSystem
+}
+
+// Wait for the first sample after d
+func (c sampledClock) Sleep(d time.Duration) {
+	deadline := time.Now().Add(d)
+	time.Sleep(d)
+	for {
+		sample, arrived, closed := c.system.sample()
+		if closed || (sample != nil && !sample.SampledAt.Before(deadline)) {
+			return
+		}
+		<-arrived
+	}
+}
+
+func (c sampledClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	ticks := make(chan time.Time, 1)
+	done := make(chan struct{})
+	go func() {
+		// Like a time.Ticker, the first tick is d after the start
+		last := time.Now()
+		for {
+			sample, arrived, closed := c.system.sample()
+			if closed {
+				// The daemon is gone, tick on our own
+				ticker := time.NewTicker(d)
+				defer ticker.Stop()
+				for {
+					select {
+					case t := <-ticker.C:
+						ticks <- t
+					case <-done:
+						return
+					}
+				}
+			}
+			// Samples come a bit less than d apart half of the time
+			if sample != nil && sample.SampledAt.Sub(last) >= d*9/10 {
+				last = sample.SampledAt
+				select {
+				case ticks <- sample.SampledAt:
+				default:
+					// The loop is late, like a time.Ticker the tick is dropped
+				}
+			}
+			select {
+			case <-arrived:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return ticks, func() { once.Do(func() { close(done) }) }
+}
+
+// With -shared-stats-fd, read the stats of the system from the samples of the daemon
+func useSharedStats(fd int) {
+	shared := newSharedSystem(os.NewFile(uintptr(fd), "shared-stats"))
+	system = shared
+	clock = sampledClock{system: shared}
+}
+
+// Samples the stats of the system each interval and sends them to the jobs of the daemon
+type systemSampler struct {
+	mu    sync.Mutex
+	feeds map[string]chan []byte // By job, holding the last sample not written yet
+}
+
+func newSystemSampler() *systemSampler {
+	return &systemSampler{feeds: make(map[string]chan []byte)}
+}
+
+func (s *systemSampler) run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		sample, err := sampleSystem()
+		if err != nil {
+			log.Printf("Warning: could not sample the system stats: %s\n", err)
+			continue
+		}
+		line, err := json.Marshal(sample)
+		if err != nil {
+			continue
+		}
+		line = append(line, '\n')
+
+		s.mu.Lock()
+		for _, feed := range s.feeds {
+			// A job that hasn't read the previous sample only gets the last one
+			select {
+			case <-feed:
+			default:
+			}
+			feed <- line
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Send the samples to a job until it exits, the write end of its pipe is closed then
+func (s *systemSampler) subscribe(id string, pipe *os.File) {
+	feed := make(chan []byte, 1)
+	s.mu.Lock()
+	s.feeds[id] = feed
+	s.mu.Unlock()
+	go func() {
+		defer pipe.Close()
+		for line := range feed {
+			if _, err := pipe.Write(line); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (s *systemSampler) unsubscribe(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if feed, exists := s.feeds[id]; exists {
+		close(feed)
+		delete(s.feeds, id)
+	}
+}
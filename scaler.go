@@ -0,0 +1,641 @@
+package main
+
+import (
+	"fmt"
+	"github.com/containerd/cgroups/v3/cgroup2/stats"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scaler runs the control loop of a cgroup: each Step measures the resources usage,
+// decides the new limits with the policy and applies them
+type Scaler struct {
+	mu        sync.Mutex
+	cgManager cgroupManager
+	policy    Policy
+	shadows   []Policy
+
+	lastLimits    Limits
+	lastApplied   bool
+	lastRationale string
+	// Why each limit has its value after the last step
+	lastConstraints []LimitConstraint
+	// Whether limits have been applied since the scaler started, the first ones are raised to the baseline
+	appliedOnce bool
+
+	warnedMissing map[string]bool // Resources whose missing stats have already been reported
+	throttled     bool            // Whether the CPU quota was heavily throttling the process
+	idle          bool            // Whether the process was idle, its limits are then held
+	window        string          // Active schedule window
+	psiMemory     *psiMemoryController
+	ioLatency     *ioLatencyController
+	ioStrategies  map[[2]int64]ioStrategy // Strategy of each disk, by major and minor numbers
+	cpuBurst      int64                   // Last cpu.max.burst written, -1 before the first one
+	stateSavedAt  time.Time               // Last save of -state-file
+	gpu           *gpuController
+	// Consecutive ticks whose limits could not be applied
+	updateFailures int
+
+	capacity     CapacityProvider
+	lastCapacity Capacity // Used while the provider fails
+}
+
+// Internal state of the Scaler after its last step
+type ScalerState struct {
+	CPUTimes     []cpu.TimesStat                // Last system CPU times
+	CgCPUTime    uint64                         // Last cgroup CPU time (µs)
+	IOCounters   map[string]disk.IOCountersStat // Last system IO counters
+	CgIOCounters []*stats.IOEntry               // Last cgroup IO counters
+	Limits       Limits                         // Last decided limits
+	Applied      bool                           // Whether the last limits were applied (false when paused)
+	Rationale    string                         // Why the last limits were decided
+	Constraints  []LimitConstraint              // Constraint binding each of the last limits
+}
+
+func NewScaler(cgManager cgroupManager, policy Policy, shadows []Policy) *Scaler {
+	initCPUTimes(cgManager)
+	initIOCounters(cgManager)
+
+	s := &Scaler{
+		cgManager: cgManager,
+		policy:    policy,
+		shadows:   shadows,
+
+		warnedMissing: make(map[string]bool),
+		capacity:      localCapacity{},
+		cpuBurst:      -1,
+	}
+	if cfg.capacityEndpoint != "" {
+		s.capacity = newHTTPCapacity(cfg.capacityEndpoint)
+	}
+	if cfg.memoryPolicy == "psi" {
+		s.psiMemory = &psiMemoryController{target: cfg.psiMemoryTarget}
+	}
+	if cfg.ioMode == "latency" {
+		s.ioLatency = newIOLatencyController(cfg.ioLatencyTarget)
+	} else {
+		s.ioStrategies = ioStrategies(cfg.ioStrategy)
+	}
+	if cfg.gpu {
+		s.gpu = newGPUController()
+	}
+	return s
+}
+
+// Run one iteration of the control loop
+// A failed measurement, usually transient (e.g. while reading /proc), skips the iteration
+// An error is returned once the limits could not be applied MaxUpdateFailures times in a row
+func (s *Scaler) Step() error {
+	snapshot, err := s.measure()
+	if err != nil {
+		log.Printf("Warning: could not read the cgroup stats, limits left unchanged: %s\n", err)
+		return nil
+	}
+	err = s.step(snapshot)
+	s.saveState(false)
+	return err
+}
+
+// Measure n times, interval apart, and run the first iteration on the average of the measurements,
+// so that the first limits are less influenced by the noise of the startup of the process
+func (s *Scaler) Warmup(n int, interval time.Duration) error {
+	samples := make([]Snapshot, 0, n)
+	for i := 0; i < n; i++ {
+		clock.Sleep(interval)
+		snapshot, err := s.measure()
+		if err != nil {
+			log.Printf("Warning: could not read the cgroup stats, measurement skipped: %s\n", err)
+			continue
+		}
+		samples = append(samples, snapshot)
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+	return s.step(averageSnapshots(samples))
+}
+
+// Measure the resources usage since the last measurement
+func (s *Scaler) measure() (Snapshot, error) {
+	cgStats, err := s.cgManager.Stat()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if resourceBudget != nil {
+		resourceBudget.update(cgStats)
+	}
+
+	snapshot := Snapshot{Skipped: make(map[string]bool)}
+	// A controller that isn't fully enabled has no stats, its limits are left unchanged for this tick
+	if cfg.unmanaged[resourceMemory] {
+		// Left out of -controllers, neither measured nor limited
+		snapshot.Skipped[resourceMemory] = true
+	} else if memStat := cgStats.GetMemory(); memStat != nil {
+		if snapshot.Memory, err = sampleMemory(memStat); err != nil {
+			s.skipFailed(snapshot, resourceMemory, err)
+		}
+	} else {
+		s.skipMissing(snapshot, resourceMemory)
+	}
+	if cfg.unmanaged[resourceCPU] {
+		snapshot.Skipped[resourceCPU] = true
+	} else if cpuStat := cgStats.GetCPU(); cpuStat != nil {
+		var ok bool
+		if snapshot.CPU, ok, err = sampleCPU(cpuStat); err != nil {
+			s.skipFailed(snapshot, resourceCPU, err)
+		} else if !ok {
+			// Left unchanged for this tick
+			snapshot.Skipped[resourceCPU] = true
+		}
+	} else {
+		s.skipMissing(snapshot, resourceCPU)
+	}
+	if len(lsblk) == 0 {
+		// No disk (or io left out of -controllers), the io controller is not enabled
+		snapshot.Skipped[resourceIO] = true
+	} else if ioStat := cgStats.GetIo(); ioStat != nil && cfg.ioAccounting != "system" {
+		if snapshot.IO, err = sampleIO(ioStat); err != nil {
+			s.skipFailed(snapshot, resourceIO, err)
+		}
+	} else if cfg.ioAccounting != "cgroup" {
+		if ioStat == nil && !s.warnedMissing["io.stat"] {
+			s.warnedMissing["io.stat"] = true
+			softFail("no io stats for the cgroup, all the IO of each disk is attributed to the process")
+		}
+		if snapshot.IO, err = sampleIO(nil); err != nil {
+			s.skipFailed(snapshot, resourceIO, err)
+		}
+	} else {
+		s.skipMissing(snapshot, resourceIO)
+	}
+	return snapshot, nil
+}
+
+// Decide and apply the limits from a measurement
+// A failed update is retried on the next tick, an error is returned once it failed MaxUpdateFailures
+// times in a row
+func (s *Scaler) step(snapshot Snapshot) (failure error) {
+	var err error
+
+	state.Lock()
+	margins := state.margins
+	paused := state.paused
+	pausedResources := make(map[string]bool)
+	for resource, p := range state.pausedResources {
+		pausedResources[resource] = p
+	}
+	state.Unlock()
+
+	var overrides scheduleOverrides
+	if cfg.schedule != nil {
+		overrides = cfg.schedule.overrides(clock.Now())
+		if overrides.window != s.window {
+			if overrides.window == "" {
+				log.Printf("Schedule window %s ended\n", s.window)
+			} else {
+				log.Printf("Schedule window %s started\n", overrides.window)
+			}
+			s.window = overrides.window
+		}
+		if overrides.margin != nil {
+			margins = uniformMargins(*overrides.margin)
+		}
+	}
+
+	snapshot.Margins = margins
+	snapshot.Reserve = cfg.reserve
+	snapshot.IOMarginOfAvailable = cfg.ioMarginBase == "available"
+
+	if capacity, err := s.capacity.Capacity(); err != nil {
+		// Report each outage once, the last capacity is kept meanwhile
+		if !s.warnedMissing["capacity"] {
+			s.warnedMissing["capacity"] = true
+			softFail("could not get the capacity, keeping the last one: %s", err)
+		}
+	} else {
+		if s.warnedMissing["capacity"] {
+			s.warnedMissing["capacity"] = false
+			log.Println("Capacity available again")
+		}
+		s.lastCapacity = capacity
+	}
+
+	// Nothing is applied in a dry run, the memory limit evolves from the one that would have been
+	if cfg.dryRun && s.appliedOnce && !snapshot.Skipped[resourceMemory] {
+		snapshot.Memory.cgLimit = s.lastLimits.MemoryMax
+	}
+	// With -soft-memory, the limit evolves from memory.high, memory.max is only the ceiling above it
+	if cfg.softMemory && s.appliedOnce && !snapshot.Skipped[resourceMemory] && s.lastLimits.MemoryHigh > 0 {
+		snapshot.Memory.cgLimit = s.lastLimits.MemoryHigh
+	}
+
+	if !snapshot.Skipped[resourceCPU] {
+		s.reportThrottling(snapshot.CPU)
+	}
+	recordUsage(snapshot)
+	// Limits computed while the process is idle only follow the noise of the rest of the system
+	held := s.detectIdle(snapshot) && s.appliedOnce
+
+	limits := s.policy.Decide(snapshot)
+	trace := newLimitsTrace(limits)
+	overrides.apply(&limits)
+	trace.stage("schedule", limits)
+	// The hard capacity and ceilings still apply over the floors
+	cfg.floors.apply(&limits, snapshot.CPU.numCores)
+	trace.stage("floor", limits)
+	s.lastCapacity.apply(&limits, snapshot.CPU.numCores)
+	trace.stage("capacity", limits)
+	cfg.ceilings.apply(&limits, snapshot.CPU.numCores)
+	trace.stage("ceiling", limits)
+	if resourceBudget != nil {
+		resourceBudget.apply(&limits)
+		trace.stage("budget", limits)
+		// Frozen or stopping, the limits no longer matter
+		if !cfg.dryRun {
+			held = held || resourceBudget.enforce(s.cgManager)
+		}
+	}
+	if cfg.softMemory {
+		limits.soften(s.lastCapacity, cfg.ceilings)
+		trace.stage("soft-memory", limits)
+	}
+	if s.psiMemory != nil && !snapshot.Skipped[resourceMemory] {
+		if pressure, err := readPressureAvg10(memoryPressurePath()); err != nil {
+			if !s.warnedMissing["memory.pressure"] {
+				s.warnedMissing["memory.pressure"] = true
+				softFail("could not read the memory pressure, memory.high is not updated: %s", err)
+			}
+		} else {
+			// memory.max stays the hard ceiling, memory.high makes the kernel reclaim before it, and
+			// never below -min-memory nor the safe baseline
+			floor := int64(BaselineMemoryMax)
+			if int64(cfg.floors.memory) > floor {
+				floor = int64(cfg.floors.memory)
+			}
+			limits.MemoryHigh = s.psiMemory.next(pressure, snapshot.Memory.cgUsage, floor, limits.MemoryMax)
+		}
+	}
+	// io.latency targets replace the bandwidth limits
+	var ioLatencyTargets map[string]uint64
+	if s.ioLatency != nil {
+		limits.IO = nil
+		// The targets are left unchanged for this tick
+		if ioLatencyTargets, err = s.ioLatency.next(margins.IO); err != nil {
+			log.Printf("Warning: could not read the IO counters, io.latency targets not updated: %s\n", err)
+		}
+	}
+	// Compare with what the other policies would have decided, without applying it
+	for _, shadow := range s.shadows {
+		shadowLimits := shadow.Decide(snapshot)
+		overrides.apply(&shadowLimits)
+		cfg.floors.apply(&shadowLimits, snapshot.CPU.numCores)
+		s.lastCapacity.apply(&shadowLimits, snapshot.CPU.numCores)
+		cfg.ceilings.apply(&shadowLimits, snapshot.CPU.numCores)
+		logDivergence(s.policy.Name(), limits, shadow.Name(), shadowLimits)
+	}
+
+	if cfg.cpuBurst > 0 && !limits.Skipped[resourceCPU] {
+		limits.CPUBurst = getCPUBurst(snapshot.CPU, margins.CPU, cfg.cpuBurst, limits.CPUQuota)
+	}
+
+	if s.ioStrategies != nil && !snapshot.Skipped[resourceIO] {
+		limits.IO = translateIO(s.ioStrategies, limits.IO, snapshot.IO)
+	}
+
+	// The first deltas are measured over a process that may not have done any work yet
+	if !paused && !held && !s.appliedOnce {
+		limits = limits.atLeastBaseline()
+		trace.stage("baseline", limits)
+	}
+	applyCPUMode(&limits)
+	constraints := trace.constraints()
+
+	// Keep measuring while paused, but leave the current limits in place
+	res := limits.without(pausedResources).resources()
+	applied := !paused && !held && !cfg.dryRun
+	slog.Debug("Limits decided", append(limitAttrs(limits.without(pausedResources)), "applied", applied)...)
+	if cfg.dryRun && !paused && !held {
+		s.appliedOnce = true
+		slog.Info("Dry run, would apply", limitAttrs(limits.without(pausedResources))...)
+	}
+	if applied {
+		if cfg.aggressiveReclaim && res.Memory != nil {
+			s.reclaim(snapshot.Memory, limits.MemoryMax)
+		}
+		if s.gpu != nil && !pausedResources[resourceGPU] {
+			if _, err = s.gpu.next(margins.GPU); err == nil {
+				err = s.gpu.apply()
+			}
+			if err != nil && !s.warnedMissing[resourceGPU] {
+				s.warnedMissing[resourceGPU] = true
+				softFail("%s, GPU limits are not updated", err)
+			}
+		}
+		if s.ioLatency != nil && !pausedResources[resourceIO] {
+			if err = s.ioLatency.apply(ioLatencyTargets); err != nil && !s.warnedMissing["io.latency"] {
+				s.warnedMissing["io.latency"] = true
+				softFail("%s (the kernel may lack CONFIG_BLK_CGROUP_IOLATENCY)", err)
+			}
+		}
+		if s.ioStrategies != nil && !pausedResources[resourceIO] {
+			for _, strategy := range s.ioStrategies {
+				if err = strategy.apply(); err != nil && !s.warnedMissing["io.bfq.weight"] {
+					s.warnedMissing["io.bfq.weight"] = true
+					softFail("%s (the disk may not use the bfq scheduler)", err)
+				}
+			}
+		}
+		// The kernel rejects a burst above the quota: a lower burst is written before a lower quota,
+		// a higher one after a higher quota
+		burst := cfg.cpuBurst > 0 && res.CPU != nil
+		if burst && limits.CPUBurst < s.cpuBurst {
+			s.applyCPUBurst(limits.CPUBurst)
+		}
+		// Update
+		if err = s.cgManager.Update(&res); err != nil {
+			s.updateFailures++
+			err = newCgroupUpdateError(err)
+			log.Printf("Warning: %s, limits left unchanged (%d/%d)\n", err, s.updateFailures, MaxUpdateFailures)
+			if s.updateFailures >= MaxUpdateFailures {
+				failure = fmt.Errorf("limits not applied %d times in a row: %w", s.updateFailures, err)
+			}
+			applied = false
+		} else {
+			s.appliedOnce = true
+			s.updateFailures = 0
+			if burst && limits.CPUBurst != s.cpuBurst {
+				s.applyCPUBurst(limits.CPUBurst)
+			}
+			state.Lock()
+			// Resources that were not updated keep their previous limits
+			if res.Memory != nil {
+				state.limits.Memory = res.Memory
+			}
+			if res.CPU != nil {
+				state.limits.CPU = res.CPU
+			}
+			if res.IO != nil {
+				state.limits.IO = res.IO
+			}
+			state.updatedAt = clock.Now()
+			state.Unlock()
+		}
+	}
+
+	s.mu.Lock()
+	s.lastLimits = limits
+	s.lastApplied = applied
+	s.lastRationale = describeDecision(s.policy, snapshot, paused, pausedResources)
+	if held {
+		s.lastRationale += "; process idle, limits held"
+	}
+	if bound := describeConstraints(constraints); bound != "" {
+		s.lastRationale += "; " + bound
+	}
+	s.lastConstraints = constraints
+	rationale := s.lastRationale
+	s.mu.Unlock()
+
+	if decisions != nil || remoteWrite != nil || metrics != nil {
+		entry := newHistoryEntry(snapshot, limits, applied, rationale)
+		entry.Constraints = constraints
+		if decisions != nil {
+			decisions.add(entry)
+		}
+		if remoteWrite != nil {
+			remoteWrite.record(entry)
+		}
+		if metrics != nil {
+			metrics.record(entry)
+		}
+	}
+	return failure
+}
+
+// The containerd API doesn't support cpu.max.burst, write it directly
+func (s *Scaler) applyCPUBurst(burst int64) {
+	if err := os.WriteFile(filepath.Join(cgroupPath, "cpu.max.burst"), []byte(strconv.FormatInt(burst, 10)), 0); err != nil {
+		if !s.warnedMissing["cpu.max.burst"] {
+			s.warnedMissing["cpu.max.burst"] = true
+			softFail("could not set cpu.max.burst %d (requires Linux 5.14): %s", burst, err)
+		}
+		return
+	}
+	s.cpuBurst = burst
+}
+
+// Shrink the cgroup towards a lowered memory limit before applying it, rather than relying on
+// the reclaim triggered by memory.max, which OOM kills the process when it is not fast enough
+func (s *Scaler) reclaim(sample memorySample, memoryMax int64) {
+	if memoryMax >= sample.cgLimit || sample.cgUsage <= memoryMax {
+		return
+	}
+	if err := reclaimMemory(sample.cgUsage - memoryMax); err != nil && !s.warnedMissing["memory.reclaim"] {
+		// Usually EAGAIN: not everything could be reclaimed, memory.max reclaims the rest
+		s.warnedMissing["memory.reclaim"] = true
+		log.Printf("Warning: could not reclaim %d bytes: %s\n", sample.cgUsage-memoryMax, err)
+	}
+}
+
+// Whether the process is idle: it uses less CPU and IO than the -idle-* thresholds
+// Log when it becomes idle or active again
+func (s *Scaler) detectIdle(snapshot Snapshot) bool {
+	if cfg.idleCPUThreshold <= 0 || snapshot.Skipped[resourceCPU] || snapshot.CPU.total == 0 {
+		return false
+	}
+	idle := snapshot.CPU.cores() < cfg.idleCPUThreshold
+	for _, io := range snapshot.IO {
+		if io.cgRead >= float64(cfg.idleIOThreshold) || io.cgWrite >= float64(cfg.idleIOThreshold) {
+			idle = false
+		}
+	}
+	if idle != s.idle {
+		if idle {
+			log.Println("Process idle, holding the limits")
+		} else {
+			log.Println("Process active again, scaling resumed")
+		}
+		s.idle = idle
+	}
+	return idle
+}
+
+// Log when the process starts or stops being heavily throttled by its CPU quota
+func (s *Scaler) reportThrottling(sample cpuSample) {
+	throttled := sample.throttledRatio() > HeavyThrottlingRatio
+	if throttled == s.throttled {
+		return
+	}
+	s.throttled = throttled
+	if throttled {
+		log.Printf("CPU quota throttling the process in %d/%d periods (%dµs)\n", sample.throttled, sample.periods, sample.throttledUsec)
+	} else {
+		log.Println("CPU quota no longer throttling the process heavily")
+	}
+}
+
+// Average of measurements: memory is averaged, CPU times are added up (the quota is a ratio of
+// the CPU time of the cgroup to the elapsed CPU time) and IO rates are averaged per device
+func averageSnapshots(samples []Snapshot) Snapshot {
+	avg := Snapshot{Skipped: make(map[string]bool)}
+	if len(samples) == 0 {
+		return avg
+	}
+	n := float64(len(samples))
+
+	type ioSum struct {
+		sample ioSample
+		count  float64
+	}
+	ioSums := make(map[[2]int64]*ioSum)
+	var ioOrder [][2]int64
+	idleCores := 0
+	for _, sample := range samples {
+		for resource, skip := range sample.Skipped {
+			if skip {
+				avg.Skipped[resource] = true
+			}
+		}
+
+		avg.Memory.cgUsage += sample.Memory.cgUsage / int64(len(samples))
+		avg.Memory.cgLimit = sample.Memory.cgLimit
+		avg.Memory.available += sample.Memory.available / n
+		avg.Memory.total += sample.Memory.total / n
+
+		avg.CPU.cg += sample.CPU.cg
+		avg.CPU.total += sample.CPU.total
+		avg.CPU.available += sample.CPU.available
+		avg.CPU.periods += sample.CPU.periods
+		avg.CPU.throttled += sample.CPU.throttled
+		avg.CPU.throttledUsec += sample.CPU.throttledUsec
+		avg.CPU.numCores = sample.CPU.numCores
+		idleCores += sample.CPU.idleCores
+
+		for _, io := range sample.IO {
+			device := [2]int64{io.major, io.minor}
+			sum, exists := ioSums[device]
+			if !exists {
+				sum = &ioSum{sample: ioSample{major: io.major, minor: io.minor}}
+				ioSums[device] = sum
+				ioOrder = append(ioOrder, device)
+			}
+			sum.sample.cgRead += io.cgRead
+			sum.sample.maxRead = io.maxRead
+			sum.sample.availableRead += io.availableRead
+			sum.sample.cgWrite += io.cgWrite
+			sum.sample.maxWrite = io.maxWrite
+			sum.sample.availableWrite += io.availableWrite
+			sum.sample.readTested = io.readTested
+			sum.sample.writeTested = io.writeTested
+			sum.sample.latency += io.latency
+			sum.sample.saturated = sum.sample.saturated || io.saturated
+			sum.count++
+		}
+	}
+	// -1 when not measured
+	avg.CPU.idleCores = int(math.Floor(float64(idleCores) / n))
+
+	for _, device := range ioOrder {
+		sum := ioSums[device]
+		sum.sample.cgRead /= sum.count
+		sum.sample.availableRead /= sum.count
+		sum.sample.cgWrite /= sum.count
+		sum.sample.availableWrite /= sum.count
+		sum.sample.latency /= sum.count
+		avg.IO = append(avg.IO, sum.sample)
+	}
+	return avg
+}
+
+func (s *Scaler) skipMissing(snapshot Snapshot, resource string) {
+	snapshot.Skipped[resource] = true
+	if !s.warnedMissing[resource] {
+		s.warnedMissing[resource] = true
+		softFail("no %s stats for the cgroup, %s limits are not updated", resource, resource)
+	}
+}
+
+// A resource could not be measured, usually transiently: its limits are left unchanged for this tick
+func (s *Scaler) skipFailed(snapshot Snapshot, resource string, err error) {
+	snapshot.Skipped[resource] = true
+	log.Printf("Warning: could not measure the %s usage, %s limits not updated: %s\n", resource, resource, err)
+}
+
+func (s *Scaler) State() ScalerState {
+	s.mu.Lock()
+	result := ScalerState{
+		Limits:      s.lastLimits,
+		Applied:     s.lastApplied,
+		Rationale:   s.lastRationale,
+		Constraints: s.lastConstraints,
+	}
+	s.mu.Unlock()
+
+	lastCPUTimes.Lock()
+	result.CPUTimes = append([]cpu.TimesStat(nil), lastCPUTimes.system...)
+	result.CgCPUTime = lastCPUTimes.cg
+	lastCPUTimes.Unlock()
+
+	lastIOCounters.Lock()
+	result.IOCounters = make(map[string]disk.IOCountersStat, len(lastIOCounters.system))
+	for name, counter := range lastIOCounters.system {
+		result.IOCounters[name] = counter
+	}
+	result.CgIOCounters = append([]*stats.IOEntry(nil), lastIOCounters.cg...)
+	lastIOCounters.Unlock()
+
+	return result
+}
+
+// Explain the decision: for each resource, whether the headroom is above or below the margin
+func describeDecision(policy Policy, s Snapshot, paused bool, pausedResources map[string]bool) string {
+	direction := func(available, total, margin float64) string {
+		if available < total*margin {
+			return "below margin, tightening"
+		}
+		return "above margin, relaxing"
+	}
+
+	parts := []string{fmt.Sprintf("policy %s", policy.Name())}
+	if !s.Skipped[resourceMemory] {
+		parts = append(parts, fmt.Sprintf("memory available %.0f/%.0f %s", s.Memory.available, s.Memory.total, direction(s.Memory.available, s.Memory.total, s.Margins.Memory)))
+	}
+	if !s.Skipped[resourceCPU] {
+		parts = append(parts, fmt.Sprintf("cpu available %.0f/%.0fµs %s", s.CPU.available, s.CPU.total, direction(s.CPU.available, s.CPU.total, s.Margins.CPU)))
+		if s.CPU.throttled > 0 {
+			parts = append(parts, fmt.Sprintf("throttled in %d/%d periods (%dµs)", s.CPU.throttled, s.CPU.periods, s.CPU.throttledUsec))
+		}
+		if s.CPU.idleCores >= 0 {
+			parts = append(parts, fmt.Sprintf("%d/%d idle cores", s.CPU.idleCores, s.CPU.numCores))
+		}
+	}
+	for _, io := range s.IO {
+		if io.saturated {
+			parts = append(parts, fmt.Sprintf("io %d:%d latency %.1fms above threshold, tightening", io.major, io.minor, io.latency))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("io %d:%d read %s, write %s", io.major, io.minor,
+			direction(io.availableRead, io.maxRead, s.Margins.IO), direction(io.availableWrite, io.maxWrite, s.Margins.IO)))
+	}
+	for resource := range s.Skipped {
+		parts = append(parts, resource+" not measured")
+	}
+	for resource, p := range pausedResources {
+		if p {
+			parts = append(parts, resource+" paused")
+		}
+	}
+	if paused {
+		parts = append(parts, "paused, not applied")
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"github.com/containerd/cgroups/v3/cgroup2"
+	"github.com/containerd/cgroups/v3/cgroup2/stats"
+	"testing"
+	"time"
+)
+
+// Cgroup recording the limits written to it instead of writing them
+type fakeCgroup struct {
+	stats     *stats.Metrics
+	updates   []cgroup2.Resources
+	statErr   error // Returned by Stat
+	updateErr error // Returned by Update, nothing is recorded then
+	procs     []uint64
+}
+
+func newFakeCgroup() *fakeCgroup {
+	return &fakeCgroup{stats: &stats.Metrics{CPU: &stats.CPUStat{}, Memory: &stats.MemoryStat{}, Io: &stats.IOStat{}}}
+}
+
+func (m *fakeCgroup) Stat() (*stats.Metrics, error) {
+	if m.statErr != nil {
+		return nil, m.statErr
+	}
+	return m.stats, nil
+}
+
+func (m *fakeCgroup) Update(resources *cgroup2.Resources) error {
+	if m.updateErr != nil {
+		return m.updateErr
+	}
+	m.updates = append(m.updates, *resources)
+	return nil
+}
+
+func (m *fakeCgroup) AddProc(pid uint64) error {
+	m.procs = append(m.procs, pid)
+	return nil
+}
+
+func (m *fakeCgroup) Procs(bool) ([]uint64, error) { return m.procs, nil }
+
+func (m *fakeCgroup) ToggleControllers([]string, cgroup2.ControllerToggle) error { return nil }
+
+func (m *fakeCgroup) Freeze() error { return nil }
+
+func (m *fakeCgroup) Delete() error { return nil }
+
+func (m *fakeCgroup) DeleteSystemd() error { return nil }
+
+// Policy deciding the same limits whatever the usage
+type fixedPolicy struct {
+	limits Limits
+}
+
+func (fixedPolicy) Name() string { return "fixed" }
+
+func (p fixedPolicy) Decide(Snapshot) Limits { return p.limits }
+
+// Reset the configuration and the runtime state, they are restored once the test ends
+func resetGlobals(t *testing.T) {
+	savedCfg, savedClock, savedSystem := cfg, clock, system
+	cfg = config{}
+	state.Lock()
+	state.margins = uniformMargins(DefaultMargin)
+	state.paused = false
+	state.pausedResources = nil
+	state.limits = cgroup2.Resources{}
+	state.Unlock()
+	t.Cleanup(func() {
+		cfg, clock, system = savedCfg, savedClock, savedSystem
+	})
+}
+
+// Scaler of the fake cgroup, without measuring the system like NewScaler
+func newTestScaler(m cgroupManager, policy Policy) *Scaler {
+	return &Scaler{
+		cgManager:     m,
+		policy:        policy,
+		warnedMissing: make(map[string]bool),
+		capacity:      localCapacity{},
+		cpuBurst:      -1,
+	}
+}
+
+// A process using 1 of 4 cores and 256MiB of 8GiB
+func testSnapshot() Snapshot {
+	return Snapshot{
+		Memory:  memorySample{cgUsage: 256 << 20, cgLimit: 1 << 30, available: 4 << 30, total: 8 << 30},
+		CPU:     cpuSample{cg: 100000, total: 400000, available: 200000, idleCores: -1, numCores: 4},
+		Skipped: make(map[string]bool),
+	}
+}
+
+func TestScalerStep(t *testing.T) {
+	decided := Limits{MemoryMax: 512 << 20, CPUQuota: 50000, CPUPeriod: 100000}
+	tests := []struct {
+		name      string
+		setup     func()
+		limits    Limits
+		updated   bool
+		memoryMax int64          // 0 when memory is not updated
+		cpuMax    cgroup2.CPUMax // Empty when cpu.max is not updated
+		cpuWeight uint64         // 0 when cpu.weight is not updated
+	}{
+		{name: "applied", limits: decided, updated: true, memoryMax: 512 << 20, cpuMax: "50000 100000"},
+		{
+			name:      "first limits raised to the baseline",
+			limits:    Limits{MemoryMax: 1 << 20, CPUQuota: 10, CPUPeriod: 100000},
+			updated:   true,
+			memoryMax: BaselineMemoryMax,
+			cpuMax:    "1000 100000",
+		},
+		{
+			name:      "floors",
+			setup:     func() { cfg.floors = floors{memory: 1 << 30, cpu: cpuFloor{cores: 3}} },
+			limits:    decided,
+			updated:   true,
+			memoryMax: 1 << 30,
+			cpuMax:    "75000 100000",
+		},
+		{
+			name:      "ceilings",
+			setup:     func() { memory := int64(128 << 20); cfg.ceilings.Memory = &memory },
+			limits:    decided,
+			updated:   true,
+			memoryMax: 128 << 20,
+			cpuMax:    "50000 100000",
+		},
+		{name: "paused", setup: func() { state.paused = true }, limits: decided},
+		{
+			name:    "memory paused",
+			setup:   func() { state.pausedResources = map[string]bool{resourceMemory: true} },
+			limits:  decided,
+			updated: true,
+			cpuMax:  "50000 100000",
+		},
+		{
+			name:      "CPU paused",
+			setup:     func() { state.pausedResources = map[string]bool{resourceCPU: true} },
+			limits:    decided,
+			updated:   true,
+			memoryMax: 512 << 20,
+		},
+		{name: "dry run", setup: func() { cfg.dryRun = true }, limits: decided},
+		{
+			name:      "CPU weight",
+			setup:     func() { cfg.cpuMode = "weight" },
+			limits:    decided,
+			updated:   true,
+			memoryMax: 512 << 20,
+			cpuWeight: DefaultCPUWeight,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetGlobals(t)
+			if test.setup != nil {
+				test.setup()
+			}
+			m := newFakeCgroup()
+			s := newTestScaler(m, fixedPolicy{test.limits})
+			if err := s.step(testSnapshot()); err != nil {
+				t.Fatal(err)
+			}
+
+			if !test.updated {
+				if len(m.updates) != 0 {
+					t.Fatalf("limits written: %+v", m.updates)
+				}
+				if state.limits.Memory != nil || state.limits.CPU != nil {
+					t.Errorf("state updated: %+v", state.limits)
+				}
+				if s.State().Applied {
+					t.Error("limits reported as applied")
+				}
+				return
+			}
+			if len(m.updates) != 1 {
+				t.Fatalf("got %d updates, want 1", len(m.updates))
+			}
+			res := m.updates[0]
+			if test.memoryMax == 0 && res.Memory != nil {
+				t.Errorf("memory updated: %d", *res.Memory.Max)
+			} else if test.memoryMax != 0 && (res.Memory == nil || *res.Memory.Max != test.memoryMax) {
+				t.Errorf("memory.max %+v, want %d", res.Memory, test.memoryMax)
+			}
+			var cpuMax cgroup2.CPUMax
+			var cpuWeight uint64
+			if res.CPU != nil {
+				cpuMax = res.CPU.Max
+				if res.CPU.Weight != nil {
+					cpuWeight = *res.CPU.Weight
+				}
+			}
+			if cpuMax != test.cpuMax || cpuWeight != test.cpuWeight {
+				t.Errorf("cpu.max %q and cpu.weight %d, want %q and %d", cpuMax, cpuWeight, test.cpuMax, test.cpuWeight)
+			}
+			if state.limits.Memory != res.Memory || state.limits.CPU != res.CPU {
+				t.Errorf("state %+v, want the applied limits %+v", state.limits, res)
+			}
+			if !s.State().Applied {
+				t.Error("limits reported as not applied")
+			}
+		})
+	}
+}
+
+func TestScalerStepKeepsPausedLimits(t *testing.T) {
+	resetGlobals(t)
+	m := newFakeCgroup()
+	s := newTestScaler(m, fixedPolicy{Limits{MemoryMax: 512 << 20, CPUQuota: 50000, CPUPeriod: 100000}})
+	if err := s.step(testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	applied := state.limits.Memory
+
+	state.pausedResources = map[string]bool{resourceMemory: true}
+	s.policy = fixedPolicy{Limits{MemoryMax: 256 << 20, CPUQuota: 20000, CPUPeriod: 100000}}
+	if err := s.step(testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.updates) != 2 || m.updates[1].Memory != nil {
+		t.Fatalf("paused memory written: %+v", m.updates)
+	}
+	if state.limits.Memory != applied {
+		t.Errorf("memory limits of the state changed while paused: %+v", state.limits.Memory)
+	}
+	if state.limits.CPU.Max != "20000 100000" {
+		t.Errorf("cpu.max %q, want 20000 100000", state.limits.CPU.Max)
+	}
+}
+
+func TestScalerStepUpdateFailures(t *testing.T) {
+	resetGlobals(t)
+	m := newFakeCgroup()
+	m.updateErr = errors.New("device or resource busy")
+	s := newTestScaler(m, fixedPolicy{Limits{MemoryMax: 512 << 20, CPUQuota: 50000, CPUPeriod: 100000}})
+
+	// Retried on the next ticks, until too many failed in a row
+	for i := 1; i < MaxUpdateFailures; i++ {
+		if err := s.step(testSnapshot()); err != nil {
+			t.Fatalf("failure %d: %s", i, err)
+		}
+	}
+	m.updateErr = nil
+	if err := s.step(testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.updates) != 1 {
+		t.Fatalf("got %d updates, want 1", len(m.updates))
+	}
+
+	// A success resets the count
+	m.updateErr = errors.New("device or resource busy")
+	for i := 1; i < MaxUpdateFailures; i++ {
+		if err := s.step(testSnapshot()); err != nil {
+			t.Fatalf("failure %d after a success: %s", i, err)
+		}
+	}
+	err := s.step(testSnapshot())
+	var updateErr *CgroupUpdateError
+	if !errors.As(err, &updateErr) {
+		t.Fatalf("got %v after %d failures, want a CgroupUpdateError", err, MaxUpdateFailures)
+	}
+	if s.State().Applied {
+		t.Error("failed limits reported as applied")
+	}
+}
+
+// A tick whose stats could not be read is skipped, the next one measures and applies the limits
+func TestStatFailureSkipsTheTick(t *testing.T) {
+	c, _ := useFakeTime(t)
+	m := newFakeCgroup()
+	initCPUTimes(m)
+	initIOCounters(m)
+	s := newTestScaler(m, greedyPolicy{})
+
+	c.advance(time.Second)
+	m.statErr = errors.New("no such device")
+	if err := s.Step(); err != nil {
+		t.Fatalf("the failed tick ended the loop: %s", err)
+	}
+	if len(m.updates) != 0 {
+		t.Fatalf("limits written without stats: %+v", m.updates)
+	}
+
+	c.advance(time.Second)
+	m.statErr = nil
+	if err := s.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.updates) != 1 || m.updates[0].CPU == nil {
+		t.Errorf("got %+v, want the limits applied on the next tick", m.updates)
+	}
+	if !s.State().Applied {
+		t.Error("limits of the next tick reported as not applied")
+	}
+}
+
+// A controller without stats is neither measured nor limited, the others still are
+func TestMissingStatsSkipped(t *testing.T) {
+	c, _ := useFakeTime(t)
+	m := newFakeCgroup()
+	m.stats.Memory = nil
+	initCPUTimes(m)
+	initIOCounters(m)
+	s := newTestScaler(m, greedyPolicy{})
+
+	c.advance(time.Second)
+	snapshot, err := s.measure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snapshot.Skipped[resourceMemory] || snapshot.Skipped[resourceCPU] || !snapshot.Skipped[resourceIO] {
+		t.Errorf("got skipped %v, want memory (no stats) and io (no disk)", snapshot.Skipped)
+	}
+	if !s.warnedMissing[resourceMemory] {
+		t.Error("missing memory stats not reported")
+	}
+	if err = s.step(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.updates) != 1 {
+		t.Fatalf("got %d updates, want 1", len(m.updates))
+	}
+	if res := m.updates[0]; res.Memory != nil || res.IO != nil || res.CPU == nil {
+		t.Errorf("got %+v, want only the CPU limits", res)
+	}
+}
+
+// The constraint binding each limit, the hard ones applying over the floors
+func TestScalerStepBindings(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func()
+		memory  int64
+		binding string
+	}{
+		{"policy", nil, 512 << 20, "none"},
+		{"floor", func() { cfg.floors.memory = 1 << 30 }, 1 << 30, "floor"},
+		{
+			name: "ceiling over the floor",
+			setup: func() {
+				cfg.floors.memory = 1 << 30
+				ceiling := int64(768 << 20)
+				cfg.ceilings.Memory = &ceiling
+			},
+			memory:  768 << 20,
+			binding: "ceiling",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resetGlobals(t)
+			if test.setup != nil {
+				test.setup()
+			}
+			m := newFakeCgroup()
+			s := newTestScaler(m, fixedPolicy{Limits{MemoryMax: 512 << 20, CPUQuota: 50000, CPUPeriod: 100000}})
+			if err := s.step(testSnapshot()); err != nil {
+				t.Fatal(err)
+			}
+			if got := *m.updates[0].Memory.Max; got != test.memory {
+				t.Errorf("memory.max %d, want %d", got, test.memory)
+			}
+			if got := memoryBinding(s.lastConstraints); got != test.binding {
+				t.Errorf("memory.max bound by %q, want %q", got, test.binding)
+			}
+		})
+	}
+
+	// The baseline of the first limits is told apart from the floors
+	resetGlobals(t)
+	s := newTestScaler(newFakeCgroup(), fixedPolicy{Limits{MemoryMax: 1 << 20, CPUQuota: 50000, CPUPeriod: 100000}})
+	if err := s.step(testSnapshot()); err != nil {
+		t.Fatal(err)
+	}
+	if got := memoryBinding(s.lastConstraints); got != "baseline" {
+		t.Errorf("memory.max bound by %q, want baseline", got)
+	}
+}
+
+func memoryBinding(constraints []LimitConstraint) string {
+	for _, constraint := range constraints {
+		if constraint.Limit == "memory.max" {
+			return constraint.Binding
+		}
+	}
+	return ""
+}
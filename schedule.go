@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Schedule of margin and ceiling overrides depending on the time of day, ex:
+//
+//	{
+//	  "timezone": "Europe/Paris",
+//	  "windows": [
+//	    {"start": "22:00", "end": "06:00", "margin": 0.02},
+//	    {"start": "09:00", "end": "18:00", "days": ["mon", "tue", "wed", "thu", "fri"], "margin": 0.3, "maxMemory": "8Gi", "maxCPU": 0.5}
+//	  ]
+//	}
+//
+// The first window matching the current time is used
+type schedule struct {
+	Timezone string           `json:"timezone"`
+	Windows  []scheduleWindow `json:"windows"`
+
+	location *time.Location
+}
+
+type scheduleWindow struct {
+	Start     string   `json:"start"`          // HH:MM
+	End       string   `json:"end"`            // HH:MM, can be before start to span midnight
+	Days      []string `json:"days,omitempty"` // Days of the week the window starts on, all days if empty
+	Margin    *float64 `json:"margin,omitempty"`
+	MaxCPU    *float64 `json:"maxCPU,omitempty"`    // Fraction of the total CPU of the system
+	MaxMemory *string  `json:"maxMemory,omitempty"` // Bytes, suffixes like 8G or 512Mi are accepted
+
+	start, end int // Minutes since midnight
+	days       map[time.Weekday]bool
+	maxMemory  byteSize
+}
+
+// Overrides of the active window
+type scheduleOverrides struct {
+	window    string // Description of the window, empty if no window is active
+	margin    *float64
+	maxCPU    *float64
+	maxMemory *byteSize
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func loadSchedule(path string) (*schedule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s schedule
+	if err = json.Unmarshal(content, &s); err != nil {
+		return nil, fmt.Errorf("invalid schedule %s: %w", path, err)
+	}
+
+	s.location = time.Local
+	if s.Timezone != "" {
+		if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		if w.start, err = parseClock(w.Start); err != nil {
+			return nil, err
+		}
+		if w.end, err = parseClock(w.End); err != nil {
+			return nil, err
+		}
+		if w.Margin != nil && !validMargin(*w.Margin) {
+			return nil, fmt.Errorf("margin of window %s-%s must be in (0, 1)", w.Start, w.End)
+		}
+		if w.MaxCPU != nil && *w.MaxCPU <= 0 {
+			return nil, fmt.Errorf("maxCPU of window %s-%s must be positive", w.Start, w.End)
+		}
+		if w.MaxMemory != nil {
+			if err = w.maxMemory.Set(*w.MaxMemory); err != nil {
+				return nil, err
+			}
+		}
+		if len(w.Days) > 0 {
+			w.days = make(map[time.Weekday]bool)
+			for _, day := range w.Days {
+				weekday, ok := weekdays[strings.ToLower(day)]
+				if !ok {
+					return nil, fmt.Errorf("invalid day %q", day)
+				}
+				w.days[weekday] = true
+			}
+		}
+	}
+	return &s, nil
+}
+
+func (w *scheduleWindow) contains(t time.Time) bool {
+	minutes := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	var inside bool
+	if w.start <= w.end {
+		inside = minutes >= w.start && minutes < w.end
+	} else {
+		// Spans midnight: after midnight, the window started the day before
+		if minutes < w.end {
+			inside = true
+			day = (day + 6) % 7
+		} else {
+			inside = minutes >= w.start
+		}
+	}
+	return inside && (w.days == nil || w.days[day])
+}
+
+func (s *schedule) overrides(now time.Time) scheduleOverrides {
+	now = now.In(s.location)
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		if !w.contains(now) {
+			continue
+		}
+		o := scheduleOverrides{
+			window: w.Start + "-" + w.End,
+			margin: w.Margin,
+			maxCPU: w.MaxCPU,
+		}
+		if w.MaxMemory != nil {
+			o.maxMemory = &w.maxMemory
+		}
+		return o
+	}
+	return scheduleOverrides{}
+}
+
+// Cap the limits to the ceilings of the active window
+func (o scheduleOverrides) apply(limits *Limits) {
+	if o.maxMemory != nil && limits.MemoryMax > int64(*o.maxMemory) {
+		limits.MemoryMax = int64(*o.maxMemory)
+	}
+	if o.maxCPU != nil && limits.CPUPeriod > 0 {
+		if maxQuota := int64(*o.maxCPU * float64(limits.CPUPeriod)); limits.CPUQuota > maxQuota {
+			limits.CPUQuota = maxQuota
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// States saved with another version are ignored, e.g. when a field is renamed
+	StateVersion = 1
+	// Interval between the saves of the state while the process runs
+	StateSaveInterval = time.Minute
+)
+
+// Runtime state saved in -state-file, so that a restarted (or migrated) process-scaler resumes where
+// the previous run stopped: the last limits are applied right away instead of scaling up from the
+// baseline, the disks are not benchmarked again, and the budgets and averages are kept
+// Unlike the benchmark cache, it belongs to a single run and is only valid for it
+type State struct {
+	Version     int                        `json:"version"`
+	SavedAt     time.Time                  `json:"savedAt"`
+	Limits      Limits                     `json:"limits"`      // Last decided limits
+	AppliedOnce bool                       `json:"appliedOnce"` // Whether limits were applied, the next ones are then not raised to the baseline
+	Benchmarks  map[string]cachedBenchmark `json:"benchmarks"`  // By kernel name, invalidated like the benchmark cache
+	Budget      *budgetState               `json:"budget,omitempty"`
+	MemoryHigh  int64                      `json:"memoryHigh,omitempty"` // memory.high driven by -memory-policy psi
+	IOLatency   map[string]float64         `json:"ioLatency,omitempty"`  // Average latency of each device with -io-mode latency (µs)
+}
+
+var (
+	// State loaded from -state-file, nil if there was none
+	resumedState *State
+	// Only the first monitoring loop resumes from it
+	resumeOnce sync.Once
+)
+
+// Load the state, nil is returned if it doesn't exist or is from an incompatible version
+func loadState(path string) (*State, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var saved State
+	if err = json.Unmarshal(content, &saved); err != nil {
+		return nil, fmt.Errorf("invalid state %s: %w", path, err)
+	}
+	if saved.Version != StateVersion {
+		log.Printf("Warning: state %s is from version %d, starting from scratch\n", path, saved.Version)
+		return nil, nil
+	}
+	log.Printf("Resuming from the state saved at %s\n", saved.SavedAt.Format(time.RFC3339))
+	return &saved, nil
+}
+
+// Return the saved benchmark of the device, if it is still valid
+func (s *State) benchmark(device lsblkOutputJSON, kernel string) (maxIO, bool) {
+	if s == nil || s.Benchmarks == nil {
+		return maxIO{}, false
+	}
+	return benchmarkCache{Devices: s.Benchmarks}.get(device, kernel)
+}
+
+func (s *State) save(path string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+// Capture the state of the scaler, of the benchmarks and of the budget
+func (s *Scaler) dumpState() *State {
+	s.mu.Lock()
+	saved := &State{
+		Version:     StateVersion,
+		SavedAt:     clock.Now(),
+		Limits:      s.lastLimits,
+		AppliedOnce: s.appliedOnce,
+	}
+	s.mu.Unlock()
+
+	if s.psiMemory != nil {
+		saved.MemoryHigh = s.psiMemory.high
+	}
+	if s.ioLatency != nil {
+		saved.IOLatency = make(map[string]float64, len(s.ioLatency.average))
+		for name, average := range s.ioLatency.average {
+			saved.IOLatency[name] = average
+		}
+	}
+	if resourceBudget != nil {
+		consumed := resourceBudget.consumption()
+		saved.Budget = &consumed
+	}
+
+	benchmarks := benchmarkCache{Devices: make(map[string]cachedBenchmark)}
+	kernel := kernelRelease()
+	for name, device := range lsblk {
+		if max, exists := getBenchmark(name); exists && max.trusted() {
+			benchmarks.set(device, kernel, max)
+		}
+	}
+	saved.Benchmarks = benchmarks.Devices
+	return saved
+}
+
+// Save the state to -state-file, at most every StateSaveInterval unless forced
+func (s *Scaler) saveState(force bool) {
+	if cfg.stateFile == "" || (!force && clock.Now().Sub(s.stateSavedAt) < StateSaveInterval) {
+		return
+	}
+	s.stateSavedAt = clock.Now()
+	if err := s.dumpState().save(cfg.stateFile); err != nil {
+		log.Printf("Warning: could not save the state %s: %s\n", cfg.stateFile, err)
+	}
+}
+
+// Continue from a saved state: its last limits are applied right away
+func (s *Scaler) resume(saved *State) {
+	if s.psiMemory != nil {
+		s.psiMemory.high = saved.MemoryHigh
+	}
+	if s.ioLatency != nil {
+		for name, average := range saved.IOLatency {
+			s.ioLatency.average[name] = average
+		}
+	}
+
+	s.mu.Lock()
+	s.lastLimits = saved.Limits
+	s.mu.Unlock()
+	if !saved.AppliedOnce || cfg.dryRun {
+		return
+	}
+	// The IO limits of the devices that are gone are not applied
+	limits := saved.Limits
+	applyCPUMode(&limits)
+	limits.IO = nil
+	for _, entry := range saved.Limits.IO {
+		for _, device := range lsblk {
+			if device.MajMin == fmt.Sprintf("%d:%d", entry.Major, entry.Minor) {
+				limits.IO = append(limits.IO, entry)
+				break
+			}
+		}
+	}
+	res := limits.without(cfg.unmanaged).resources()
+	if err := s.cgManager.Update(&res); err != nil {
+		softFailError(newCgroupUpdateError(err), "scaling up from the baseline again")
+		return
+	}
+	s.appliedOnce = true
+}
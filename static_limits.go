@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"github.com/containerd/cgroups/v3/cgroup2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Limits that are not scaled, applied once when the cgroup is created
+type staticLimits struct {
+	hugetlb2MB byteSize
+	hugetlb1GB byteSize
+	misc       miscLimits
+	cpuset     cpuSet // Cores the processes may run on, nil for all
+}
+
+// misc controller limits, ex: -misc-max res_a=1 -misc-max res_b=2
+type miscLimits map[string]uint64
+
+func (m *miscLimits) String() string {
+	entries := make([]string, 0, len(*m))
+	for key, value := range *m {
+		entries = append(entries, fmt.Sprintf("%s=%d", key, value))
+	}
+	return strings.Join(entries, ",")
+}
+
+func (m *miscLimits) Set(value string) error {
+	key, limit, found := strings.Cut(value, "=")
+	if !found || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	n, err := strconv.ParseUint(limit, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid limit for %s: %q", key, limit)
+	}
+	if *m == nil {
+		*m = make(miscLimits)
+	}
+	(*m)[key] = n
+	return nil
+}
+
+// Controllers needed by the static limits
+func (s staticLimits) controllers() []string {
+	var controllers []string
+	if s.hugetlb2MB > 0 || s.hugetlb1GB > 0 {
+		controllers = append(controllers, "hugetlb")
+	}
+	if len(s.misc) > 0 {
+		controllers = append(controllers, "misc")
+	}
+	if s.cpuset != nil {
+		controllers = append(controllers, "cpuset")
+	}
+	return controllers
+}
+
+func (s staticLimits) apply(m cgroupManager, cgroupPath string) error {
+	var hugetlb cgroup2.HugeTlb
+	if s.hugetlb2MB > 0 {
+		hugetlb = append(hugetlb, cgroup2.HugeTlbEntry{HugePageSize: "2MB", Limit: uint64(s.hugetlb2MB)})
+	}
+	if s.hugetlb1GB > 0 {
+		hugetlb = append(hugetlb, cgroup2.HugeTlbEntry{HugePageSize: "1GB", Limit: uint64(s.hugetlb1GB)})
+	}
+	if len(hugetlb) > 0 {
+		if err := m.Update(&cgroup2.Resources{HugeTlb: &hugetlb}); err != nil {
+			return newCgroupUpdateError(err)
+		}
+	}
+
+	if s.cpuset != nil {
+		if err := m.Update(&cgroup2.Resources{CPU: &cgroup2.CPU{Cpus: s.cpuset.String()}}); err != nil {
+			return newCgroupUpdateError(err)
+		}
+	}
+
+	// The containerd API doesn't support the misc controller, write misc.max directly
+	for key, limit := range s.misc {
+		line := fmt.Sprintf("%s %d", key, limit)
+		if err := os.WriteFile(filepath.Join(cgroupPath, "misc.max"), []byte(line), 0); err != nil {
+			return &CgroupUpdateError{Resource: "misc", Cause: fmt.Errorf("could not set misc.max %s: %w", line, err)}
+		}
+	}
+	return nil
+}
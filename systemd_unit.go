@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/coreos/go-systemd/v22/dbus"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Prefix of the keys of a unit file read as options, named after the flags, ex:
+//
+//	[Service]
+//	X-ProcessScaler-reserve-memory=2G
+//	X-ProcessScaler-policy=target
+//
+// systemd ignores the keys starting with X-, so that the policy can live with the service definition
+const UnitOptionPrefix = "X-ProcessScaler-"
+
+// Read the options set in the unit file of a unit and its drop-ins, by flag name
+// With unit "auto", the unit is the one of the process pid
+func unitOptions(unit string, pid int) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := dbus.NewWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to systemd: %w", err)
+	}
+	defer conn.Close()
+
+	if unit == "auto" {
+		if pid == 0 {
+			return nil, errors.New("-systemd-unit auto requires -pid")
+		}
+		if unit, err = conn.GetUnitNameByPID(ctx, uint32(pid)); err != nil {
+			return nil, fmt.Errorf("could not find the unit of process %d: %w", pid, err)
+		}
+	}
+
+	var files []string
+	fragment, err := conn.GetUnitPropertyContext(ctx, unit, "FragmentPath")
+	if err != nil {
+		return nil, fmt.Errorf("could not get the unit file of %s: %w", unit, err)
+	}
+	if path, ok := fragment.Value.Value().(string); ok && path != "" {
+		files = append(files, path)
+	}
+	// Drop-ins override the unit file
+	if dropIns, err := conn.GetUnitPropertyContext(ctx, unit, "DropInPaths"); err == nil {
+		if paths, ok := dropIns.Value.Value().([]string); ok {
+			files = append(files, paths...)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("unit %s has no unit file", unit)
+	}
+
+	options := make(map[string]string)
+	for _, path := range files {
+		if err = readUnitOptions(path, options); err != nil {
+			return nil, err
+		}
+	}
+	slog.Info("Read options from unit", "unit", unit, "options", len(options))
+	return options, nil
+}
+
+func readUnitOptions(path string, options map[string]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, UnitOptionPrefix) {
+			continue
+		}
+		key, value, found := strings.Cut(strings.TrimPrefix(line, UnitOptionPrefix), "=")
+		if !found {
+			return fmt.Errorf("%s: expected %s<option>=<value>, got %q", path, UnitOptionPrefix, line)
+		}
+		options[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return scanner.Err()
+}
+
+// Set the flags from options (of the unit or of the config file), by flag name, the flags already set
+// (e.g. on the command line) take precedence. origin describes where an option comes from in errors
+func applyOptions(options map[string]string, origin func(name string) string) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for name, value := range options {
+		if explicit[name] {
+			continue
+		}
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %s", origin(name))
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid option %s=%s: %w", origin(name), value, err)
+		}
+	}
+	return nil
+}
+
+func unitOptionOrigin(name string) string {
+	return UnitOptionPrefix + name
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Signals accepted by -stop-signal
+var signalNames = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signalNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal %s", name)
+	}
+	return sig, nil
+}
+
+// Stops the child and all its descendants, which are in their own process group
+type terminator struct {
+	proc     *exec.Cmd
+	exited   chan struct{} // Closed once the child has been reaped
+	hurry    chan struct{} // Closed on a second stop request, to kill without waiting for the grace period
+	detached chan struct{} // Closed when process-scaler is asked to stop with -detach, the child is left running
+	once     sync.Once
+	stopping bool
+	mu       sync.Mutex
+	kill     func(pid int, sig syscall.Signal) error // syscall.Kill, replaced by the tests
+}
+
+func newTerminator(proc *exec.Cmd) *terminator {
+	return &terminator{
+		proc:     proc,
+		exited:   make(chan struct{}),
+		hurry:    make(chan struct{}),
+		detached: make(chan struct{}),
+		kill:     syscall.Kill,
+	}
+}
+
+// Must be called once the child has been reaped
+func (t *terminator) reaped() {
+	close(t.exited)
+}
+
+// Whether the child was stopped by process-scaler
+func (t *terminator) requested() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stopping
+}
+
+// Send the stop signal to the process group, then SIGKILL if it is still running after the grace period
+func (t *terminator) stop(reason string) {
+	t.once.Do(func() {
+		t.mu.Lock()
+		t.stopping = true
+		t.mu.Unlock()
+
+		// Negative PID: the whole process group, so that grandchildren are not orphaned
+		pgid := t.proc.Process.Pid
+		log.Printf("Stopping process group %d (%s) with %s\n", pgid, reason, cfg.stopSignal)
+		if err := t.kill(-pgid, cfg.stopSignal); err != nil {
+			log.Printf("Could not signal process group %d: %s\n", pgid, err)
+		}
+
+		select {
+		case <-t.exited:
+			return
+		case <-time.After(cfg.stopGrace):
+			log.Printf("Process group %d still running after %s, killing it\n", pgid, cfg.stopGrace)
+		case <-t.hurry:
+			log.Printf("Asked again to stop, killing process group %d\n", pgid)
+		}
+		_ = t.kill(-pgid, syscall.SIGKILL)
+	})
+}
+
+// Stop the child when process-scaler is asked to stop, a second signal (e.g. Ctrl-C twice) kills it
+// without waiting for the grace period, the cgroup is torn down once it has exited either way
+func (t *terminator) handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go t.watchSignals(signals)
+}
+
+func (t *terminator) watchSignals(signals <-chan os.Signal) {
+	sig := <-signals
+	if cfg.detach {
+		log.Printf("Received %s, detaching from the process\n", sig)
+		close(t.detached)
+		return
+	}
+	go t.stop(fmt.Sprintf("received %s", sig))
+	select {
+	case <-signals:
+		close(t.hurry)
+	case <-t.exited:
+	}
+}
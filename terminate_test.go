@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type sentSignal struct {
+	pid int
+	sig syscall.Signal
+}
+
+// Terminator of a child that is never signaled, the signals sent to it are recorded instead
+func newTestTerminator(t *testing.T) (*terminator, func() []sentSignal, <-chan struct{}) {
+	resetGlobals(t)
+	cfg.stopSignal = syscall.SIGTERM
+	cfg.stopGrace = time.Minute
+
+	var mu sync.Mutex
+	var sent []sentSignal
+	signaled := make(chan struct{}, 10)
+	term := newTerminator(&exec.Cmd{Process: &os.Process{Pid: 4242}})
+	term.kill = func(pid int, sig syscall.Signal) error {
+		mu.Lock()
+		sent = append(sent, sentSignal{pid, sig})
+		mu.Unlock()
+		signaled <- struct{}{}
+		return nil
+	}
+	return term, func() []sentSignal {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]sentSignal(nil), sent...)
+	}, signaled
+}
+
+func waitSignaled(t *testing.T, signaled <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-signaled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the process group was not signaled")
+	}
+}
+
+// A second signal kills the process group, the stop signal is still sent once
+func TestSecondSignalKills(t *testing.T) {
+	term, sent, signaled := newTestTerminator(t)
+	signals := make(chan os.Signal, 2)
+	go term.watchSignals(signals)
+
+	signals <- syscall.SIGINT
+	waitSignaled(t, signaled)
+	signals <- syscall.SIGINT
+	waitSignaled(t, signaled)
+	term.reaped()
+	// The monitoring failing as the child exits doesn't stop it again
+	term.stop("monitoring failed")
+
+	want := []sentSignal{{-4242, syscall.SIGTERM}, {-4242, syscall.SIGKILL}}
+	if got := sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+	if !term.requested() {
+		t.Error("stop not reported as requested")
+	}
+}
+
+// A child exiting on the stop signal is not killed
+func TestStoppedChildNotKilled(t *testing.T) {
+	term, sent, signaled := newTestTerminator(t)
+	signals := make(chan os.Signal, 2)
+	go term.watchSignals(signals)
+
+	signals <- syscall.SIGTERM
+	waitSignaled(t, signaled)
+	term.reaped()
+	// Returns once the first stop has
+	term.stop("monitoring failed")
+
+	want := []sentSignal{{-4242, syscall.SIGTERM}}
+	if got := sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+}
+
+// With -detach, a signal leaves the child running
+func TestSignalDetaches(t *testing.T) {
+	term, sent, _ := newTestTerminator(t)
+	cfg.detach = true
+	signals := make(chan os.Signal, 2)
+	go term.watchSignals(signals)
+
+	signals <- syscall.SIGTERM
+	select {
+	case <-term.detached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not detached")
+	}
+	if got := sent(); len(got) != 0 || term.requested() {
+		t.Errorf("sent %v to a detached child", got)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time, ex: go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD)"
+var (
+	version = ""
+	commit  = ""
+)
+
+// Version, commit and Go version, falling back to the build info embedded by the Go toolchain
+func versionInfo() string {
+	v, c, modified := version, commit, false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if c == "" {
+					c = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	if c == "" {
+		c = "unknown"
+	} else if modified {
+		c += "-dirty"
+	}
+	return fmt.Sprintf("process-scaler %s\ncommit: %s\ngo: %s %s/%s", v, c, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}